@@ -21,9 +21,15 @@ var (
 func NewRouter(t *ctx.Tracer) *gin.Engine {
 	router := api.Router.SetupRouter()
 	router.GET("/"+apiVersion+"/pods", t.LocalPodsGet)
+	router.GET("/"+apiVersion+"/pods/watch", t.LocalPodsWatch)
+	router.GET("/"+apiVersion+"/health", t.HealthGet)
 	router.GET("/"+apiVersion+"/trace-hooks", t.TraceHooksGet)
+	router.POST("/"+apiVersion+"/trace-hooks/rescan", t.TraceHooksRescan)
+	router.GET("/"+apiVersion+"/trace-resources", t.TraceResourcesGet)
 	router.POST("/"+apiVersion+"/trace-session", t.TraceSessionPost)
 	router.GET("/"+apiVersion+"/trace-session/:id", t.TraceSessionGet)
+	router.GET("/"+apiVersion+"/trace-session/:id/processes", t.TraceSessionProcessesGet)
+	router.GET("/"+apiVersion+"/trace-session/:id/events", t.TraceSessionEventsGet)
 	router.PUT("/"+apiVersion+"/trace-session/:id", t.TraceSessionPut)
 	router.DELETE("/"+apiVersion+"/trace-session/:id", t.TraceSessionDel)
 	return router
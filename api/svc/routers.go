@@ -20,9 +20,14 @@ var (
 func NewRouter(t *ctx.TraceKube) *gin.Engine {
 	router := api.Router.SetupRouter()
 	router.GET("/"+apiVersion+"/pods", t.ProxyAllMap)
+	router.GET("/"+apiVersion+"/pods/watch", t.ProxyAllStream)
+	router.GET("/"+apiVersion+"/health", t.ProxyAllMap)
 	router.GET("/"+apiVersion+"/trace-hooks", t.ProxyAnyMap)
+	router.POST("/"+apiVersion+"/trace-hooks/rescan", t.ProxyAllMap)
+	router.GET("/"+apiVersion+"/trace-resources", t.ProxyAllMap)
 	router.POST("/"+apiVersion+"/trace-session", t.ProxyAllMap)
 	router.GET("/"+apiVersion+"/trace-session/:id", t.ProxyAllMap)
+	router.GET("/"+apiVersion+"/trace-session/:id/processes", t.ProxyAllMap)
 	router.PUT("/"+apiVersion+"/trace-session/:id", t.ProxyAllMap)
 	router.DELETE("/"+apiVersion+"/trace-session/:id", t.ProxyAllMap)
 	return router
@@ -9,8 +9,21 @@
    -address string
 		IP address and port in format IP:port, used for listening for incoming API requests.
 		Can be passed using TRACER_API_ADDRESS environment variable as well
-  -cri-endpoint string
-		Path to the CRI endpoint. Can be passed using TRACER_CRI_ENDPOINT environment variable as well.
+  -cri-endpoint value
+		Path to the CRI endpoint. Can be specified more than once, to merge the containers of multiple runtimes.
+		Can be passed using TRACER_CRI_ENDPOINT environment variable as well.
+  -hook-cpu-limit uint
+		Limit of the CPU time of each trace hook process in seconds, 0 for no limit.
+		Can be passed using TRACER_HOOK_CPU_LIMIT environment variable as well.
+  -hook-memory-limit uint
+		Limit of the address space of each trace hook process in MiB, 0 for no limit.
+		Can be passed using TRACER_HOOK_MEMORY_LIMIT environment variable as well.
+  -hook-start-timeout duration
+		Time to wait for a trace hook to start, 5s by default.
+		Can be passed using TRACER_HOOK_START_TIMEOUT environment variable as well.
+  -hook-stop-timeout duration
+		Time to wait for a trace hook to stop, before sending SIGTERM and then SIGKILL to it, 5s by default.
+		Can be passed using TRACER_HOOK_STOP_TIMEOUT environment variable as well.
   -jaeger-endpoint string
 		URL or name of the jaeger endpoint service, used to send collected traces.
 		Can be passed using TRACER_JEAGER_ENDPOINT environment variable as well.
@@ -27,6 +40,9 @@
 		Can be passed using TRACER_RUN_PATHS environment variable as well.
   -sysfs-path string
 		Path to the /sys fs mount point. Can be passed using TRACER_SYSFS_PATH environment variable as well.
+  -tracefs-path string
+		Path to the tracefs mount point, used by the native trace hooks. Auto detected if not set.
+		Can be passed using TRACER_TRACEFS_PATH environment variable as well.
   -trace-hooks string
 		Location of the directory with trace helper applications.
 		Can be passed using TRACER_HOOKS environment variable as well.
@@ -44,8 +60,13 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	api "github.com/vmware-labs/container-tracer/api/node"
 	"github.com/vmware-labs/container-tracer/internal/logger"
@@ -100,6 +121,7 @@ func (arr *stringsFlag) Set(s string) error {
 
 func getConfig() (*trace.TracerConfig, *string) {
 	var runPathsArg stringsFlag
+	var criEndpointsArg stringsFlag
 	cfg := trace.TracerConfig{}
 
 	flApiAddr := flag.String("address", "",
@@ -114,13 +136,29 @@ func getConfig() (*trace.TracerConfig, *string) {
 		fmt.Sprintf("Path to the /proc fs mount point. Can be passed using %s environment variable as well.", hooks.EnvProcfs))
 	cfg.Hook.Sysfs = flag.String("sysfs-path", "",
 		fmt.Sprintf("Path to the /sys fs mount point. Can be passed using %s environment variable as well.", hooks.EnvSysfs))
+	cfg.Hook.Tracefs = flag.String("tracefs-path", "",
+		fmt.Sprintf("Path to the tracefs mount point, used by the native trace hooks. Auto detected if not set. Can be passed using %s environment variable as well.", hooks.EnvTracefs))
+	cfg.Hook.StartTimeout = flag.Duration("hook-start-timeout", 0,
+		fmt.Sprintf("Time to wait for a trace hook to start, %v by default. Can be passed using %s environment variable as well.", hooks.DefaultStartTimeout, hooks.EnvStartTimeout))
+	cfg.Hook.StopTimeout = flag.Duration("hook-stop-timeout", 0,
+		fmt.Sprintf("Time to wait for a trace hook to stop, before sending SIGTERM and then SIGKILL to it, %v by default. Can be passed using %s environment variable as well.", hooks.DefaultStopTimeout, hooks.EnvStopTimeout))
+	cfg.Hook.CpuLimit = flag.Uint64("hook-cpu-limit", 0,
+		fmt.Sprintf("Limit of the CPU time of each trace hook process in seconds, 0 for no limit. Can be passed using %s environment variable as well.", hooks.EnvCpuLimit))
+	cfg.Hook.MemoryLimit = flag.Uint64("hook-memory-limit", 0,
+		fmt.Sprintf("Limit of the address space of each trace hook process in MiB, 0 for no limit. Can be passed using %s environment variable as well.", hooks.EnvMemoryLimit))
 	cfg.Hook.HooksPath = flag.String("trace-hooks", "",
 		fmt.Sprintf("Location of the directory with trace helper applications. Can be passed using %s environment variable as well.", hooks.EnvHooks))
+	cfg.Hook.StateFile = flag.String("state-file", "",
+		fmt.Sprintf("File with the trace instances and dynamic events, owned by the tracer, %s by default. Can be passed using %s environment variable as well.", hooks.DefaultStateFile, hooks.EnvStateFile))
+	cfg.Hook.OrphanPolicy = flag.String("orphan-policy", "",
+		fmt.Sprintf("What to do with the orphaned trace instances and dynamic events: %s, %s or %s, %s by default. Can be passed using %s environment variable as well.", hooks.OrphanKeep, hooks.OrphanRemove, hooks.OrphanRemoveAll, hooks.DefaultOrphanPolicy, hooks.EnvOrphanPolicy))
+	cfg.Hook.PolicyFile = flag.String("hook-policy", "",
+		fmt.Sprintf("File with the allowed hook managers and hooks, and the SHA-256 digests of their files. All hooks are allowed if not set. Can be passed using %s environment variable as well.", hooks.EnvHookPolicy))
 
 	flag.Var(&runPathsArg, "run-path",
 		fmt.Sprintf("Path to the run directories, to look for cri endpoints. Can be passed using %s environment variable as well.", pods.EnvRunPaths))
-	cfg.Pod.Cri.Endpoint = flag.String("cri-endpoint", "",
-		fmt.Sprintf("Path to the CRI endpoint. Can be passed using %s environment variable as well.", pods.EnvCri))
+	flag.Var(&criEndpointsArg, "cri-endpoint",
+		fmt.Sprintf("Path to the CRI endpoint. Can be specified more than once, to merge the containers of multiple runtimes. Can be passed using %s environment variable as well.", pods.EnvCri))
 	cfg.Pod.Cri.PodName = flag.String("pod-name", "",
 		fmt.Sprintf("Name of the tracer pod, used to verify the CRI endpoint. Can be passed using %s environment variable as well.", pods.EnvPodName))
 	cfg.Pod.ForceProc = flag.Bool("use-procfs", false,
@@ -157,6 +195,30 @@ func getConfig() (*trace.TracerConfig, *string) {
 		a := os.Getenv(hooks.EnvSysfs)
 		cfg.Hook.Sysfs = &a
 	}
+	if *cfg.Hook.Tracefs == "" {
+		a := os.Getenv(hooks.EnvTracefs)
+		cfg.Hook.Tracefs = &a
+	}
+	if *cfg.Hook.StartTimeout == 0 {
+		if a, err := time.ParseDuration(os.Getenv(hooks.EnvStartTimeout)); err == nil {
+			cfg.Hook.StartTimeout = &a
+		}
+	}
+	if *cfg.Hook.StopTimeout == 0 {
+		if a, err := time.ParseDuration(os.Getenv(hooks.EnvStopTimeout)); err == nil {
+			cfg.Hook.StopTimeout = &a
+		}
+	}
+	if *cfg.Hook.CpuLimit == 0 {
+		if a, err := strconv.ParseUint(os.Getenv(hooks.EnvCpuLimit), 10, 64); err == nil {
+			cfg.Hook.CpuLimit = &a
+		}
+	}
+	if *cfg.Hook.MemoryLimit == 0 {
+		if a, err := strconv.ParseUint(os.Getenv(hooks.EnvMemoryLimit), 10, 64); err == nil {
+			cfg.Hook.MemoryLimit = &a
+		}
+	}
 	if *cfg.Hook.HooksPath == "" {
 		a := os.Getenv(hooks.EnvHooks)
 		cfg.Hook.HooksPath = &a
@@ -164,11 +226,22 @@ func getConfig() (*trace.TracerConfig, *string) {
 	if *cfg.Hook.HooksPath == "" {
 		cfg.Hook.HooksPath = &hooks.DefaultHookPath
 	}
-
-	if *cfg.Pod.Cri.Endpoint == "" {
-		a := os.Getenv(pods.EnvCri)
-		cfg.Pod.Cri.Endpoint = &a
+	if *cfg.Hook.StateFile == "" {
+		a := os.Getenv(hooks.EnvStateFile)
+		cfg.Hook.StateFile = &a
 	}
+	if *cfg.Hook.StateFile == "" {
+		cfg.Hook.StateFile = &hooks.DefaultStateFile
+	}
+	if *cfg.Hook.OrphanPolicy == "" {
+		a := os.Getenv(hooks.EnvOrphanPolicy)
+		cfg.Hook.OrphanPolicy = &a
+	}
+	if *cfg.Hook.PolicyFile == "" {
+		a := os.Getenv(hooks.EnvHookPolicy)
+		cfg.Hook.PolicyFile = &a
+	}
+
 	if *cfg.Pod.ForceProc == false {
 		if _, ok := os.LookupEnv(pods.EnvForceProcfs); ok {
 			a := true
@@ -191,6 +264,11 @@ func getConfig() (*trace.TracerConfig, *string) {
 	}
 	cfg.Pod.Cri.RunPaths = runPathsArg
 
+	if len(criEndpointsArg) == 0 {
+		criEndpointsArg.Set(os.Getenv(pods.EnvCri))
+	}
+	cfg.Pod.Cri.Endpoints = criEndpointsArg
+
 	return &cfg, flApiAddr
 }
 
@@ -202,7 +280,8 @@ func main() {
 
 	flag.Usage = usage
 
-	ctx, cancel := context.WithCancel(context.Background())
+	/* Stop the trace sessions and clean up the trace hooks on termination */
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
 	cfg, addr := getConfig()
@@ -213,10 +292,19 @@ func main() {
 	defer t.Destroy()
 
 	router := api.NewRouter(t)
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: router,
+	}
 
 	log.Printf("Listening for incoming API requests at %s", *addr)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Failed to run the server:", err)
+		}
+	}()
 
-	if err = router.Run(*addr); err != nil {
-		log.Fatal("Failed to run the server:", err)
-	}
+	<-ctx.Done()
+	log.Printf("Shutting down")
+	srv.Shutdown(context.Background())
 }
@@ -0,0 +1,427 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Native access to the ftrace sub-system of the Linux kernel, through the tracefs file system.
+ */
+package ftrace
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	tracefsType   = "tracefs"
+	debugfsType   = "debugfs"
+	sysfsDefault  = "/sys"
+	instancesDir  = "instances"
+	eventsDir     = "events"
+	optionsDir    = "options"
+	tracePipeFile = "trace_pipe"
+
+	dynamicEventsFile = "dynamic_events"
+
+	/* Locations of the tracefs, relative to the /sys mount point */
+	tracefsDefault = []string{
+		"kernel/tracing",
+		"kernel/debug/tracing",
+	}
+
+	tracefsMagic = int64(0x74726163)
+	debugfsMagic = int64(0x64626720)
+)
+
+type Tracefs struct {
+	Dir  string /* Mount point of the tracefs */
+	fake bool   /* A plain directory, used for testing. Missing files are created on write */
+}
+
+type Instance struct {
+	Name string
+	Dir  string
+	fs   *Tracefs
+}
+
+/* Use the tracefs, mounted in the given directory. It must be a tracefs or debugfs mount point */
+func New(dir string) (*Tracefs, error) {
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		return nil, fmt.Errorf("Invalid tracefs directory %s", dir)
+	}
+	t := &Tracefs{Dir: dir}
+	if !t.isReal() {
+		return nil, fmt.Errorf("%s is not a tracefs or debugfs mount point", dir)
+	}
+	return t, nil
+}
+
+/*
+ * Use a plain directory as a fake tracefs, for testing. The missing files are created on write
+ * and the kernel is emulated when adding and removing dynamic events.
+ */
+func NewFake(dir string) (*Tracefs, error) {
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		return nil, fmt.Errorf("Invalid tracefs directory %s", dir)
+	}
+	return &Tracefs{Dir: dir, fake: true}, nil
+}
+
+/* Look for tracefs or debugfs in the mounts of the given procfs */
+func findMount(procfs, sysfs string) string {
+	file, err := os.Open(filepath.Join(procfs, "mounts"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	traceMount := ""
+	debugMount := ""
+	scan := bufio.NewScanner(file)
+	for scan.Scan() {
+		words := strings.Fields(scan.Text())
+		if len(words) < 3 {
+			continue
+		}
+		if words[2] == tracefsType {
+			traceMount = words[1]
+			break
+		}
+		if words[2] == debugfsType && debugMount == "" {
+			debugMount = filepath.Join(words[1], "tracing")
+		}
+	}
+	if traceMount == "" {
+		traceMount = debugMount
+	}
+	if traceMount == "" {
+		return ""
+	}
+
+	/* The mounts are relative to the host, translate them to the custom /sys mount point */
+	if sysfs != sysfsDefault && strings.HasPrefix(traceMount, sysfsDefault+"/") {
+		traceMount = filepath.Join(sysfs, strings.TrimPrefix(traceMount, sysfsDefault))
+	}
+	if st, err := os.Stat(traceMount); err == nil && st.IsDir() {
+		return traceMount
+	}
+
+	return ""
+}
+
+/* Look for the tracefs in the mounts, or in the default locations under the sysfs */
+func findDir(procfs, sysfs string) string {
+	if d := findMount(procfs, sysfs); d != "" {
+		return d
+	}
+	for _, d := range tracefsDefault {
+		p := filepath.Join(sysfs, d)
+		if st, err := os.Stat(filepath.Join(p, instancesDir)); err == nil && st.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
+
+/* Find the mount point of the tracefs, using the given /proc and /sys mount points */
+func Find(procfs, sysfs string) (*Tracefs, error) {
+	if procfs == "" {
+		procfs = "/proc"
+	}
+	if sysfs == "" {
+		sysfs = sysfsDefault
+	}
+
+	d := findDir(procfs, sysfs)
+	if d == "" {
+		return nil, fmt.Errorf("Failed to find ftrace mount point")
+	}
+	return New(d)
+}
+
+/* Check if the directory is on a real tracefs or debugfs */
+func (t *Tracefs) isReal() bool {
+	var st syscall.Statfs_t
+
+	if err := syscall.Statfs(t.Dir, &st); err != nil {
+		return false
+	}
+	return int64(st.Type) == tracefsMagic || int64(st.Type) == debugfsMagic
+}
+
+/* Create a new ftrace instance with the given name */
+func (t *Tracefs) CreateInstance(name string) (*Instance, error) {
+	i := &Instance{
+		Name: name,
+		Dir:  filepath.Join(t.Dir, instancesDir, name),
+		fs:   t,
+	}
+	if err := os.Mkdir(i.Dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+/* Get an existing ftrace instance */
+func (t *Tracefs) GetInstance(name string) (*Instance, error) {
+	d := filepath.Join(t.Dir, instancesDir, name)
+	if st, err := os.Stat(d); err != nil || !st.IsDir() {
+		return nil, fmt.Errorf("Cannot find ftrace instance %s", name)
+	}
+
+	return &Instance{Name: name, Dir: d, fs: t}, nil
+}
+
+/* Get all ftrace instances, which names start with the given prefix */
+func (t *Tracefs) Instances(prefix string) ([]*Instance, error) {
+	res := []*Instance{}
+
+	dir, err := os.ReadDir(filepath.Join(t.Dir, instancesDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dir {
+		if d.IsDir() && strings.HasPrefix(d.Name(), prefix) {
+			res = append(res, &Instance{
+				Name: d.Name(),
+				Dir:  filepath.Join(t.Dir, instancesDir, d.Name()),
+				fs:   t,
+			})
+		}
+	}
+
+	return res, nil
+}
+
+/* Get all events of a trace system */
+func (t *Tracefs) Events(system string) ([]string, error) {
+	res := []string{}
+
+	dir, err := os.ReadDir(filepath.Join(t.Dir, eventsDir, system))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dir {
+		if d.IsDir() {
+			res = append(res, d.Name())
+		}
+	}
+
+	return res, nil
+}
+
+/*
+ * Remove the instance. The files of a real tracefs instance cannot be deleted, the kernel removes
+ * them together with the directory. The removal fails while the trace_pipe of the instance is open.
+ */
+func (i *Instance) Remove() error {
+	if i.fs.fake {
+		return os.RemoveAll(i.Dir)
+	}
+	return os.Remove(i.Dir)
+}
+
+func (i *Instance) write(file, val string) error {
+	if i.fs.fake {
+		os.MkdirAll(filepath.Dir(filepath.Join(i.Dir, file)), 0750)
+	}
+	f, err := os.OpenFile(filepath.Join(i.Dir, file), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString(val); err != nil {
+		return fmt.Errorf("Failed to write \"%s\" to %s: %v", val, file, err)
+	}
+	return nil
+}
+
+func (i *Instance) read(file string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(i.Dir, file))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func boolValue(on bool) string {
+	if on {
+		return "1"
+	}
+	return "0"
+}
+
+func pidsValue(pids []int) string {
+	res := []string{}
+	for _, p := range pids {
+		res = append(res, strconv.Itoa(p))
+	}
+	return strings.Join(res, " ")
+}
+
+/* Trace events only from the given tasks. An empty list clears the filter */
+func (i *Instance) SetEventPid(pids []int) error {
+	return i.write("set_event_pid", pidsValue(pids))
+}
+
+/* Trace functions only from the given tasks. An empty list clears the filter */
+func (i *Instance) SetFtracePid(pids []int) error {
+	return i.write("set_ftrace_pid", pidsValue(pids))
+}
+
+func eventPath(system, event, file string) string {
+	p := eventsDir
+	if system != "" {
+		p = filepath.Join(p, system)
+		if event != "" {
+			p = filepath.Join(p, event)
+		}
+	}
+	return filepath.Join(p, file)
+}
+
+/* Enable or disable an event. If the event is empty, all events of the system are changed */
+func (i *Instance) EnableEvent(system, event string, on bool) error {
+	return i.write(eventPath(system, event, "enable"), boolValue(on))
+}
+
+/* Set a filter on an event. If the event is empty, the filter is set on all events of the system */
+func (i *Instance) SetFilter(system, event, filter string) error {
+	return i.write(eventPath(system, event, "filter"), filter)
+}
+
+func (i *Instance) ClearFilter(system, event string) error {
+	return i.write(eventPath(system, event, "filter"), "0")
+}
+
+/* Set a trace option, i.e. event-fork */
+func (i *Instance) SetOption(name string, on bool) error {
+	return i.write(filepath.Join(optionsDir, name), boolValue(on))
+}
+
+func (i *Instance) TracingOn(on bool) error {
+	return i.write("tracing_on", boolValue(on))
+}
+
+func (i *Instance) IsTracingOn() bool {
+	v, err := i.read("tracing_on")
+	return err == nil && v == "1"
+}
+
+/* Path to the trace_pipe of the instance, where the recorded events can be read */
+func (i *Instance) TracePipe() string {
+	return filepath.Join(i.Dir, tracePipeFile)
+}
+
+/* Open the trace_pipe of the instance. The reads block until events are recorded, closing it unblocks them */
+func (i *Instance) OpenTracePipe() (*os.File, error) {
+	if i.fs.fake {
+		if _, err := os.Stat(i.TracePipe()); os.IsNotExist(err) {
+			i.write(tracePipeFile, "")
+		}
+	}
+	return os.Open(i.TracePipe())
+}
+
+/* Add a kprobe, kretprobe, uprobe, uretprobe or tracepoint probe, i.e. "p:group/event do_sys_open dfd=%di" */
+func (t *Tracefs) AddDynamicEvent(def string) error {
+	/* Truncating the file removes all dynamic events */
+	flags := os.O_WRONLY | os.O_APPEND
+	if t.fake {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(filepath.Join(t.Dir, dynamicEventsFile), flags, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString(def + "\n"); err != nil {
+		return fmt.Errorf("Failed to add dynamic event \"%s\": %v", def, err)
+	}
+	if t.fake {
+		/* Emulate the kernel, which creates the event */
+		if g, e := dynamicEventName(def); e != "" {
+			os.MkdirAll(filepath.Join(t.Dir, eventsDir, g, e), 0750)
+		}
+	}
+	return nil
+}
+
+/* Get group and name of a dynamic event from its definition */
+func dynamicEventName(def string) (string, string) {
+	words := strings.Fields(def)
+	if len(words) < 1 {
+		return "", ""
+	}
+	name := strings.SplitN(words[0], ":", 2)
+	if len(name) < 2 {
+		return "", ""
+	}
+	ge := strings.SplitN(name[1], "/", 2)
+	if len(ge) < 2 {
+		return "", ge[0]
+	}
+	return ge[0], ge[1]
+}
+
+/* Get all dynamic events of a group, as "<group>/<event>". If the group is empty, all are returned */
+func (t *Tracefs) DynamicEvents(group string) ([]string, error) {
+	res := []string{}
+
+	data, err := os.ReadFile(filepath.Join(t.Dir, dynamicEventsFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		g, e := dynamicEventName(l)
+		if e == "" || strings.HasPrefix(l, "-") {
+			continue
+		}
+		if group == "" || g == group {
+			res = append(res, g+"/"+e)
+		}
+	}
+
+	return res, nil
+}
+
+/* Remove a dynamic event, given as "<group>/<event>". The event must be disabled in all instances */
+func (t *Tracefs) RemoveDynamicEvent(event string) error {
+	if t.fake {
+		return t.removeFakeDynamicEvent(event)
+	}
+
+	f, err := os.OpenFile(filepath.Join(t.Dir, dynamicEventsFile), os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString("-:" + event + "\n"); err != nil {
+		return fmt.Errorf("Failed to remove dynamic event %s: %v", event, err)
+	}
+	return nil
+}
+
+func (t *Tracefs) removeFakeDynamicEvent(event string) error {
+	file := filepath.Join(t.Dir, dynamicEventsFile)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	res := []string{}
+	for _, l := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if g, e := dynamicEventName(l); g+"/"+e != event {
+			res = append(res, l)
+		}
+	}
+	os.RemoveAll(filepath.Join(t.Dir, eventsDir, event))
+	return os.WriteFile(file, []byte(strings.Join(res, "\n")), 0640)
+}
@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package ftrace
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* Create a fake tracefs directory tree with the given syscall events */
+func fakeTracefs(t *testing.T, events ...string) string {
+	dir := t.TempDir()
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, instancesDir), 0750))
+	for _, e := range events {
+		assert.Nil(t, os.MkdirAll(filepath.Join(dir, eventsDir, "syscalls", e), 0750))
+	}
+	return dir
+}
+
+func readFile(t *testing.T, file string) string {
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func TestFind(t *testing.T) {
+	sys := t.TempDir()
+	proc := t.TempDir()
+
+	_, err := Find(proc, sys)
+	assert.NotNil(t, err)
+	assert.Equal(t, "", findDir(proc, sys))
+
+	/* Default location, relative to the sysfs. Plain directories are not a tracefs */
+	assert.Nil(t, os.MkdirAll(filepath.Join(sys, "kernel/tracing", instancesDir), 0750))
+	assert.Equal(t, filepath.Join(sys, "kernel/tracing"), findDir(proc, sys))
+	_, err = Find(proc, sys)
+	assert.NotNil(t, err)
+
+	/* Mount point from the mounts, translated to the custom sysfs */
+	assert.Nil(t, os.MkdirAll(filepath.Join(sys, "kernel/debug/tracing"), 0750))
+	mounts := "sysfs /sys sysfs rw 0 0\ndebugfs /sys/kernel/debug debugfs rw 0 0\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(proc, "mounts"), []byte(mounts), 0640))
+	assert.Equal(t, filepath.Join(sys, "kernel/debug/tracing"), findDir(proc, sys))
+
+	mounts += "tracefs /sys/kernel/tracing tracefs rw 0 0\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(proc, "mounts"), []byte(mounts), 0640))
+	assert.Equal(t, filepath.Join(sys, "kernel/tracing"), findDir(proc, sys))
+}
+
+func TestNew(t *testing.T) {
+	dir := fakeTracefs(t)
+
+	/* The emulation of a fake tracefs is only enabled explicitly */
+	_, err := New(dir)
+	assert.NotNil(t, err)
+	_, err = New(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+	_, err = NewFake(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+	tfs, err := NewFake(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, dir, tfs.Dir)
+}
+
+func TestInstance(t *testing.T) {
+	tfs, err := NewFake(fakeTracefs(t, "sys_enter_openat", "sys_enter_read"))
+	assert.Nil(t, err)
+
+	inst, err := tfs.CreateInstance("kube_test")
+	assert.Nil(t, err)
+	_, err = tfs.CreateInstance("kube_test")
+	assert.NotNil(t, err)
+	_, err = tfs.GetInstance("kube_test")
+	assert.Nil(t, err)
+	all, err := tfs.Instances("kube_")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(all))
+
+	assert.Nil(t, inst.SetEventPid([]int{1, 2, 3}))
+	assert.Equal(t, "1 2 3", readFile(t, filepath.Join(inst.Dir, "set_event_pid")))
+	assert.Nil(t, inst.SetEventPid([]int{}))
+	assert.Equal(t, "", readFile(t, filepath.Join(inst.Dir, "set_event_pid")))
+
+	assert.Nil(t, inst.EnableEvent("syscalls", "sys_enter_openat", true))
+	assert.Equal(t, "1", readFile(t, filepath.Join(inst.Dir, eventsDir, "syscalls/sys_enter_openat/enable")))
+	assert.Nil(t, inst.SetFilter("syscalls", "", "ret < 0"))
+	assert.Equal(t, "ret < 0", readFile(t, filepath.Join(inst.Dir, eventsDir, "syscalls/filter")))
+	assert.Nil(t, inst.ClearFilter("syscalls", ""))
+	assert.Equal(t, "0", readFile(t, filepath.Join(inst.Dir, eventsDir, "syscalls/filter")))
+
+	assert.Nil(t, inst.SetOption("event-fork", true))
+	assert.Equal(t, "1", readFile(t, filepath.Join(inst.Dir, optionsDir, "event-fork")))
+
+	assert.False(t, inst.IsTracingOn())
+	assert.Nil(t, inst.TracingOn(true))
+	assert.True(t, inst.IsTracingOn())
+	assert.Equal(t, filepath.Join(tfs.Dir, instancesDir, "kube_test", tracePipeFile), inst.TracePipe())
+
+	events, err := tfs.Events("syscalls")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"sys_enter_openat", "sys_enter_read"}, events)
+
+	assert.Nil(t, inst.Remove())
+	_, err = tfs.GetInstance("kube_test")
+	assert.NotNil(t, err)
+}
+
+func TestDynamicEvents(t *testing.T) {
+	tfs, err := NewFake(fakeTracefs(t))
+	assert.Nil(t, err)
+
+	assert.Nil(t, tfs.AddDynamicEvent("p:kube_test/open do_sys_openat2 dfd=%di"))
+	assert.Nil(t, tfs.AddDynamicEvent("r:kube_test/open_ret do_sys_openat2 ret=$retval"))
+	assert.Nil(t, tfs.AddDynamicEvent("p:other/read ksys_read"))
+	events, err := tfs.DynamicEvents("kube_test")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"kube_test/open", "kube_test/open_ret"}, events)
+	events, err = tfs.Events("kube_test")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"open", "open_ret"}, events)
+
+	assert.Nil(t, tfs.RemoveDynamicEvent("kube_test/open"))
+	events, err = tfs.DynamicEvents("")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"kube_test/open_ret", "other/read"}, events)
+}
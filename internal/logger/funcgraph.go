@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Export of function graph traces as nested spans - each traced kernel function call is a span,
+ * a child of the span of its caller.
+ */
+package logger
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	logger "go.opentelemetry.io/otel/trace"
+)
+
+var (
+	/*
+	 * function_graph text format, with funcgraph-abstime and funcgraph-proc options:
+	 * "<timestamp> | <cpu>) <comm>-<pid> | [<mark>] <duration> us | <indent><call>"
+	 */
+	funcgraphRe = regexp.MustCompile(`^\s*(\d+\.\d+)\s*\|\s*(\d+)\)\s*(.*?)-(\d+)\s*\|\s*(?:[-+!#*@$]\s*)?(\d+\.?\d*)?\s*(?:us)?\s*\|\s*(.*?)\s*$`)
+)
+
+const (
+	funcgraphEntry = iota /* "func() {" */
+	funcgraphExit         /* "}", optionally followed by the function name in a comment */
+	funcgraphLeaf         /* "func();" */
+)
+
+type funcgraphLine struct {
+	Time     time.Duration /* Trace timestamp, relative to the trace clock */
+	Cpu      int
+	Comm     string
+	Pid      int
+	Duration time.Duration /* Set on exit and leaf lines */
+	Kind     int
+	Function string /* Empty on exit lines, if funcgraph-tail is not set */
+}
+
+type funcgraphCall struct {
+	function string
+	ctx      context.Context
+	span     logger.Span
+}
+
+/* Calls in progress and the mapping of the trace clock to the wall clock */
+type funcgraphState struct {
+	clock traceClock
+	calls map[int][]*funcgraphCall /* Stack of calls in progress, per PID */
+}
+
+/* Parse a line of the function_graph tracer. Returns nil for lines, that are not function calls */
+func parseFuncgraphLine(line string) *funcgraphLine {
+	var err error
+
+	m := funcgraphRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	res := funcgraphLine{
+		Comm: strings.TrimSpace(m[3]),
+	}
+	if res.Time, err = parseTraceTime(m[1]); err != nil {
+		return nil
+	}
+	if res.Cpu, err = strconv.Atoi(m[2]); err != nil {
+		return nil
+	}
+	if res.Pid, err = strconv.Atoi(m[4]); err != nil {
+		return nil
+	}
+	if m[5] != "" {
+		if d, err := strconv.ParseFloat(m[5], 64); err == nil {
+			res.Duration = time.Duration(d * float64(time.Microsecond))
+		}
+	}
+
+	call := m[6]
+	switch {
+	case strings.HasSuffix(call, "() {"):
+		res.Kind = funcgraphEntry
+		res.Function = strings.TrimSuffix(call, "() {")
+	case strings.HasSuffix(call, "();"):
+		res.Kind = funcgraphLeaf
+		res.Function = strings.TrimSuffix(call, "();")
+	case strings.HasPrefix(call, "}"):
+		res.Kind = funcgraphExit
+		tail := strings.TrimSpace(strings.TrimPrefix(call, "}"))
+		if strings.HasPrefix(tail, "/*") && strings.HasSuffix(tail, "*/") {
+			res.Function = strings.TrimSpace(tail[2 : len(tail)-2])
+		}
+	default:
+		return nil
+	}
+
+	return &res
+}
+
+func newFuncgraphState() *funcgraphState {
+	return &funcgraphState{
+		calls: make(map[int][]*funcgraphCall),
+	}
+}
+
+func (s *funcgraphState) parent(job *logWorker, pid int) context.Context {
+	if st := s.calls[pid]; len(st) > 0 {
+		return st[len(st)-1].ctx
+	}
+	return job.ctx
+}
+
+func (l *Logger) funcgraphSpan(ctx context.Context, fl *funcgraphLine, start time.Time, ev *TraceEvent) (context.Context, logger.Span) {
+	ctx, sp := l.tracer.Start(ctx, fl.Function, logger.WithTimestamp(start))
+	sp.SetAttributes(attribute.Key("pid").Int(fl.Pid))
+	sp.SetAttributes(attribute.Key("comm").String(fl.Comm))
+	sp.SetAttributes(attribute.Key("cpu").Int(fl.Cpu))
+	if ev.ContainerPid != 0 {
+		sp.SetAttributes(attribute.Key("containerPid").Int(ev.ContainerPid))
+	}
+	return ctx, sp
+}
+
+/* Create or complete the span of a function call, described by the line */
+func (l *Logger) funcgraphEvent(job *logWorker, s *funcgraphState, fl *funcgraphLine, ev *TraceEvent) {
+	now := s.clock.wallTime(fl.Time)
+
+	switch fl.Kind {
+	case funcgraphEntry:
+		ctx, sp := l.funcgraphSpan(s.parent(job, fl.Pid), fl, now, ev)
+		s.calls[fl.Pid] = append(s.calls[fl.Pid], &funcgraphCall{
+			function: fl.Function,
+			ctx:      ctx,
+			span:     sp,
+		})
+	case funcgraphLeaf:
+		/* The timestamp of a leaf is its start */
+		_, sp := l.funcgraphSpan(s.parent(job, fl.Pid), fl, now, ev)
+		sp.SetAttributes(attribute.Key("duration_us").Float64(float64(fl.Duration) / float64(time.Microsecond)))
+		sp.End(logger.WithTimestamp(now.Add(fl.Duration)))
+	case funcgraphExit:
+		st := s.calls[fl.Pid]
+		if len(st) == 0 {
+			/* The entry of the call happened before the trace started */
+			return
+		}
+		c := st[len(st)-1]
+		s.calls[fl.Pid] = st[:len(st)-1]
+		c.span.SetAttributes(attribute.Key("duration_us").Float64(float64(fl.Duration) / float64(time.Microsecond)))
+		c.span.End(logger.WithTimestamp(now))
+	}
+}
+
+/* End the spans of all calls in progress, i.e. when the trace is stopped. The span of the job must not be ended yet */
+func (s *funcgraphState) endAll() {
+	for pid, st := range s.calls {
+		for i := len(st) - 1; i >= 0; i-- {
+			st[i].span.SetAttributes(attribute.Key("incomplete").Bool(true))
+			st[i].span.End()
+		}
+		delete(s.calls, pid)
+	}
+}
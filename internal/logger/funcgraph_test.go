@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package logger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFuncgraphLine(t *testing.T) {
+	l := parseFuncgraphLine(" 1234.500000 |   2)  bash-4321    |               |  do_sys_open() {")
+	assert.NotNil(t, l)
+	assert.Equal(t, funcgraphEntry, l.Kind)
+	assert.Equal(t, "do_sys_open", l.Function)
+	assert.Equal(t, 4321, l.Pid)
+	assert.Equal(t, 2, l.Cpu)
+	assert.Equal(t, "bash", l.Comm)
+	assert.Equal(t, 1234*time.Second+500*time.Millisecond, l.Time)
+
+	l = parseFuncgraphLine(" 1234.500001 |   2)  bash-4321    |   0.750 us    |    getname();")
+	assert.NotNil(t, l)
+	assert.Equal(t, funcgraphLeaf, l.Kind)
+	assert.Equal(t, "getname", l.Function)
+	assert.Equal(t, 750*time.Nanosecond, l.Duration)
+
+	l = parseFuncgraphLine(" 1234.500020 |   2)  bash-4321    | + 12.500 us   |  } /* do_sys_open */")
+	assert.NotNil(t, l)
+	assert.Equal(t, funcgraphExit, l.Kind)
+	assert.Equal(t, "do_sys_open", l.Function)
+	assert.Equal(t, 12500*time.Nanosecond, l.Duration)
+
+	l = parseFuncgraphLine(" 1234.500020 |   2)  kworker/2:1-87 | ! 150.000 us  |  }")
+	assert.NotNil(t, l)
+	assert.Equal(t, funcgraphExit, l.Kind)
+	assert.Equal(t, "", l.Function)
+	assert.Equal(t, "kworker/2:1", l.Comm)
+	assert.Equal(t, 87, l.Pid)
+
+	assert.Nil(t, parseFuncgraphLine(" ------------------------------------------"))
+	assert.Nil(t, parseFuncgraphLine(" 1234.5 |   2)  bash-4321    |               |  /* trace_printk */"))
+}
+
+func TestFuncgraphIncompleteCalls(t *testing.T) {
+	spans := runLogJob(t, FormatFuncgraph, []string{
+		" 1234.500000 |   2)  app-100    |               |  do_sys_open() {",
+		" 1234.500001 |   2)  app-100    |   0.750 us    |    getname();",
+		" 1234.500002 |   2)  app-100    |               |    do_filp_open() {",
+	})
+
+	/* The calls in progress end when the job stops, before the span of the job ends */
+	job := spans[len(spans)-1]
+	incomplete := []string{}
+	for _, s := range spans[:len(spans)-1] {
+		assert.False(t, s.EndTime().After(job.EndTime()))
+		if spanAttribute(s, "incomplete") == "true" {
+			incomplete = append(incomplete, s.Name())
+		}
+	}
+	assert.Equal(t, 2, len(incomplete))
+}
@@ -0,0 +1,298 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Analysis of block and file system I/O traces. Block requests, issued by the traced tasks, are paired
+ * with their completion and exported as spans with the I/O latency. File system events are exported
+ * as spans with the path of the file, when it can be found. The completions may be recorded in another
+ * trace instance than the issues, so a completion can be read before its issue.
+ */
+package logger
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	logger "go.opentelemetry.io/otel/trace"
+)
+
+var (
+	/* ftrace text format: "<comm>-<pid> [<cpu>] <flags> <timestamp>: <event>: <data>" */
+	ioEventRe = regexp.MustCompile(`^\s*(.*?)-(\d+)\s+(?:\(\s*[-\d]+\)\s+)?\[\d+\]\s+(?:\S+\s+)?(\d+\.\d+):\s+(\w+):\s*(.*)$`)
+	/* block_rq_issue: "<major>,<minor> <rwbs> <bytes> (<cmd>) <sector> + <sectors> [<comm>]" */
+	blockIssueRe = regexp.MustCompile(`^(\d+),(\d+)\s+(\S+)\s+(\d+)\s+\(.*?\)\s+(\d+)\s+\+\s+(\d+)`)
+	/* block_rq_complete: "<major>,<minor> <rwbs> (<cmd>) <sector> + <sectors> [<error>]" */
+	blockCompleteRe = regexp.MustCompile(`^(\d+),(\d+)\s+(\S+)\s+\(.*?\)\s+(\d+)\s+\+\s+(\d+)\s+\[(-?\d+)\]`)
+	/* ext4 and xfs events: "dev <major>,<minor> ino <inode> ..." or "dev <major>:<minor> ino 0x<inode> ..." */
+	fsFileRe = regexp.MustCompile(`dev (\d+)[,:](\d+) ino (\S+)`)
+
+	ioSectorSize   = 512
+	ioPendingLimit = 65536                  /* Drop the oldest pending requests, if their completion is lost */
+	ioEarlyWindow  = 100 * time.Millisecond /* Keep the completions, read before their issue, for this trace time */
+	ioFsyncEnter   = "ext4_sync_file_enter"
+	ioFsyncExit    = "ext4_sync_file_exit"
+)
+
+/* Finds the path of an open file of a task by its device and inode */
+type FileResolver interface {
+	FindFile(pid int, major, minor uint32, ino uint64) (string, bool)
+}
+
+type ioFile struct {
+	major, minor uint32
+	ino          uint64
+	path         string
+}
+
+/* A block request, issued by a traced task and not completed yet, or a completion without its issue */
+type ioRequest struct {
+	start        time.Duration
+	end          time.Duration /* Set only for completions */
+	err          string
+	pid, cpid    int
+	comm         string
+	rwbs         string
+	bytes        int
+	sector       uint64
+	file         string
+	major, minor uint32
+}
+
+type ioEntry struct {
+	key string
+	req *ioRequest
+}
+
+/* Requests by key, in the order they are added. The oldest are dropped when the limit is reached */
+type ioQueue struct {
+	items map[string]*list.Element
+	order *list.List
+}
+
+func newIoQueue() *ioQueue {
+	return &ioQueue{
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (q *ioQueue) add(key string, r *ioRequest) {
+	if e, ok := q.items[key]; ok {
+		q.order.Remove(e)
+	}
+	q.items[key] = q.order.PushBack(&ioEntry{key: key, req: r})
+	for q.order.Len() > ioPendingLimit {
+		q.remove(q.order.Front())
+	}
+}
+
+func (q *ioQueue) remove(e *list.Element) *ioRequest {
+	ent := q.order.Remove(e).(*ioEntry)
+	delete(q.items, ent.key)
+	return ent.req
+}
+
+func (q *ioQueue) take(key string) *ioRequest {
+	e, ok := q.items[key]
+	if !ok {
+		return nil
+	}
+	return q.remove(e)
+}
+
+/* Drop the oldest completions, which issue is not traced */
+func (q *ioQueue) expire(before time.Duration) {
+	for e := q.order.Front(); e != nil && e.Value.(*ioEntry).req.end < before; e = q.order.Front() {
+		q.remove(e)
+	}
+}
+
+type ioAnalyzer struct {
+	clock   traceClock
+	pending *ioQueue           /* Requests of the traced tasks, not completed yet */
+	early   *ioQueue           /* Completions, read before their issue */
+	files   map[string]*ioFile /* Files, already resolved to paths */
+	current map[int]*ioFile    /* The last file, accessed by the task */
+	syncs   map[int]time.Duration
+}
+
+func newIoAnalyzer() *ioAnalyzer {
+	return &ioAnalyzer{
+		pending: newIoQueue(),
+		early:   newIoQueue(),
+		files:   make(map[string]*ioFile),
+		current: make(map[int]*ioFile),
+		syncs:   make(map[int]time.Duration),
+	}
+}
+
+func parseUint32(s string) uint32 {
+	v, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(v)
+}
+
+/* Get the file of a file system event and try to resolve its path */
+func (a *ioAnalyzer) file(data string, pid int, files FileResolver) *ioFile {
+	m := fsFileRe.FindStringSubmatch(data)
+	if m == nil {
+		return nil
+	}
+	ino, err := strconv.ParseUint(m[3], 0, 64)
+	if err != nil {
+		return nil
+	}
+	key := fmt.Sprintf("%s:%s:%d", m[1], m[2], ino)
+	if f, ok := a.files[key]; ok && f.path != "" {
+		return f
+	}
+	f := &ioFile{
+		major: parseUint32(m[1]),
+		minor: parseUint32(m[2]),
+		ino:   ino,
+	}
+	if files != nil {
+		f.path, _ = files.FindFile(pid, f.major, f.minor, ino)
+	}
+	a.files[key] = f
+
+	return f
+}
+
+func (l *Logger) ioSpan(job *logWorker, name string, start, end time.Time, attrs ...attribute.KeyValue) {
+	_, sp := l.tracer.Start(job.ctx, name, logger.WithTimestamp(start))
+	sp.SetAttributes(attrs...)
+	sp.End(logger.WithTimestamp(end))
+}
+
+/* Export a completed block request */
+func (l *Logger) blockSpan(job *logWorker, req *ioRequest, end time.Duration, errno string) {
+	a := job.log.io
+	attrs := append(taskAttributes(req.pid, req.cpid, req.comm),
+		attribute.Key("device").String(fmt.Sprintf("%d,%d", req.major, req.minor)),
+		attribute.Key("sector").Int64(int64(req.sector)),
+		attribute.Key("size").Int(req.bytes),
+		attribute.Key("rwbs").String(req.rwbs),
+		attribute.Key("latency_us").Float64(usec(end-req.start)),
+		attribute.Key("error").String(errno))
+	if req.file != "" {
+		attrs = append(attrs, attribute.Key("file").String(req.file))
+	}
+	l.ioSpan(job, "block-io", a.clock.wallTime(req.start), a.clock.wallTime(end), attrs...)
+}
+
+func taskAttributes(pid, cpid int, comm string) []attribute.KeyValue {
+	res := []attribute.KeyValue{
+		attribute.Key("pid").Int(pid),
+		attribute.Key("comm").String(comm),
+	}
+	if cpid != 0 {
+		res = append(res, attribute.Key("containerPid").Int(cpid))
+	}
+	return res
+}
+
+/* Account an I/O event. Only events of the traced tasks and completions of their requests are returned */
+func (l *Logger) logIo(job *logWorker, line string) *TraceEvent {
+	m := ioEventRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	ts, err := parseTraceTime(m[3])
+	if err != nil {
+		return nil
+	}
+	pid, _ := strconv.Atoi(m[2])
+	comm, name, data := strings.TrimSpace(m[1]), m[4], m[5]
+	a := job.log.io
+	ev := &TraceEvent{
+		Pid:  pid,
+		Line: line,
+	}
+	traced := false
+	if job.log.Pids != nil {
+		ev.ContainerPid, traced = job.log.Pids.Lookup(pid)
+	}
+
+	switch name {
+	case "block_rq_issue":
+		r := blockIssueRe.FindStringSubmatch(data)
+		if r == nil || !traced {
+			return nil
+		}
+		req := &ioRequest{
+			start: ts,
+			pid:   pid,
+			cpid:  ev.ContainerPid,
+			comm:  comm,
+			rwbs:  r[3],
+			major: parseUint32(r[1]),
+			minor: parseUint32(r[2]),
+		}
+		req.bytes, _ = strconv.Atoi(r[4])
+		req.sector, _ = strconv.ParseUint(r[5], 10, 64)
+		if req.bytes == 0 {
+			n, _ := strconv.Atoi(r[6])
+			req.bytes = n * ioSectorSize
+		}
+		if f, ok := a.current[pid]; ok && f.path != "" {
+			req.file = f.path
+		}
+		key := fmt.Sprintf("%s,%s:%s", r[1], r[2], r[5])
+		if c := a.early.take(key); c != nil && c.end >= ts {
+			l.blockSpan(job, req, c.end, c.err)
+		} else {
+			a.pending.add(key, req)
+		}
+	case "block_rq_complete":
+		r := blockCompleteRe.FindStringSubmatch(data)
+		if r == nil {
+			return nil
+		}
+		key := fmt.Sprintf("%s,%s:%s", r[1], r[2], r[4])
+		req := a.pending.take(key)
+		if req == nil {
+			/* The issue may be read later, most of the completions are of other tasks and expire */
+			a.early.expire(ts - ioEarlyWindow)
+			a.early.add(key, &ioRequest{end: ts, err: r[6]})
+			return nil
+		}
+		ev.Pid, ev.ContainerPid = req.pid, req.cpid
+		l.blockSpan(job, req, ts, r[6])
+	default:
+		if !traced {
+			return nil
+		}
+		f := a.file(data, pid, job.log.Files)
+		attrs := append(taskAttributes(pid, ev.ContainerPid, comm), attribute.Key("event").String(name))
+		if f != nil {
+			a.current[pid] = f
+			attrs = append(attrs,
+				attribute.Key("device").String(fmt.Sprintf("%d,%d", f.major, f.minor)),
+				attribute.Key("inode").Int64(int64(f.ino)))
+			if f.path != "" {
+				attrs = append(attrs, attribute.Key("file").String(f.path))
+			}
+		}
+		now := a.clock.wallTime(ts)
+		switch name {
+		case ioFsyncEnter:
+			a.syncs[pid] = ts
+		case ioFsyncExit:
+			if start, ok := a.syncs[pid]; ok {
+				delete(a.syncs, pid)
+				delete(a.current, pid)
+				attrs = append(attrs, attribute.Key("latency_us").Float64(usec(ts-start)))
+				l.ioSpan(job, "fsync", a.clock.wallTime(start), now, attrs...)
+			}
+		default:
+			l.ioSpan(job, name, now, now, attrs...)
+		}
+	}
+
+	return ev
+}
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package logger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type fakeFiles map[uint64]string
+
+func (f fakeFiles) FindFile(pid int, major, minor uint32, ino uint64) (string, bool) {
+	p, ok := f[ino]
+	return p, ok
+}
+
+func spanAttribute(s sdk.ReadOnlySpan, key string) string {
+	for _, a := range s.Attributes() {
+		if string(a.Key) == key {
+			return a.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestIoAnalyzer(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	l := &Logger{tracer: sdk.NewTracerProvider(sdk.WithSpanProcessor(rec)).Tracer("test")}
+	job := &logWorker{
+		ctx: context.Background(),
+		log: &LogJob{
+			Format: FormatIo,
+			Pids:   fakePids{100: 1},
+			Files:  fakeFiles{12: "/data/db.log"},
+			io:     newIoAnalyzer(),
+		},
+	}
+
+	events := []string{
+		"  app-100   [001] .....  10.000000: ext4_sync_file_enter: dev 259,0 ino 12 parent 2 datasync 0",
+		"  app-100   [001] .....  10.000100: block_rq_issue: 259,0 WS 4096 () 2048 + 8 [app]",
+		"  other-7   [002] .....  10.000200: block_rq_issue: 259,0 W 4096 () 4096 + 8 [other]",
+		" <idle>-0   [001] d.h1.  10.002100: block_rq_complete: 259,0 WS () 2048 + 8 [0]",
+		" <idle>-0   [002] d.h1.  10.002200: block_rq_complete: 259,0 W () 4096 + 8 [0]",
+		"  app-100   [001] .....  10.003000: ext4_sync_file_exit: dev 259,0 ino 12 ret 0",
+		"  app-100   [001] .....  10.004000: xfs_file_buffered_write: dev 253:1 ino 0x83 disize 0x0 pos 0x0 bytecount 0x1000",
+	}
+	published := 0
+	for _, e := range events {
+		if l.logIo(job, e) != nil {
+			published++
+		}
+	}
+	assert.Equal(t, 5, published)
+
+	spans := rec.Ended()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "block-io", spans[0].Name())
+	assert.Equal(t, "259,0", spanAttribute(spans[0], "device"))
+	assert.Equal(t, "2048", spanAttribute(spans[0], "sector"))
+	assert.Equal(t, "4096", spanAttribute(spans[0], "size"))
+	assert.Equal(t, "/data/db.log", spanAttribute(spans[0], "file"))
+	assert.Equal(t, "1", spanAttribute(spans[0], "containerPid"))
+	assert.Equal(t, "2000", spanAttribute(spans[0], "latency_us"))
+	assert.Equal(t, "fsync", spans[1].Name())
+	assert.Equal(t, "/data/db.log", spanAttribute(spans[1], "file"))
+	assert.Equal(t, "xfs_file_buffered_write", spans[2].Name())
+	assert.Equal(t, "131", spanAttribute(spans[2], "inode"))
+	assert.Equal(t, "", spanAttribute(spans[2], "file"))
+}
+
+func TestIoEarlyCompletion(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	l := &Logger{tracer: sdk.NewTracerProvider(sdk.WithSpanProcessor(rec)).Tracer("test")}
+	job := &logWorker{
+		ctx: context.Background(),
+		log: &LogJob{
+			Format: FormatIo,
+			Pids:   fakePids{100: 1},
+			io:     newIoAnalyzer(),
+		},
+	}
+
+	/* The completions are recorded in another trace instance and can be read before their issue */
+	events := []string{
+		" <idle>-0   [002] d.h1.  10.000050: block_rq_complete: 259,0 R () 512 + 8 [0]",
+		" <idle>-0   [001] d.h1.  10.001100: block_rq_complete: 259,0 R () 1024 + 8 [-5]",
+		"  app-100   [001] .....  10.000200: block_rq_issue: 259,0 R 4096 () 512 + 8 [app]",
+		" <idle>-0   [002] d.h1.  10.300000: block_rq_complete: 259,0 R () 4096 + 8 [0]",
+		"  app-100   [001] .....  10.000100: block_rq_issue: 259,0 R 4096 () 1024 + 8 [app]",
+	}
+	for _, e := range events {
+		l.logIo(job, e)
+	}
+
+	/* The first completion is older than its issue, the second one expired. Both issues wait */
+	spans := rec.Ended()
+	assert.Equal(t, 0, len(spans))
+	assert.Equal(t, 2, job.log.io.pending.order.Len())
+
+	job.log.io = newIoAnalyzer()
+	l.logIo(job, events[1])
+	l.logIo(job, events[4])
+	spans = rec.Ended()
+	if assert.Equal(t, 1, len(spans)) {
+		assert.Equal(t, "1024", spanAttribute(spans[0], "sector"))
+		assert.Equal(t, "1000", spanAttribute(spans[0], "latency_us"))
+		assert.Equal(t, "-5", spanAttribute(spans[0], "error"))
+	}
+	assert.Equal(t, 0, job.log.io.pending.order.Len())
+	assert.Equal(t, 0, job.log.io.early.order.Len())
+}
@@ -52,7 +52,7 @@ func jaegerAutoDetect(ctx context.Context) (*string, error) {
 		return nil, err
 	}
 
-	return nil, fmt.Errorf("Cannot find default ", jaegerDefaultService, " on port ", jaegerDefaultPort)
+	return nil, fmt.Errorf("Cannot find default %s on port %d", jaegerDefaultService, jaegerDefaultPort)
 }
 
 func jaegerExporter(ctx context.Context, endpoint *string) (*sdk.SpanExporter, error) {
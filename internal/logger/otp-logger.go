@@ -10,8 +10,10 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/otel"
@@ -25,15 +27,27 @@ import (
 var (
 	loogerCloseTimeout      = time.Second * 5
 	EnvLoggerJaegerEndpoint = "TRACER_JEAGER_ENDPOINT"
+
+	FormatFtrace    = "ftrace"         /* Each trace event is a span */
+	FormatFuncgraph = "function_graph" /* Each function call is a span, nested in the span of its caller */
+	FormatSched     = "sched"          /* Scheduler events, analyzed for latency and off-CPU time */
+	FormatIo        = "io"             /* Block and file system events, analyzed for I/O latency */
 )
 
 type LogJob struct {
 	Name    string
-	File    string
+	File    string        /* File with the traces, also identifies the job */
+	Input   io.ReadCloser /* Optional, the traces are read from it instead of from the file, until EOF */
+	Format  string        /* Format of the traces in the file, ftrace by default */
 	Node    string
 	Pod     string
 	Job     string
 	Session string
+	Pids    PidTranslator     /* Optional, used to add the container PID to the traces */
+	Filter  func(string) bool /* Optional, traces for which it returns false are dropped */
+	Files   FileResolver      /* Optional, used to find the paths of the files in I/O traces */
+	sched   *schedAnalyzer
+	io      *ioAnalyzer
 }
 
 type LoggerConfig struct {
@@ -42,17 +56,21 @@ type LoggerConfig struct {
 }
 
 type logWorker struct {
-	log    *LogJob
-	span   logger.Span
-	ctx    context.Context
-	cancel context.CancelFunc
-	count  int
+	log         *LogJob
+	span        logger.Span
+	ctx         context.Context
+	cancel      context.CancelFunc
+	count       int
+	subLock     sync.Mutex
+	subscribers []chan *TraceEvent
+	closed      bool
 }
 
 type Logger struct {
 	ctx        context.Context
 	provider   *sdk.TracerProvider
 	tracer     logger.Tracer
+	lock       sync.Mutex
 	logWorkers map[string]*logWorker
 }
 
@@ -62,8 +80,7 @@ func (l *Logger) Destroy() {
 	l.provider.Shutdown(ctx)
 }
 
-func readLine(f *os.File) (*[]byte, error) {
-	r := bufio.NewReader(f)
+func readLine(r *bufio.Reader) (*[]byte, error) {
 	if line, p, err := r.ReadLine(); err == nil {
 		if p == false {
 			return &line, nil
@@ -86,34 +103,112 @@ func readLine(f *os.File) (*[]byte, error) {
 }
 
 func (l *Logger) readFile(job *logWorker) error {
-	f, err := os.Open(job.log.File)
-	if err != nil {
-		return err
+	/* The span of the job ends after the spans, flushed when the reading completes */
+	defer job.span.End()
+	defer job.closeSubscribers()
+
+	var f io.ReadCloser
+	if job.log.Input != nil {
+		f = job.log.Input
+	} else {
+		file, err := os.Open(job.log.File)
+		if err != nil {
+			return err
+		}
+		f = file
 	}
 	defer f.Close()
 
+	/* Reading of an empty trace pipe blocks, close it on stop to release the trace instance */
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-job.ctx.Done():
+			f.Close()
+		case <-done:
+		}
+	}()
+
+	var fg *funcgraphState
+	switch job.log.Format {
+	case FormatFuncgraph:
+		fg = newFuncgraphState()
+		defer fg.endAll()
+	case FormatSched:
+		defer l.logSchedSummary(job)
+	}
+
+	r := bufio.NewReader(f)
 	for {
-		line, err := readLine(f)
+		line, err := readLine(r)
 		if err != nil {
 			return err
 		}
+		if job.log.Filter != nil && !job.log.Filter(string(*line)) {
+			continue
+		}
 		select {
 		case <-job.ctx.Done():
 			return job.ctx.Err()
 		default:
-			_, sp := l.tracer.Start(job.ctx, "trace")
-			sp.AddEvent(string(*line))
-			sp.End()
-			job.count++
+			var ev *TraceEvent
+			switch job.log.Format {
+			case FormatFuncgraph:
+				ev = l.logFuncgraph(job, fg, string(*line))
+			case FormatSched:
+				ev = l.logSched(job, string(*line))
+			case FormatIo:
+				ev = l.logIo(job, string(*line))
+			default:
+				ev = l.logFtrace(job, string(*line))
+			}
+			if ev != nil {
+				job.publish(ev)
+				job.count++
+			}
+		}
+	}
+}
+
+func (l *Logger) logFtrace(job *logWorker, line string) *TraceEvent {
+	ev := newTraceEvent(line, job.log.Pids)
+	_, sp := l.tracer.Start(job.ctx, "trace")
+	if ev.Pid != 0 {
+		sp.SetAttributes(attribute.Key("pid").Int(ev.Pid))
+	}
+	if ev.ContainerPid != 0 {
+		sp.SetAttributes(attribute.Key("containerPid").Int(ev.ContainerPid))
+	}
+	sp.AddEvent(ev.Line)
+	sp.End()
+
+	return ev
+}
+
+func (l *Logger) logFuncgraph(job *logWorker, fg *funcgraphState, line string) *TraceEvent {
+	fl := parseFuncgraphLine(line)
+	if fl == nil {
+		return nil
+	}
+	ev := &TraceEvent{
+		Pid:  fl.Pid,
+		Line: line,
+	}
+	if job.log.Pids != nil {
+		if cpid, ok := job.log.Pids.Lookup(fl.Pid); ok {
+			ev.ContainerPid = cpid
 		}
 	}
-	return fmt.Errorf("Completed reading file", job.log.File)
+	l.funcgraphEvent(job, fg, fl, ev)
+
+	return ev
 }
 
 func (l *Logger) delCompleted() {
 	for f, w := range l.logWorkers {
 		if w.ctx.Err() != nil {
-			w.span.End()
+			w.closeSubscribers()
 			log.Printf("Completed trace job %s: %d traces collected", w.log.Name, w.count)
 			delete(l.logWorkers, f)
 		}
@@ -121,11 +216,20 @@ func (l *Logger) delCompleted() {
 }
 
 func (l *Logger) RunLogJob(log *LogJob) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
 	l.delCompleted()
 	if _, ok := l.logWorkers[log.File]; ok {
 		return nil
 	}
 
+	switch log.Format {
+	case FormatSched:
+		log.sched = newSchedAnalyzer()
+	case FormatIo:
+		log.io = newIoAnalyzer()
+	}
 	ctx, cancel := context.WithCancel(l.ctx)
 	ctxp, span := l.tracer.Start(ctx, log.Name)
 	span.SetAttributes(attribute.Key("node").String(log.Node))
@@ -147,13 +251,15 @@ func (l *Logger) RunLogJob(log *LogJob) error {
 }
 
 func (l *Logger) StopLogJob(log *LogJob) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 
 	if w, ok := l.logWorkers[log.File]; ok {
 		w.cancel()
 		l.delCompleted()
 		return nil
 	}
-	return fmt.Errorf("No log job for ", log.File)
+	return fmt.Errorf("No log job for %s", log.File)
 }
 
 func NewLogger(ctx context.Context, cfg *LoggerConfig) (*Logger, error) {
@@ -0,0 +1,302 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Analysis of scheduler traces - run queue latency, off-CPU time and the reasons tasks are blocked.
+ * Each off-CPU interval of a traced task is exported as a span, summary statistics per task are
+ * exported when the trace completes.
+ */
+package logger
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	logger "go.opentelemetry.io/otel/trace"
+)
+
+var (
+	/* ftrace text format: "<comm>-<pid> [<cpu>] <flags> <timestamp>: <event>: <data>" */
+	schedEventRe = regexp.MustCompile(`^\s*.*?-\d+\s+(?:\(\s*[-\d]+\)\s+)?\[\d+\]\s+(?:\S+\s+)?(\d+\.\d+):\s+(\w+):\s*(.*)$`)
+
+	/* Reasons for a task to be off CPU, by the prev_state of sched_switch */
+	offCpuReasons = map[byte]string{
+		'R': "preempted",
+		'S': "sleep",
+		'D': "uninterruptible",
+		'T': "stopped",
+		't': "traced",
+		'I': "idle",
+		'P': "parked",
+	}
+)
+
+/* Scheduling statistics of a traced task, durations are in microseconds */
+type SchedStats struct {
+	Pid           int
+	ContainerPid  int `json:",omitempty"`
+	Comm          string
+	Switches      int                /* Number of times the task was scheduled out */
+	OnCpu         float64            /* Total time on CPU */
+	OffCpu        float64            /* Total time off CPU */
+	OffCpuReasons map[string]float64 /* Time off CPU, by reason */
+	RunqueueCount int                /* Number of times the task waited in the run queue */
+	RunqueueTotal float64            /* Total time in the run queue, after wake up or preemption */
+	RunqueueMax   float64
+	Exited        bool `json:",omitempty"`
+}
+
+/* Current scheduling state of a traced task */
+type schedTask struct {
+	stats    SchedStats
+	onCpu    time.Duration /* Time the task was scheduled in, zero if it is off CPU */
+	offCpu   time.Duration /* Time the task was scheduled out, zero if it is on CPU */
+	reason   string
+	runnable time.Duration /* Time the task became runnable, zero if it is not in the run queue */
+}
+
+type schedAnalyzer struct {
+	lock  sync.Mutex
+	clock traceClock
+	tasks map[int]*schedTask
+}
+
+type schedEvent struct {
+	Time   time.Duration
+	Name   string
+	Fields map[string]string
+}
+
+func newSchedAnalyzer() *schedAnalyzer {
+	return &schedAnalyzer{
+		tasks: make(map[int]*schedTask),
+	}
+}
+
+func usec(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+/* Parse a scheduler event, i.e. "sched_switch: prev_comm=sh prev_pid=12 ... next_pid=0" */
+func parseSchedEvent(line string) *schedEvent {
+	m := schedEventRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	t, err := parseTraceTime(m[1])
+	if err != nil {
+		return nil
+	}
+	res := schedEvent{
+		Time:   t,
+		Name:   m[2],
+		Fields: make(map[string]string),
+	}
+	for _, f := range strings.Fields(m[3]) {
+		if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+			res.Fields[kv[0]] = kv[1]
+		}
+	}
+
+	return &res
+}
+
+func (e *schedEvent) pid(name string) int {
+	if p, err := strconv.Atoi(e.Fields[name]); err == nil {
+		return p
+	}
+	return -1
+}
+
+func offCpuReason(state string) string {
+	if state == "" {
+		return "unknown"
+	}
+	if r, ok := offCpuReasons[state[0]]; ok {
+		return r
+	}
+	return state
+}
+
+/*
+ * Get a traced task. The kernel records the scheduler events if at least one of the tasks is traced,
+ * the idle task and tasks outside of the container are skipped. Tasks are known to be traced if they
+ * are in the container, or if they were woken up or forked - these events are recorded only for
+ * traced tasks.
+ */
+func (a *schedAnalyzer) task(pid int, comm string, pids PidTranslator, add bool) *schedTask {
+	if pid <= 0 {
+		return nil
+	}
+	if t, ok := a.tasks[pid]; ok {
+		if comm != "" {
+			t.stats.Comm = comm
+		}
+		return t
+	}
+	cpid := 0
+	if pids != nil {
+		if c, ok := pids.Lookup(pid); ok {
+			cpid = c
+			add = true
+		}
+	}
+	if !add {
+		return nil
+	}
+	t := &schedTask{
+		stats: SchedStats{
+			Pid:           pid,
+			ContainerPid:  cpid,
+			Comm:          comm,
+			OffCpuReasons: make(map[string]float64),
+		},
+	}
+	a.tasks[pid] = t
+	return t
+}
+
+/* Account an event, returns the completed off-CPU interval of a task, if any */
+func (a *schedAnalyzer) handle(ev *schedEvent, pids PidTranslator) (*schedTask, time.Duration, time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	switch ev.Name {
+	case "sched_switch":
+		if t := a.task(ev.pid("prev_pid"), ev.Fields["prev_comm"], pids, false); t != nil {
+			if t.onCpu != 0 {
+				t.stats.OnCpu += usec(ev.Time - t.onCpu)
+			}
+			t.onCpu = 0
+			t.offCpu = ev.Time
+			t.reason = offCpuReason(ev.Fields["prev_state"])
+			t.stats.Switches++
+			if t.reason == offCpuReasons['R'] {
+				t.runnable = ev.Time
+			}
+		}
+		if t := a.task(ev.pid("next_pid"), ev.Fields["next_comm"], pids, false); t != nil {
+			var off, rq time.Duration
+			t.onCpu = ev.Time
+			if t.runnable != 0 {
+				rq = ev.Time - t.runnable
+				t.stats.RunqueueCount++
+				t.stats.RunqueueTotal += usec(rq)
+				if usec(rq) > t.stats.RunqueueMax {
+					t.stats.RunqueueMax = usec(rq)
+				}
+				t.runnable = 0
+			}
+			if t.offCpu != 0 {
+				off = ev.Time - t.offCpu
+				t.stats.OffCpu += usec(off)
+				t.stats.OffCpuReasons[t.reason] += usec(off)
+				t.offCpu = 0
+				return t, off, rq
+			}
+		}
+	case "sched_wakeup", "sched_wakeup_new":
+		if t := a.task(ev.pid("pid"), ev.Fields["comm"], pids, true); t != nil && t.runnable == 0 {
+			t.runnable = ev.Time
+		}
+	case "sched_process_fork":
+		a.task(ev.pid("child_pid"), ev.Fields["child_comm"], pids, true)
+	case "sched_process_exec":
+		if t := a.task(ev.pid("pid"), "", pids, false); t != nil {
+			if f := ev.Fields["filename"]; f != "" {
+				t.stats.Comm = f[strings.LastIndex(f, "/")+1:]
+			}
+		}
+	case "sched_process_exit":
+		if t := a.task(ev.pid("pid"), ev.Fields["comm"], pids, false); t != nil {
+			if t.onCpu != 0 {
+				t.stats.OnCpu += usec(ev.Time - t.onCpu)
+			}
+			t.onCpu, t.offCpu, t.runnable = 0, 0, 0
+			t.stats.Exited = true
+		}
+	}
+
+	return nil, 0, 0
+}
+
+/* Get the statistics of all traced tasks, sorted by PID */
+func (a *schedAnalyzer) stats() []*SchedStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	res := []*SchedStats{}
+	for _, t := range a.tasks {
+		s := t.stats
+		s.OffCpuReasons = make(map[string]float64)
+		for r, d := range t.stats.OffCpuReasons {
+			s.OffCpuReasons[r] = d
+		}
+		res = append(res, &s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Pid < res[j].Pid })
+
+	return res
+}
+
+func (l *Logger) logSched(job *logWorker, line string) *TraceEvent {
+	ev := newTraceEvent(line, job.log.Pids)
+	se := parseSchedEvent(line)
+	if se == nil {
+		return ev
+	}
+
+	a := job.log.sched
+	t, off, rq := a.handle(se, job.log.Pids)
+	if t == nil {
+		return ev
+	}
+	end := a.clock.wallTime(se.Time)
+	_, sp := l.tracer.Start(job.ctx, "off-cpu", logger.WithTimestamp(end.Add(-off)))
+	sp.SetAttributes(attribute.Key("pid").Int(t.stats.Pid))
+	if t.stats.ContainerPid != 0 {
+		sp.SetAttributes(attribute.Key("containerPid").Int(t.stats.ContainerPid))
+	}
+	sp.SetAttributes(attribute.Key("comm").String(t.stats.Comm))
+	sp.SetAttributes(attribute.Key("reason").String(t.reason))
+	sp.SetAttributes(attribute.Key("off_cpu_us").Float64(usec(off)))
+	sp.SetAttributes(attribute.Key("runqueue_us").Float64(usec(rq)))
+	sp.End(logger.WithTimestamp(end))
+
+	return ev
+}
+
+/* Export the summary statistics of all traced tasks */
+func (l *Logger) logSchedSummary(job *logWorker) {
+	for _, s := range job.log.sched.stats() {
+		_, sp := l.tracer.Start(job.ctx, "sched-summary")
+		sp.SetAttributes(attribute.Key("pid").Int(s.Pid))
+		if s.ContainerPid != 0 {
+			sp.SetAttributes(attribute.Key("containerPid").Int(s.ContainerPid))
+		}
+		sp.SetAttributes(attribute.Key("comm").String(s.Comm))
+		sp.SetAttributes(attribute.Key("switches").Int(s.Switches))
+		sp.SetAttributes(attribute.Key("on_cpu_us").Float64(s.OnCpu))
+		sp.SetAttributes(attribute.Key("off_cpu_us").Float64(s.OffCpu))
+		for r, d := range s.OffCpuReasons {
+			sp.SetAttributes(attribute.Key("off_cpu_" + r + "_us").Float64(d))
+		}
+		sp.SetAttributes(attribute.Key("runqueue_count").Int(s.RunqueueCount))
+		sp.SetAttributes(attribute.Key("runqueue_total_us").Float64(s.RunqueueTotal))
+		sp.SetAttributes(attribute.Key("runqueue_max_us").Float64(s.RunqueueMax))
+		sp.End()
+	}
+}
+
+/* Scheduling statistics of the traced tasks, if the job collects scheduler traces */
+func (j *LogJob) SchedStats() []*SchedStats {
+	if j.sched == nil {
+		return nil
+	}
+	return j.sched.stats()
+}
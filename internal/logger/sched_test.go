@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package logger
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	sdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type fakePids map[int]int
+
+func (f fakePids) Lookup(pid int) (int, bool) {
+	p, ok := f[pid]
+	return p, ok
+}
+
+func TestSchedAnalyzer(t *testing.T) {
+	a := newSchedAnalyzer()
+	pids := fakePids{100: 1}
+	events := []string{
+		"           app-100     [001] d..2.  10.000000: sched_switch: prev_comm=app prev_pid=100 prev_prio=120 prev_state=D ==> next_comm=swapper/1 next_pid=0 next_prio=120",
+		"          <idle>-0     [001] dNh3.  10.000500: sched_wakeup: comm=app pid=100 prio=120 target_cpu=001",
+		"          <idle>-0     [001] d..2.  10.000700: sched_switch: prev_comm=swapper/1 prev_pid=0 prev_prio=120 prev_state=R ==> next_comm=app pid=100 next_pid=100 next_prio=120",
+		"           app-100     [001] d..2.  10.001700: sched_switch: prev_comm=app prev_pid=100 prev_prio=120 prev_state=R+ ==> next_comm=other next_pid=7 next_prio=120",
+		"           other-7     [001] d..2.  10.002000: sched_switch: prev_comm=other prev_pid=7 prev_prio=120 prev_state=S ==> next_comm=app next_pid=100 next_prio=120",
+		"           app-100     [001] .....  10.002100: sched_process_fork: comm=app pid=100 child_comm=app child_pid=101",
+		"           app-100     [001] .....  10.003000: sched_process_exit: comm=app pid=100 prio=120",
+	}
+
+	offs := []float64{}
+	for _, l := range events {
+		ev := parseSchedEvent(l)
+		assert.NotNil(t, ev)
+		if tk, off, _ := a.handle(ev, pids); tk != nil {
+			offs = append(offs, usec(off))
+		}
+	}
+	assert.InDeltaSlice(t, []float64{700, 300}, offs, 0.01)
+
+	stats := a.stats()
+	assert.Equal(t, 2, len(stats))
+	s := stats[0]
+	assert.Equal(t, 100, s.Pid)
+	assert.Equal(t, 1, s.ContainerPid)
+	assert.Equal(t, 2, s.Switches)
+	assert.Equal(t, 2, s.RunqueueCount)
+	assert.InDelta(t, 500, s.RunqueueTotal, 0.01)
+	assert.InDelta(t, 300, s.RunqueueMax, 0.01)
+	assert.InDelta(t, 1000, s.OffCpu, 0.01)
+	assert.InDelta(t, 700, s.OffCpuReasons["uninterruptible"], 0.01)
+	assert.InDelta(t, 300, s.OffCpuReasons["preempted"], 0.01)
+	assert.InDelta(t, 2000, s.OnCpu, 0.01)
+	assert.True(t, s.Exited)
+	/* The other task is not in the container */
+	assert.Equal(t, 101, stats[1].Pid)
+
+	assert.Nil(t, parseSchedEvent("# tracer: nop"))
+}
+
+/* Run a log job on the given traces and stop it. Returns the ended spans, the span of the job is the last one */
+func runLogJob(t *testing.T, format string, events []string) []sdk.ReadOnlySpan {
+	rec := tracetest.NewSpanRecorder()
+	l := &Logger{
+		ctx:        context.Background(),
+		tracer:     sdk.NewTracerProvider(sdk.WithSpanProcessor(rec)).Tracer("test"),
+		logWorkers: make(map[string]*logWorker),
+	}
+	r, w := io.Pipe()
+	job := &LogJob{
+		Name:   "job",
+		File:   "pipe:1",
+		Input:  r,
+		Format: format,
+		Pids:   fakePids{100: 1},
+	}
+	assert.Nil(t, l.RunLogJob(job))
+	_, err := w.Write([]byte(strings.Join(events, "\n") + "\n"))
+	assert.Nil(t, err)
+	/* The reader asks for more data only after it handled all previous lines */
+	_, err = w.Write([]byte("\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, l.StopLogJob(job))
+
+	assert.Eventually(t, func() bool {
+		spans := rec.Ended()
+		return len(spans) > 0 && spans[len(spans)-1].Name() == "job"
+	}, time.Second, 10*time.Millisecond)
+	return rec.Ended()
+}
+
+func TestSchedSummarySpans(t *testing.T) {
+	spans := runLogJob(t, FormatSched, []string{
+		"           app-100     [001] d..2.  10.000000: sched_switch: prev_comm=app prev_pid=100 prev_prio=120 prev_state=S ==> next_comm=swapper/1 next_pid=0 next_prio=120",
+		"          <idle>-0     [001] dNh3.  10.000500: sched_wakeup: comm=app pid=100 prio=120 target_cpu=001",
+	})
+
+	/* The summary is flushed when the job stops, before the span of the job ends */
+	job := spans[len(spans)-1]
+	summary := 0
+	for _, s := range spans[:len(spans)-1] {
+		assert.Equal(t, job.SpanContext().SpanID(), s.Parent().SpanID())
+		assert.False(t, s.EndTime().After(job.EndTime()))
+		if s.Name() == "sched-summary" {
+			summary++
+		}
+	}
+	assert.Equal(t, 1, summary)
+}
@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Parsing of trace events and streaming them to subscribers.
+ */
+package logger
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	eventsQueueLen = 1024
+	/* ftrace text format: "<comm>-<pid> [<cpu>] <flags> <timestamp>: <event>: <data>" */
+	ftraceTaskRe = regexp.MustCompile(`^\s*(.*?)-(\d+)\s+(\(\s*[-\d]+\)\s+)?\[\d+\]`)
+)
+
+/* Translates host PIDs to PIDs, as seen inside the container */
+type PidTranslator interface {
+	Lookup(pid int) (int, bool)
+}
+
+type TraceEvent struct {
+	Pid          int    `json:",omitempty"` /* PID of the task, as seen on the host */
+	ContainerPid int    `json:",omitempty"` /* PID of the task, as seen inside its container */
+	Line         string /* The raw trace event */
+}
+
+/* Maps the trace clock to the wall clock */
+type traceClock struct {
+	offset time.Duration
+}
+
+/* Parse a trace timestamp, i.e. "1234.567890" seconds */
+func parseTraceTime(s string) (time.Duration, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(v * float64(time.Second)), nil
+}
+
+/* Convert a trace timestamp to wall clock, the first seen timestamp is mapped to the current time */
+func (c *traceClock) wallTime(t time.Duration) time.Time {
+	if c.offset == 0 {
+		c.offset = time.Duration(time.Now().UnixNano()) - t
+	}
+	return time.Unix(0, int64(t+c.offset))
+}
+
+/* Parse a raw trace event and translate its PID */
+func newTraceEvent(line string, pids PidTranslator) *TraceEvent {
+	ev := TraceEvent{
+		Line: line,
+	}
+
+	if m := ftraceTaskRe.FindStringSubmatch(line); m != nil {
+		if pid, err := strconv.Atoi(m[2]); err == nil {
+			ev.Pid = pid
+			if pids != nil {
+				if cpid, ok := pids.Lookup(pid); ok {
+					ev.ContainerPid = cpid
+				}
+			}
+		}
+	}
+
+	return &ev
+}
+
+/* Send a trace event to all subscribers of the job, without blocking */
+func (w *logWorker) publish(ev *TraceEvent) {
+	w.subLock.Lock()
+	defer w.subLock.Unlock()
+
+	for _, s := range w.subscribers {
+		select {
+		case s <- ev:
+		default:
+		}
+	}
+}
+
+func (w *logWorker) closeSubscribers() {
+	w.subLock.Lock()
+	defer w.subLock.Unlock()
+
+	for _, s := range w.subscribers {
+		close(s)
+	}
+	w.subscribers = nil
+	w.closed = true
+}
+
+/*
+ * Subscribe for the events of a running log job. The returned channel is closed when the job
+ * completes, the returned function must be called to unsubscribe.
+ */
+func (l *Logger) Subscribe(job *LogJob) (<-chan *TraceEvent, func(), bool) {
+	l.lock.Lock()
+	w, ok := l.logWorkers[job.File]
+	l.lock.Unlock()
+	if !ok {
+		return nil, nil, false
+	}
+
+	ch := make(chan *TraceEvent, eventsQueueLen)
+	w.subLock.Lock()
+	if w.closed {
+		w.subLock.Unlock()
+		return nil, nil, false
+	}
+	w.subscribers = append(w.subscribers, ch)
+	w.subLock.Unlock()
+
+	return ch, func() {
+		w.subLock.Lock()
+		defer w.subLock.Unlock()
+		for i, s := range w.subscribers {
+			if s == ch {
+				w.subscribers = append(w.subscribers[:i], w.subscribers[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}, true
+}
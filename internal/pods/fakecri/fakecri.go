@@ -0,0 +1,419 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * In-process fake CRI runtime, used to test the pods discovery without a real container runtime.
+ * It serves a scripted list of containers over a temporary unix socket.
+ */
+package fakecri
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pbuf "k8s.io/cri-api/pkg/apis/runtime/v1"
+	ktype "k8s.io/kubernetes/pkg/kubelet/types"
+)
+
+var (
+	socketName     = "cri.sock"
+	eventsQueueLen = 64
+	DefaultImage   = "fake.registry/fake-image:latest"
+)
+
+type Container struct {
+	Id             string              /* ID of the container in the runtime */
+	Name           string              /* Name of the container */
+	Pod            string              /* Name of the pod */
+	Namespace      string              /* Kubernetes name space of the pod */
+	SandboxId      string              /* ID of the pod sandbox, generated from the pod name if not set */
+	RuntimeHandler string              /* Runtime handler of the pod sandbox, i.e. kata */
+	Labels         map[string]string   /* Additional container labels */
+	Pid            int                 /* PID of the container process, reported in the status info */
+	Info           *string             /* Raw status info JSON, overrides the generated one */
+	State          pbuf.ContainerState /* Containers with a Pid are running, if no state is set */
+	Stats          *pbuf.ContainerStats
+	StatusError    error /* Returned by the status call of this container */
+}
+
+type Runtime struct {
+	pbuf.UnimplementedRuntimeServiceServer
+
+	Name     string /* Runtime name, reported by the Version call */
+	Endpoint string /* CRI endpoint of the runtime, unix://<path> */
+
+	lock       sync.Mutex
+	dir        string
+	server     *grpc.Server
+	containers map[string]*Container
+	errors     map[string]error
+	events     []chan *pbuf.ContainerEventResponse
+}
+
+/* Create a new fake runtime, listening on a unix socket in a new temporary directory */
+func NewRuntime(name string) (*Runtime, error) {
+	dir, err := os.MkdirTemp("", "fakecri")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Runtime{
+		Name:       name,
+		dir:        dir,
+		containers: make(map[string]*Container),
+		errors:     make(map[string]error),
+	}
+	r.Endpoint = "unix://" + r.SocketPath()
+
+	if err := r.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+/* Path to the unix socket of the runtime */
+func (r *Runtime) SocketPath() string {
+	return filepath.Join(r.dir, socketName)
+}
+
+/* Start serving CRI requests, can be used to simulate restart of the runtime after Stop */
+func (r *Runtime) Start() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.server != nil {
+		return fmt.Errorf("Runtime %s is already running", r.Name)
+	}
+
+	os.Remove(r.SocketPath())
+	l, err := net.Listen("unix", r.SocketPath())
+	if err != nil {
+		return err
+	}
+
+	r.server = grpc.NewServer()
+	pbuf.RegisterRuntimeServiceServer(r.server, r)
+	go r.server.Serve(l)
+
+	return nil
+}
+
+/* Stop serving CRI requests, all connections are closed */
+func (r *Runtime) Stop() {
+	r.lock.Lock()
+	srv := r.server
+	r.server = nil
+	for _, e := range r.events {
+		close(e)
+	}
+	r.events = nil
+	r.lock.Unlock()
+
+	if srv != nil {
+		srv.Stop()
+	}
+}
+
+/* Stop the runtime and remove its temporary directory */
+func (r *Runtime) Destroy() {
+	r.Stop()
+	os.RemoveAll(r.dir)
+}
+
+/* Return the given error on each call of a CRI method, i.e. "ListContainers". Pass nil to reset */
+func (r *Runtime) SetError(method string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err == nil {
+		delete(r.errors, method)
+	} else {
+		r.errors[method] = err
+	}
+}
+
+func (r *Runtime) getError(method string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.errors[method]
+}
+
+func sandboxId(c *Container) string {
+	if c.SandboxId != "" {
+		return c.SandboxId
+	}
+	return "sandbox-" + c.Pod
+}
+
+func (r *Runtime) sendEvent(c *Container, t pbuf.ContainerEventType) {
+	ev := &pbuf.ContainerEventResponse{
+		ContainerId:        c.Id,
+		ContainerEventType: t,
+		CreatedAt:          time.Now().UnixNano(),
+		PodSandboxStatus: &pbuf.PodSandboxStatus{
+			Id: sandboxId(c),
+			Metadata: &pbuf.PodSandboxMetadata{
+				Name:      c.Pod,
+				Namespace: c.Namespace,
+			},
+			RuntimeHandler: c.RuntimeHandler,
+		},
+	}
+	for _, e := range r.events {
+		select {
+		case e <- ev:
+		default:
+		}
+	}
+}
+
+/* Add a new running container to the runtime and send a CONTAINER_STARTED_EVENT */
+func (r *Runtime) Add(c *Container) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if c.State == pbuf.ContainerState_CONTAINER_CREATED && c.Pid != 0 {
+		c.State = pbuf.ContainerState_CONTAINER_RUNNING
+	}
+	r.containers[c.Id] = c
+	r.sendEvent(c, pbuf.ContainerEventType_CONTAINER_STARTED_EVENT)
+}
+
+/* Remove a container from the runtime and send a CONTAINER_DELETED_EVENT */
+func (r *Runtime) Remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if c, ok := r.containers[id]; ok {
+		delete(r.containers, id)
+		r.sendEvent(c, pbuf.ContainerEventType_CONTAINER_DELETED_EVENT)
+	}
+}
+
+func (r *Runtime) labels(c *Container) map[string]string {
+	res := map[string]string{
+		ktype.KubernetesPodNameLabel:       c.Pod,
+		ktype.KubernetesPodNamespaceLabel:  c.Namespace,
+		ktype.KubernetesContainerNameLabel: c.Name,
+	}
+	for k, v := range c.Labels {
+		res[k] = v
+	}
+	return res
+}
+
+func (r *Runtime) container(c *Container) *pbuf.Container {
+	return &pbuf.Container{
+		Id:           c.Id,
+		PodSandboxId: sandboxId(c),
+		Metadata: &pbuf.ContainerMetadata{
+			Name: c.Name,
+		},
+		Image:     &pbuf.ImageSpec{Image: DefaultImage},
+		ImageRef:  DefaultImage,
+		State:     c.State,
+		CreatedAt: 1,
+		Labels:    r.labels(c),
+	}
+}
+
+func matchLabels(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Runtime) Version(ctx context.Context, req *pbuf.VersionRequest) (*pbuf.VersionResponse, error) {
+	if err := r.getError("Version"); err != nil {
+		return nil, err
+	}
+	return &pbuf.VersionResponse{
+		Version:           "0.1.0",
+		RuntimeName:       r.Name,
+		RuntimeVersion:    "0.1.0",
+		RuntimeApiVersion: "v1",
+	}, nil
+}
+
+func (r *Runtime) ListContainers(ctx context.Context, req *pbuf.ListContainersRequest) (*pbuf.ListContainersResponse, error) {
+	if err := r.getError("ListContainers"); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res := &pbuf.ListContainersResponse{}
+	f := req.GetFilter()
+	for _, c := range r.containers {
+		if f != nil {
+			if f.Id != "" && f.Id != c.Id {
+				continue
+			}
+			if f.PodSandboxId != "" && f.PodSandboxId != sandboxId(c) {
+				continue
+			}
+			if f.State != nil && f.State.State != c.State {
+				continue
+			}
+			if !matchLabels(f.LabelSelector, r.labels(c)) {
+				continue
+			}
+		}
+		res.Containers = append(res.Containers, r.container(c))
+	}
+
+	return res, nil
+}
+
+func (r *Runtime) ContainerStatus(ctx context.Context, req *pbuf.ContainerStatusRequest) (*pbuf.ContainerStatusResponse, error) {
+	if err := r.getError("ContainerStatus"); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	c, ok := r.containers[req.ContainerId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Container %s not found", req.ContainerId)
+	}
+	if c.StatusError != nil {
+		return nil, c.StatusError
+	}
+
+	res := &pbuf.ContainerStatusResponse{
+		Status: &pbuf.ContainerStatus{
+			Id:        c.Id,
+			Metadata:  &pbuf.ContainerMetadata{Name: c.Name},
+			State:     c.State,
+			CreatedAt: 1,
+			Image:     &pbuf.ImageSpec{Image: DefaultImage},
+			ImageRef:  DefaultImage,
+			Labels:    r.labels(c),
+		},
+	}
+	if req.Verbose {
+		if c.Info != nil {
+			res.Info = map[string]string{"info": *c.Info}
+		} else if info, err := json.Marshal(map[string]interface{}{"Pid": c.Pid}); err == nil {
+			res.Info = map[string]string{"info": string(info)}
+		}
+	}
+
+	return res, nil
+}
+
+func (r *Runtime) ListPodSandbox(ctx context.Context, req *pbuf.ListPodSandboxRequest) (*pbuf.ListPodSandboxResponse, error) {
+	if err := r.getError("ListPodSandbox"); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res := &pbuf.ListPodSandboxResponse{}
+	seen := make(map[string]bool)
+	for _, c := range r.containers {
+		id := sandboxId(c)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		res.Items = append(res.Items, &pbuf.PodSandbox{
+			Id: id,
+			Metadata: &pbuf.PodSandboxMetadata{
+				Name:      c.Pod,
+				Namespace: c.Namespace,
+				Uid:       id,
+			},
+			State:          pbuf.PodSandboxState_SANDBOX_READY,
+			CreatedAt:      1,
+			RuntimeHandler: c.RuntimeHandler,
+		})
+	}
+
+	return res, nil
+}
+
+func (r *Runtime) ContainerStats(ctx context.Context, req *pbuf.ContainerStatsRequest) (*pbuf.ContainerStatsResponse, error) {
+	if err := r.getError("ContainerStats"); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	c, ok := r.containers[req.ContainerId]
+	if !ok {
+		return nil, fmt.Errorf("Container %s not found", req.ContainerId)
+	}
+
+	return &pbuf.ContainerStatsResponse{Stats: c.Stats}, nil
+}
+
+func (r *Runtime) ListContainerStats(ctx context.Context, req *pbuf.ListContainerStatsRequest) (*pbuf.ListContainerStatsResponse, error) {
+	if err := r.getError("ListContainerStats"); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res := &pbuf.ListContainerStatsResponse{}
+	for _, c := range r.containers {
+		if c.Stats != nil {
+			res.Stats = append(res.Stats, c.Stats)
+		}
+	}
+
+	return res, nil
+}
+
+/* Stream container events, until the runtime is stopped or the client disconnects */
+func (r *Runtime) GetContainerEvents(req *pbuf.GetEventsRequest, stream pbuf.RuntimeService_GetContainerEventsServer) error {
+	if err := r.getError("GetContainerEvents"); err != nil {
+		return err
+	}
+
+	ev := make(chan *pbuf.ContainerEventResponse, eventsQueueLen)
+	r.lock.Lock()
+	r.events = append(r.events, ev)
+	r.lock.Unlock()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			r.lock.Lock()
+			for i, e := range r.events {
+				if e == ev {
+					r.events = append(r.events[:i], r.events[i+1:]...)
+					break
+				}
+			}
+			r.lock.Unlock()
+			return nil
+		case e, ok := <-ev:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		}
+	}
+}
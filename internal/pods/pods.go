@@ -14,16 +14,37 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	parentPidStr      = "PPid:"
 	procfsPathDefault = "/proc"
 	EnvForceProcfs    = "TRACER_FORCE_PROCFS"
+	namespaceTypes    = []string{"cgroup", "ipc", "mnt", "net", "pid", "user", "uts"}
 )
 
 type podsDiscover interface {
 	podScan() (*map[string]*pod, error)
+	runtime() string
+	endpoint() string
+}
+
+/* State of a discovery backend, as reported by the health API */
+type DiscoverHealth struct {
+	Backend       string
+	Endpoint      string
+	Fallback      bool       /* Used temporarily, when the other backends are not available */
+	Active        bool       /* Containers from the last scan of this backend are in the database */
+	LastScan      *time.Time /* Time of the last successful scan */
+	LastError     *string
+	LastErrorTime *time.Time
+}
+
+type podsBackend struct {
+	discover podsDiscover
+	health   DiscoverHealth
 }
 
 type PodConfig struct {
@@ -32,9 +53,15 @@ type PodConfig struct {
 }
 
 type Container struct {
-	Id, Pod *string
-	Parent  []int
-	Tasks   []int `json:"Tasks"`
+	Id, Pod   *string
+	Namespace string  `json:",omitempty"` /* Kubernetes name space of the pod */
+	Runtime   *string /* Name of the container runtime, that reported this container */
+	Parent    []int
+	Tasks     []int           `json:"Tasks"`
+	NetNs     int             `json:",omitempty"` /* Inode of the network name space of the container */
+	Stats     *ContainerStats `json:",omitempty"` /* Resource usage, set only when requested */
+	cid       string          /* ID of the container in the runtime */
+	discover  podsDiscover    /* The backend, that reported this container */
 }
 
 type pod struct {
@@ -43,9 +70,17 @@ type pod struct {
 
 type PodDb struct {
 	ctx        context.Context
-	discover   podsDiscover
+	lock       sync.RWMutex
+	discover   []*podsBackend
+	fallback   *podsBackend
 	procfsPath *string
+	sysfsPath  *string
+	cpuSamples map[string]cpuSample       /* Previous CPU usage of the containers */
+	stats      map[string]*ContainerStats /* Resource usage of the containers, from the last scan */
 	pods       *map[string]*pod
+	revision   uint64            /* Incremented on each change of the pods database */
+	changes    []ContainerChange /* Log of the most recent changes */
+	trimmed    uint64            /* The last revision, dropped from the change log */
 }
 
 func hasWildcard(pattern *string) bool {
@@ -98,6 +133,12 @@ func (p *PodDb) GetContainers(podName, containerName *string) []*Container {
 
 	res := []*Container{}
 
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.pods == nil {
+		return res
+	}
+
 	if !hasWildcard(podName) {
 		if pd, ok := (*p.pods)[*podName]; ok {
 			return getContainersFromPod(pd, containerName)
@@ -116,35 +157,47 @@ func (p *PodDb) GetContainers(podName, containerName *string) []*Container {
 	return res
 }
 
-func getPodDiscover(ctx context.Context, cfg *PodConfig, procfsPath *string) (podsDiscover, error) {
+func getPodDiscover(ctx context.Context, cfg *PodConfig, procfsPath *string) ([]podsDiscover, error) {
 	var d podsDiscover
+	var all []podsDiscover
 	var err error
 
 	if cfg.ForceProc != nil && *cfg.ForceProc {
-		return getProcDiscover(ctx, procfsPath)
+		if d, err = getProcDiscover(ctx, procfsPath); err == nil {
+			return []podsDiscover{d}, nil
+		}
+		return nil, err
 	}
 
-	if d, err = getCriDiscover(ctx, &cfg.Cri); err == nil {
-		return d, err
+	if all, err = getCriDiscover(ctx, &cfg.Cri); err == nil {
+		return all, err
 	} else if d, err = getProcDiscover(ctx, procfsPath); err == nil {
-		return d, err
+		return []podsDiscover{d}, err
 	}
 
 	return nil, err
 }
 
-func NewPodDb(ctx context.Context, cfg *PodConfig, procfsPath *string) (*PodDb, error) {
+func NewPodDb(ctx context.Context, cfg *PodConfig, procfsPath, sysfsPath *string) (*PodDb, error) {
 
 	ppath := procfsPath
 	if ppath == nil || *ppath == "" {
 		ppath = &procfsPathDefault
 	}
+	spath := sysfsPath
+	if spath == nil || *spath == "" {
+		spath = &sysfsPathDefault
+	}
 
 	if d, err := getPodDiscover(ctx, cfg, ppath); err == nil {
 		db := &PodDb{
-			discover:   d,
 			ctx:        ctx,
 			procfsPath: ppath,
+			sysfsPath:  spath,
+			cpuSamples: make(map[string]cpuSample),
+		}
+		for _, b := range d {
+			db.discover = append(db.discover, newPodsBackend(b, false))
 		}
 		db.Scan()
 		return db, nil
@@ -185,8 +238,8 @@ func checkArrayContains(arr []int, val int) bool {
 	return false
 }
 
-func (p *PodDb) scanParents() {
-	for _, pd := range *p.pods {
+func (p *PodDb) scanParents(pods *map[string]*pod) {
+	for _, pd := range *pods {
 		for _, cn := range pd.Containers {
 			for _, t := range cn.Tasks {
 				if ppid, err := p.getParent(t); err == nil {
@@ -205,18 +258,192 @@ func (p *PodDb) scanParents() {
 	}
 }
 
+/* ID of the container in its runtime, empty if the container is not reported by a runtime */
+func (c *Container) RuntimeId() string {
+	return c.cid
+}
+
+/* Get the inodes of the name spaces of a task, by name space type */
+func (p *PodDb) Namespaces(pid int) map[string]int {
+	res := make(map[string]int)
+
+	for _, n := range namespaceTypes {
+		if ns, err := NamespaceInode(*p.procfsPath, pid, n); err == nil {
+			res[n] = ns
+		}
+	}
+	return res
+}
+
+/* Get the cgroup paths of a task, by controllers. The cgroup v2 path has an empty key */
+func (p *PodDb) Cgroups(pid int) (map[string]string, error) {
+	return p.getCgroups(pid)
+}
+
+func (p *PodDb) scanNamespaces(pods *map[string]*pod) {
+	for _, pd := range *pods {
+		for _, cn := range pd.Containers {
+			for _, t := range cn.Tasks {
+				if ns, err := NamespaceInode(*p.procfsPath, t, "net"); err == nil {
+					cn.NetNs = ns
+					break
+				}
+			}
+		}
+	}
+}
+
+func tasksOverlap(c1, c2 *Container) bool {
+	for _, t := range c1.Tasks {
+		if checkArrayContains(c2.Tasks, t) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Check if the container is already in the pod, reported by another runtime with the same ID or tasks */
+func (p *pod) hasContainer(c *Container) bool {
+	for _, old := range p.Containers {
+		if c.cid != "" && old.cid == c.cid {
+			return true
+		}
+		if tasksOverlap(old, c) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Merge pods, reported by one discovery backend, into the pods database */
+func mergePods(all map[string]*pod, pods *map[string]*pod, d podsDiscover) {
+	runtime := d.runtime()
+	for pn, pd := range *pods {
+		if _, ok := all[pn]; !ok {
+			all[pn] = &pod{
+				Containers: make(map[string]*Container),
+			}
+		}
+		for cn, c := range pd.Containers {
+			/* The same container, reported by more than one runtime */
+			if all[pn].hasContainer(c) {
+				continue
+			}
+			/* Different containers with the same name, reported by different runtimes */
+			name := cn
+			for i := 1; all[pn].Containers[name] != nil; i++ {
+				name = cn + "@" + runtime
+				if i > 1 {
+					name = fmt.Sprintf("%s@%s-%d", cn, runtime, i)
+				}
+			}
+			c.discover = d
+			all[pn].Containers[name] = c
+		}
+	}
+}
+
+func newPodsBackend(d podsDiscover, fallback bool) *podsBackend {
+	return &podsBackend{
+		discover: d,
+		health: DiscoverHealth{
+			Backend:  d.runtime(),
+			Endpoint: d.endpoint(),
+			Fallback: fallback,
+		},
+	}
+}
+
+func (p *PodDb) scanBackend(b *podsBackend, all map[string]*pod) error {
+	now := time.Now()
+	cdb, err := b.discover.podScan()
+
+	b.health.Backend = b.discover.runtime()
+	b.health.Active = err == nil
+	if err != nil {
+		e := err.Error()
+		b.health.LastError = &e
+		b.health.LastErrorTime = &now
+		return err
+	}
+
+	b.health.LastScan = &now
+	mergePods(all, cdb, b.discover)
+	return nil
+}
+
+/* Get a procfs backend, used temporarily when all other backends fail */
+func (p *PodDb) getFallback() *podsBackend {
+	if p.fallback != nil {
+		return p.fallback
+	}
+	for _, b := range p.discover {
+		if b.discover.runtime() == procRuntime {
+			return nil
+		}
+	}
+	if d, err := getProcDiscover(p.ctx, p.procfsPath); err == nil {
+		p.fallback = newPodsBackend(d, true)
+	}
+
+	return p.fallback
+}
+
 func (p *PodDb) Scan() error {
-	if cdb, err := p.discover.podScan(); err == nil {
-		p.pods = cdb
-		p.scanParents()
-	} else {
+	var err error
+	scanned := false
+	all := make(map[string]*pod)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, b := range p.discover {
+		if e := p.scanBackend(b, all); e == nil {
+			scanned = true
+		} else {
+			err = e
+		}
+	}
+
+	if !scanned {
+		if f := p.getFallback(); f != nil && p.scanBackend(f, all) == nil {
+			scanned = true
+		}
+	} else if p.fallback != nil {
+		p.fallback.health.Active = false
+	}
+
+	if !scanned {
 		return err
 	}
 
+	p.scanParents(&all)
+	p.scanNamespaces(&all)
+	p.newRevision(&all)
+	p.pods = &all
 	return nil
 }
 
+/* Get the state of all discovery backends */
+func (p *PodDb) Health() []DiscoverHealth {
+	res := []DiscoverHealth{}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	for _, b := range p.discover {
+		res = append(res, b.health)
+	}
+	if p.fallback != nil {
+		res = append(res, p.fallback.health)
+	}
+
+	return res
+}
+
 func (p *PodDb) Count() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
 	if p.pods == nil {
 		return 0
 	}
@@ -233,5 +460,7 @@ func (p *PodDb) Print() {
 }
 
 func (p *PodDb) Get() *map[string]*pod {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
 	return p.pods
 }
@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Revisions of the pods database and a log with all changes between revisions.
+ */
+package pods
+
+import "fmt"
+
+var (
+	changesMax = 4096 /* Max number of entries in the change log */
+
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+type ContainerChange struct {
+	Revision  uint64
+	Type      string
+	Pod       string
+	Name      string     /* Name of the container, as used in the pods database */
+	Container *Container `json:",omitempty"` /* Not set for removed containers */
+}
+
+type PodChanges struct {
+	Revision uint64 /* Current revision of the pods database */
+	Full     bool   /* No revision is requested, all containers are returned as added */
+	Changes  []ContainerChange
+}
+
+func sameTasks(t1, t2 []int) bool {
+	if len(t1) != len(t2) {
+		return false
+	}
+	for _, t := range t1 {
+		if !checkArrayContains(t2, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameContainer(c1, c2 *Container) bool {
+	if !sameTasks(c1.Tasks, c2.Tasks) || !sameTasks(c1.Parent, c2.Parent) || c1.NetNs != c2.NetNs {
+		return false
+	}
+	if (c1.Runtime == nil) != (c2.Runtime == nil) {
+		return false
+	}
+	return c1.Runtime == nil || *c1.Runtime == *c2.Runtime
+}
+
+/* Compare the old and the new pods databases and get the list of changes */
+func diffPods(old, new *map[string]*pod, revision uint64) []ContainerChange {
+	res := []ContainerChange{}
+	empty := map[string]*pod{}
+
+	if old == nil {
+		old = &empty
+	}
+	for pn, pd := range *new {
+		for cn, c := range pd.Containers {
+			ch := ContainerChange{
+				Revision:  revision,
+				Type:      ChangeAdded,
+				Pod:       pn,
+				Name:      cn,
+				Container: c,
+			}
+			if opd, ok := (*old)[pn]; ok {
+				if oc, ok := opd.Containers[cn]; ok {
+					if sameContainer(oc, c) {
+						continue
+					}
+					ch.Type = ChangeChanged
+				}
+			}
+			res = append(res, ch)
+		}
+	}
+	for pn, pd := range *old {
+		for cn := range pd.Containers {
+			if npd, ok := (*new)[pn]; ok {
+				if _, ok := npd.Containers[cn]; ok {
+					continue
+				}
+			}
+			res = append(res, ContainerChange{
+				Revision: revision,
+				Type:     ChangeRemoved,
+				Pod:      pn,
+				Name:     cn,
+			})
+		}
+	}
+
+	return res
+}
+
+/* Record the changes, introduced by a new version of the pods database. Must be called with the lock held */
+func (p *PodDb) newRevision(pods *map[string]*pod) {
+	changes := diffPods(p.pods, pods, p.revision+1)
+	if len(changes) == 0 {
+		return
+	}
+
+	p.revision++
+	p.changes = append(p.changes, changes...)
+	if len(p.changes) > changesMax {
+		drop := len(p.changes) - changesMax
+		p.trimmed = p.changes[drop-1].Revision
+		p.changes = p.changes[drop:]
+	}
+}
+
+/*
+ * Get all changes in the pods database after the given revision. If the revision is 0, all containers
+ * are returned as added. Fails if the changes after the revision are no longer in the change log, or
+ * the revision is not known, i.e. it is from before a restart of the tracer.
+ */
+func (p *PodDb) Changes(since uint64) (*PodChanges, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	res := PodChanges{
+		Revision: p.revision,
+		Changes:  []ContainerChange{},
+	}
+
+	if since == 0 {
+		res.Full = true
+		if p.pods != nil {
+			res.Changes = diffPods(nil, p.pods, p.revision)
+		}
+		return &res, nil
+	}
+	if since > p.revision {
+		return nil, fmt.Errorf("Unknown revision %d of the pods database, the current is %d", since, p.revision)
+	}
+	if since < p.trimmed {
+		return nil, fmt.Errorf("Revision %d of the pods database is too old, the oldest is %d", since, p.trimmed)
+	}
+
+	for _, c := range p.changes {
+		if c.Revision > since {
+			res.Changes = append(res.Changes, c)
+		}
+	}
+
+	return &res, nil
+}
+
+func (p *PodDb) Revision() uint64 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.revision
+}
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package pods
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* Build a pods database from "<pod>/<container>" names, the tasks of each container are given */
+func podsOf(containers map[string][]int) *map[string]*pod {
+	res := make(map[string]*pod)
+	for name, tasks := range containers {
+		n := strings.SplitN(name, "/", 2)
+		if _, ok := res[n[0]]; !ok {
+			res[n[0]] = &pod{Containers: make(map[string]*Container)}
+		}
+		res[n[0]].Containers[n[1]] = &Container{Id: &n[1], Pod: &n[0], Tasks: tasks}
+	}
+	return &res
+}
+
+func changeTypes(ch []ContainerChange) map[string]string {
+	res := make(map[string]string)
+	for _, c := range ch {
+		res[c.Pod+"/"+c.Name] = c.Type
+	}
+	return res
+}
+
+func TestNewRevision(t *testing.T) {
+	db := &PodDb{}
+
+	db.newRevision(podsOf(map[string][]int{"web/c1": {1}, "web/c2": {2}}))
+	assert.Equal(t, uint64(1), db.revision)
+	db.pods = podsOf(map[string][]int{"web/c1": {1}, "web/c2": {2}})
+
+	/* Nothing is changed, the revision is the same */
+	db.newRevision(podsOf(map[string][]int{"web/c1": {1}, "web/c2": {2}}))
+	assert.Equal(t, uint64(1), db.revision)
+	assert.Len(t, db.changes, 2)
+
+	db.newRevision(podsOf(map[string][]int{"web/c1": {1, 3}, "api/c1": {4}}))
+	assert.Equal(t, uint64(2), db.revision)
+	assert.Equal(t, map[string]string{
+		"web/c1": ChangeChanged,
+		"web/c2": ChangeRemoved,
+		"api/c1": ChangeAdded,
+	}, changeTypes(db.changes[2:]))
+	for _, c := range db.changes[2:] {
+		assert.Equal(t, uint64(2), c.Revision)
+		assert.Equal(t, c.Type == ChangeRemoved, c.Container == nil)
+	}
+}
+
+func TestChangesTrim(t *testing.T) {
+	max := changesMax
+	changesMax = 3
+	defer func() { changesMax = max }()
+
+	db := &PodDb{}
+	scan := func(containers map[string][]int) {
+		pods := podsOf(containers)
+		db.newRevision(pods)
+		db.pods = pods
+	}
+
+	scan(map[string][]int{"web/c1": {1}, "web/c2": {2}})
+	scan(map[string][]int{"web/c1": {1}})
+	assert.Equal(t, uint64(0), db.trimmed)
+	/* Revision 1 is dropped from the log partially, the changes after it are still known */
+	scan(map[string][]int{"web/c1": {1}, "api/c1": {3}})
+	assert.Equal(t, uint64(1), db.trimmed)
+	assert.Len(t, db.changes, 3)
+	ch, err := db.Changes(1)
+	assert.Nil(t, err)
+	assert.Len(t, ch.Changes, 2)
+
+	scan(map[string][]int{"web/c1": {1}, "api/c1": {3}, "api/c2": {4}})
+	scan(map[string][]int{"web/c1": {1}, "api/c2": {4}})
+	assert.Equal(t, uint64(5), db.revision)
+	assert.Equal(t, uint64(2), db.trimmed)
+	assert.Len(t, db.changes, 3)
+
+	_, err = db.Changes(1)
+	assert.NotNil(t, err)
+	ch, err = db.Changes(3)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"api/c1": ChangeRemoved, "api/c2": ChangeAdded}, changeTypes(ch.Changes))
+	ch, err = db.Changes(0)
+	assert.Nil(t, err)
+	assert.Len(t, ch.Changes, 2)
+}
+
+func TestChangesSince(t *testing.T) {
+	db := &PodDb{}
+
+	/* An empty database */
+	ch, err := db.Changes(0)
+	assert.Nil(t, err)
+	assert.True(t, ch.Full)
+	assert.Empty(t, ch.Changes)
+
+	for _, c := range []map[string][]int{
+		{"web/c1": {1}},
+		{"web/c1": {1}, "web/c2": {2}},
+		{"web/c2": {2}},
+	} {
+		pods := podsOf(c)
+		db.newRevision(pods)
+		db.pods = pods
+	}
+
+	ch, err = db.Changes(0)
+	assert.Nil(t, err)
+	assert.True(t, ch.Full)
+	assert.Equal(t, uint64(3), ch.Revision)
+	assert.Equal(t, map[string]string{"web/c2": ChangeAdded}, changeTypes(ch.Changes))
+
+	ch, err = db.Changes(1)
+	assert.Nil(t, err)
+	assert.False(t, ch.Full)
+	assert.Len(t, ch.Changes, 2)
+	assert.Equal(t, map[string]string{"web/c1": ChangeRemoved, "web/c2": ChangeAdded}, changeTypes(ch.Changes))
+
+	ch, err = db.Changes(3)
+	assert.Nil(t, err)
+	assert.Empty(t, ch.Changes)
+
+	/* A revision from before a restart of the tracer */
+	_, err = db.Changes(4)
+	assert.NotNil(t, err)
+}
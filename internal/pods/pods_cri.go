@@ -10,8 +10,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
+	"path/filepath"
 	"time"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	criapi "k8s.io/cri-api/pkg/apis"
 	pbuf "k8s.io/cri-api/pkg/apis/runtime/v1"
 	"k8s.io/kubernetes/pkg/kubelet/cri/remote"
@@ -32,21 +36,30 @@ var (
 		"k3s/containerd/containerd.sock",
 	}
 
+	criBackoffMin = 500 * time.Millisecond
+	criBackoffMax = 30 * time.Second
+
 	EnvCri      = "TRACER_CRI_ENDPOINT"
 	EnvRunPaths = "TRACER_RUN_PATHS"
 	EnvPodName  = "TRACER_POD_NAME"
 )
 
 type CriConfig struct {
-	Endpoint *string  /* CRI endpoint. */
-	RunPaths []string /* Paths to run directories. */
-	PodName  *string  /* Name of the tracer pod */
+	Endpoints []string /* CRI endpoints. */
+	RunPaths  []string /* Paths to run directories. */
+	PodName   *string  /* Name of the tracer pod */
 }
 
 type podCri struct {
-	api  criapi.RuntimeService
-	ctx  context.Context
-	podb map[string]*pod
+	api     criapi.RuntimeService
+	ctx     context.Context
+	sockUrl string
+	name    string
+	podb    map[string]*pod
+	broken  bool            /* The connection to the runtime is broken and must be re-established */
+	backoff time.Duration   /* Current delay between reconnect attempts */
+	retry   time.Time       /* Time of the next reconnect attempt */
+	failed  map[string]bool /* Containers, which status cannot be read, reported once */
 }
 
 type podCriInfo struct {
@@ -84,18 +97,67 @@ func (p *podCri) criVerify(podName *string, api *criapi.RuntimeService) bool {
 	return false
 }
 
-func (p *podCri) criConnect(cfg *CriConfig) error {
+func (p *podCri) criConnect(sockUrl string) error {
 	timeout := 100 * time.Millisecond
 
-	if cfg.Endpoint != nil && *cfg.Endpoint != "" {
-		if svc, err := remote.NewRemoteRuntimeService(*cfg.Endpoint, timeout, nil); err != nil {
+	p.sockUrl = sockUrl
+	if p.name == "" {
+		p.name = sockUrl
+	}
+	svc, err := remote.NewRemoteRuntimeService(sockUrl, timeout, nil)
+	if err != nil {
+		return err
+	}
+	p.api = svc
+	if v, err := svc.Version(p.ctx, ""); err == nil && v.RuntimeName != "" {
+		p.name = v.RuntimeName
+	}
+
+	return nil
+}
+
+/* Mark the connection as broken and schedule the next reconnect attempt, with exponential backoff */
+func (p *podCri) criBroken() {
+	if !p.broken || p.backoff == 0 {
+		p.backoff = criBackoffMin
+	} else if p.backoff *= 2; p.backoff > criBackoffMax {
+		p.backoff = criBackoffMax
+	}
+	p.broken = true
+	p.retry = time.Now().Add(p.backoff)
+}
+
+/*
+ * Check if the runtime is reachable again. The gRPC connection is kept and re-established by itself,
+ * a new one is created only if there is no connection at all.
+ */
+func (p *podCri) criReconnect() error {
+	if time.Now().Before(p.retry) {
+		return fmt.Errorf("Connection to CRI endpoint %s is broken, next reconnect attempt in %v",
+			p.sockUrl, time.Until(p.retry).Round(time.Millisecond))
+	}
+
+	if p.api == nil {
+		if err := p.criConnect(p.sockUrl); err != nil {
+			p.criBroken()
 			return err
-		} else {
-			p.api = svc
 		}
-		return nil
+	} else if _, err := p.api.Version(p.ctx, ""); err != nil {
+		p.criBroken()
+		return err
 	}
 
+	p.broken = false
+	p.backoff = 0
+	log.Printf("Reconnected to CRI %s at %s", p.name, p.sockUrl)
+	return nil
+}
+
+/* Get a list of unique CRI endpoints, that exist on the local node */
+func criEndpoints(cfg *CriConfig) []string {
+	res := []string{}
+	seen := make(map[string]bool)
+
 	paths := defaultRunPaths
 	if len(cfg.RunPaths) > 0 {
 		paths = cfg.RunPaths
@@ -103,34 +165,89 @@ func (p *podCri) criConnect(cfg *CriConfig) error {
 
 	for _, pt := range paths {
 		for _, ep := range knownCriEndpoints {
-			sockUrl := socPrefix + pt + "/" + ep
-			svc, err := remote.NewRemoteRuntimeService(sockUrl, timeout, nil)
-			if err == nil && p.criVerify(cfg.PodName, &svc) {
-				p.api = svc
-				print("\nUsing CRI for pods discovery at ", sockUrl, "\n")
-				return nil
+			sock := pt + "/" + ep
+			real, err := filepath.EvalSymlinks(sock)
+			if err != nil {
+				continue
+			}
+			/* The same socket may be reachable from more than one run path, i.e. /var/run -> /run */
+			if seen[real] {
+				continue
 			}
+			seen[real] = true
+			res = append(res, socPrefix+sock)
 		}
 	}
 
-	return fmt.Errorf("Cannot connect to CRI endpoint")
+	return res
 }
 
-func getCriDiscover(ctx context.Context, cfg *CriConfig) (podsDiscover, error) {
+/* Connect to all CRI endpoints, available on the local node */
+func getCriDiscover(ctx context.Context, cfg *CriConfig) ([]podsDiscover, error) {
+	res := []podsDiscover{}
 
-	ctr := podCri{
-		podb: make(map[string]*pod),
-		ctx:  ctx,
+	endpoints := cfg.Endpoints
+	auto := len(endpoints) == 0
+	if auto {
+		endpoints = criEndpoints(cfg)
 	}
 
-	if err := ctr.criConnect(cfg); err != nil {
-		return nil, err
+	for _, ep := range endpoints {
+		ctr := &podCri{
+			podb: make(map[string]*pod),
+			ctx:  ctx,
+		}
+		if err := ctr.criConnect(ep); err != nil {
+			if !auto {
+				return nil, err
+			}
+			continue
+		}
+		/* The runtime, which runs the tracer pod, is the primary one and wins on duplicates */
+		if cfg.PodName != nil && *cfg.PodName != "" && ctr.criVerify(cfg.PodName, &ctr.api) {
+			res = append([]podsDiscover{ctr}, res...)
+		} else {
+			res = append(res, ctr)
+		}
+		print("\nUsing CRI ", ctr.name, " for pods discovery at ", ep, "\n")
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("Cannot connect to CRI endpoint")
+	}
+
+	return res, nil
+}
+
+func (p *podCri) runtime() string {
+	return p.name
+}
+
+func (p *podCri) endpoint() string {
+	return p.sockUrl
+}
+
+/* Get the runtime handlers of all pods, i.e. runc or kata, used to tag the containers */
+func (p *podCri) getRuntimeHandlers() map[string]string {
+	res := make(map[string]string)
+
+	if sb, err := p.api.ListPodSandbox(p.ctx, nil); err == nil {
+		for _, s := range sb {
+			if s.RuntimeHandler != "" {
+				res[s.Id] = p.name + "/" + s.RuntimeHandler
+			}
+		}
 	}
 
-	return ctr, nil
+	return res
 }
 
-func (p *podCri) getPodInfo(cinfo *pbuf.Container, pname *string) error {
+/* Add a container to its pod. The container is not added, if its status cannot be read */
+func (p *podCri) getPodInfo(cinfo *pbuf.Container, pname *string, runtime string) error {
+	s, err := p.api.ContainerStatus(p.ctx, cinfo.Id, true)
+	if err != nil {
+		return err
+	}
 
 	if _, ok := p.podb[*pname]; !ok {
 		p.podb[*pname] = &pod{
@@ -139,46 +256,107 @@ func (p *podCri) getPodInfo(cinfo *pbuf.Container, pname *string) error {
 	}
 	if _, ok := p.podb[*pname].Containers[cinfo.Metadata.Name]; !ok {
 		p.podb[*pname].Containers[cinfo.Metadata.Name] = &Container{
-			Id:  &cinfo.Metadata.Name,
-			Pod: pname,
+			Id:        &cinfo.Metadata.Name,
+			Pod:       pname,
+			Namespace: cinfo.Labels[ktype.KubernetesPodNamespaceLabel],
+			Runtime:   &runtime,
+			cid:       cinfo.Id,
 		}
 	}
 	cr := p.podb[*pname].Containers[cinfo.Metadata.Name]
 
-	if s, e := p.api.ContainerStatus(p.ctx, cinfo.Id, true); e == nil {
-		i := s.GetInfo()
-		if v, ok := i["info"]; ok {
-			info := podCriInfo{}
-			if err := json.Unmarshal([]byte(v), &info); err == nil {
-				cr.Tasks = append(cr.Tasks, info.Pid)
-			}
+	if v, ok := s.GetInfo()["info"]; ok {
+		info := podCriInfo{}
+		if err := json.Unmarshal([]byte(v), &info); err == nil {
+			cr.Tasks = append(cr.Tasks, info.Pid)
 		}
-	} else {
-		return e
 	}
 
 	return nil
 }
 
-func (p podCri) podScan() (*map[string]*pod, error) {
+func (p *podCri) podScan() (*map[string]*pod, error) {
 	// Filter only the running containers
 	f := &pbuf.ContainerFilter{
 		State: &pbuf.ContainerStateValue{
 			State: pbuf.ContainerState_CONTAINER_RUNNING,
 		},
 	}
+	if p.broken {
+		if err := p.criReconnect(); err != nil {
+			return nil, err
+		}
+	}
 	// Get list of all running containers
 	r, err := p.api.ListContainers(p.ctx, f)
 	if err != nil {
+		p.criBroken()
 		return nil, err
 	}
+	handlers := p.getRuntimeHandlers()
 	// Reset the pods databse
 	p.podb = make(map[string]*pod)
+	failed := make(map[string]bool)
+	found := 0
+	var ferr error
 	for _, cr := range r {
 		if podName, ok := cr.Labels[ktype.KubernetesPodNameLabel]; ok {
-			p.getPodInfo(cr, &podName)
+			runtime := p.name
+			if h, ok := handlers[cr.PodSandboxId]; ok {
+				runtime = h
+			}
+			found++
+			err := p.getPodInfo(cr, &podName, runtime)
+			/* The container may exit after it is listed */
+			if err == nil || status.Code(err) == codes.NotFound {
+				continue
+			}
+			/* The runtime is gone, the containers it reports cannot be trusted */
+			if status.Code(err) == codes.Unavailable {
+				p.criBroken()
+				return nil, err
+			}
+			failed[cr.Id] = true
+			if !p.failed[cr.Id] {
+				log.Printf("Skipped container %s of pod %s, reported by CRI %s: %v",
+					cr.Metadata.Name, podName, p.name, err)
+			}
+			ferr = err
 		}
 	}
+	p.failed = failed
+	if found > 0 && len(failed) == found {
+		return nil, fmt.Errorf("Failed to get the status of the containers from CRI %s: %v", p.name, ferr)
+	}
 
 	return &p.podb, nil
 }
+
+func (p *podCri) containerStats(c *Container) (*ContainerStats, error) {
+	if c.cid == "" || p.broken {
+		return nil, fmt.Errorf("Cannot get stats of container %s", *c.Id)
+	}
+
+	s, err := p.api.ContainerStats(p.ctx, c.cid)
+	if err != nil {
+		if status.Code(err) == codes.Unavailable {
+			p.criBroken()
+		}
+		return nil, err
+	}
+	if s.Cpu == nil || s.Memory == nil || s.Cpu.UsageCoreNanoSeconds == nil || s.Memory.WorkingSetBytes == nil {
+		return nil, fmt.Errorf("No stats reported for container %s", *c.Id)
+	}
+
+	res := ContainerStats{
+		Source:      StatsSourceCri,
+		Time:        time.Unix(0, s.Cpu.Timestamp),
+		CpuUsageNs:  s.Cpu.UsageCoreNanoSeconds.Value,
+		MemoryBytes: s.Memory.WorkingSetBytes.Value,
+	}
+	if s.Cpu.UsageNanoCores != nil {
+		res.CpuPercent = float64(s.Cpu.UsageNanoCores.Value) / 1e7
+	}
+
+	return &res, nil
+}
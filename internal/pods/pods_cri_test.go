@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package pods
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware-labs/container-tracer/internal/pods/fakecri"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newFakeRuntime(t *testing.T, name string, containers ...*fakecri.Container) *fakecri.Runtime {
+	r, err := fakecri.NewRuntime(name)
+	if err != nil {
+		t.Fatal("Failed to start fake runtime: ", err)
+	}
+	t.Cleanup(r.Destroy)
+	for _, c := range containers {
+		r.Add(c)
+	}
+	return r
+}
+
+func newFakeCri(t *testing.T, r *fakecri.Runtime) *podCri {
+	p := &podCri{
+		ctx:  context.Background(),
+		podb: make(map[string]*pod),
+	}
+	if err := p.criConnect(r.Endpoint); err != nil {
+		t.Fatal("Failed to connect to fake runtime: ", err)
+	}
+	return p
+}
+
+// This validates connecting to a CRI endpoint
+func TestCriConnect(t *testing.T) {
+	r := newFakeRuntime(t, "containerd")
+
+	p := newFakeCri(t, r)
+	assert.Equal(t, "containerd", p.runtime())
+	assert.Equal(t, r.Endpoint, p.endpoint())
+
+	bad := &podCri{ctx: context.Background()}
+	assert.NotNil(t, bad.criConnect("unix:///nonexistent/cri.sock"))
+}
+
+// This validates looking for the tracer pod in the CRI database
+func TestCriVerify(t *testing.T) {
+	r := newFakeRuntime(t, "containerd", &fakecri.Container{
+		Id: "c1", Name: "tracer", Pod: "tracer-node-x1", Namespace: "default", Pid: 100,
+	})
+	p := newFakeCri(t, r)
+
+	tracer := "tracer-node-x1"
+	other := "tracer-node-y2"
+	assert.True(t, p.criVerify(&tracer, &p.api))
+	assert.False(t, p.criVerify(&other, &p.api))
+	assert.True(t, p.criVerify(nil, &p.api))
+}
+
+// This validates discovering containers and their runtime handlers
+func TestCriPodScan(t *testing.T) {
+	r := newFakeRuntime(t, "containerd",
+		&fakecri.Container{Id: "c1", Name: "app", Pod: "web", Namespace: "default", Pid: 101},
+		&fakecri.Container{Id: "c2", Name: "sidecar", Pod: "web", Namespace: "default", Pid: 102},
+		&fakecri.Container{Id: "c3", Name: "app", Pod: "sandboxed", Namespace: "default", Pid: 103,
+			RuntimeHandler: "kata"},
+		&fakecri.Container{Id: "c4", Name: "stopped", Pod: "web", Namespace: "default"},
+	)
+	p := newFakeCri(t, r)
+
+	db, err := p.podScan()
+	assert.Nil(t, err)
+	assert.Len(t, *db, 2)
+	assert.Len(t, (*db)["web"].Containers, 2)
+	assert.Equal(t, []int{101}, (*db)["web"].Containers["app"].Tasks)
+	assert.Equal(t, "c1", (*db)["web"].Containers["app"].RuntimeId())
+	assert.Equal(t, "default", (*db)["web"].Containers["app"].Namespace)
+	assert.Equal(t, "containerd", *(*db)["web"].Containers["app"].Runtime)
+	assert.Equal(t, "containerd/kata", *(*db)["sandboxed"].Containers["app"].Runtime)
+}
+
+// This validates skipping the containers, which status cannot be read
+func TestCriPodScanErrors(t *testing.T) {
+	r := newFakeRuntime(t, "containerd",
+		&fakecri.Container{Id: "c1", Name: "app", Pod: "web", Namespace: "default", Pid: 101},
+		&fakecri.Container{Id: "c2", Name: "sidecar", Pod: "web", Namespace: "default", Pid: 102,
+			StatusError: status.Error(codes.Internal, "broken container")},
+		&fakecri.Container{Id: "c3", Name: "app", Pod: "db", Namespace: "default", Pid: 103,
+			StatusError: status.Error(codes.Internal, "broken container")},
+	)
+	p := newFakeCri(t, r)
+
+	db, err := p.podScan()
+	assert.Nil(t, err)
+	assert.Len(t, *db, 1)
+	assert.Len(t, (*db)["web"].Containers, 1)
+	assert.Equal(t, []int{101}, (*db)["web"].Containers["app"].Tasks)
+	assert.Equal(t, map[string]bool{"c2": true, "c3": true}, p.failed)
+
+	/* The scan fails, if the status of no container can be read */
+	r.SetError("ContainerStatus", status.Error(codes.Internal, "busy"))
+	_, err = p.podScan()
+	assert.NotNil(t, err)
+	assert.False(t, p.broken)
+
+	/* The runtime is not reachable, the connection is broken */
+	r.SetError("ContainerStatus", status.Error(codes.Unavailable, "gone"))
+	_, err = p.podScan()
+	assert.NotNil(t, err)
+	assert.True(t, p.broken)
+	r.SetError("ContainerStatus", nil)
+	p.retry = time.Now()
+	r.Remove("c2")
+	r.Remove("c3")
+	db, err = p.podScan()
+	assert.Nil(t, err)
+	assert.Len(t, (*db)["web"].Containers, 1)
+	assert.Empty(t, p.failed)
+}
+
+// This validates reconnecting to a restarted runtime
+func TestCriReconnect(t *testing.T) {
+	r := newFakeRuntime(t, "containerd", &fakecri.Container{
+		Id: "c1", Name: "app", Pod: "web", Namespace: "default", Pid: 101,
+	})
+	p := newFakeCri(t, r)
+
+	r.Stop()
+	_, err := p.podScan()
+	assert.NotNil(t, err)
+	assert.True(t, p.broken)
+
+	/* The same connection is used after the runtime is restarted */
+	api := p.api
+	assert.Nil(t, r.Start())
+	assert.Eventually(t, func() bool {
+		p.retry = time.Now()
+		_, err := p.podScan()
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.False(t, p.broken)
+	assert.Equal(t, api, p.api)
+	db, err := p.podScan()
+	assert.Nil(t, err)
+	assert.Len(t, *db, 1)
+
+	/* The stats of the containers cannot be read from an unreachable runtime */
+	r.SetError("ContainerStats", status.Error(codes.Unavailable, "gone"))
+	_, err = p.containerStats((*db)["web"].Containers["app"])
+	assert.NotNil(t, err)
+	assert.True(t, p.broken)
+}
+
+// This validates merging containers from multiple runtimes and tracking the changes
+func TestPodDbMerge(t *testing.T) {
+	r1 := newFakeRuntime(t, "containerd",
+		&fakecri.Container{Id: "c1", Name: "app", Pod: "web", Namespace: "default", Pid: 101},
+		&fakecri.Container{Id: "c2", Name: "app", Pod: "api", Namespace: "default", Pid: 401},
+	)
+	r2 := newFakeRuntime(t, "cri-o",
+		&fakecri.Container{Id: "d1", Name: "app", Pod: "web", Namespace: "default", Pid: 101},
+		&fakecri.Container{Id: "d2", Name: "db", Pod: "store", Namespace: "default", Pid: 201},
+	)
+
+	cfg := &PodConfig{
+		Cri: CriConfig{
+			Endpoints: []string{r1.Endpoint, r2.Endpoint},
+		},
+	}
+	db, err := NewPodDb(context.Background(), cfg, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, db.Count())
+	assert.Len(t, (*db.Get())["web"].Containers, 1)
+	assert.Equal(t, "containerd", *(*db.Get())["web"].Containers["app"].Runtime)
+
+	rev := db.Revision()
+	r2.Add(&fakecri.Container{Id: "d3", Name: "app", Pod: "api", Namespace: "default", Pid: 301})
+	r2.Remove("d2")
+	assert.Nil(t, db.Scan())
+	assert.Equal(t, rev+1, db.Revision())
+
+	ch, err := db.Changes(rev)
+	assert.Nil(t, err)
+	assert.False(t, ch.Full)
+	assert.Len(t, ch.Changes, 2)
+	for _, c := range ch.Changes {
+		switch c.Type {
+		case ChangeAdded:
+			assert.Equal(t, "app@cri-o", c.Name)
+		case ChangeRemoved:
+			assert.Equal(t, "db", c.Name)
+		default:
+			t.Error("Unexpected change ", c.Type)
+		}
+	}
+	ch, err = db.Changes(0)
+	assert.Nil(t, err)
+	assert.True(t, ch.Full)
+}
@@ -0,0 +1,225 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Translation of host PIDs to PIDs, as seen inside the PID name space of a container.
+ */
+package pods
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	nsPidStr           = "NSpid:"
+	pidMapRefreshDelay = 5 * time.Second
+)
+
+type PidInfo struct {
+	Pod          string
+	Container    string
+	HostPid      int
+	ContainerPid int
+}
+
+type pidNs struct {
+	pod       string
+	container string
+	level     int /* Index of the container PID in the NSpid list */
+}
+
+/* Map of host PIDs to container PIDs, for a set of containers */
+type PidMap struct {
+	lock       sync.Mutex
+	procfsPath string
+	ns         map[string]*pidNs /* PID name spaces of the containers */
+	pids       map[int]*PidInfo
+	others     map[int]bool /* PIDs, that are not part of any of the containers */
+	refreshed  time.Time
+}
+
+func (m *PidMap) getPidNs(pid int) (string, error) {
+	return os.Readlink(fmt.Sprintf("%s/%d/ns/pid", m.procfsPath, pid))
+}
+
+/* Get the list of PIDs of a task in all nested PID name spaces, the host PID is the first one */
+func (m *PidMap) getNsPids(pid int) ([]int, error) {
+	file, err := os.Open(fmt.Sprintf("%s/%d/status", m.procfsPath, pid))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scan := bufio.NewScanner(file)
+	for scan.Scan() {
+		words := strings.Fields(scan.Text())
+		if len(words) < 2 || words[0] != nsPidStr {
+			continue
+		}
+		res := []int{}
+		for _, w := range words[1:] {
+			if i, err := strconv.Atoi(w); err == nil {
+				res = append(res, i)
+			} else {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("Cannot find %s of task %d", nsPidStr, pid)
+}
+
+/* Check if the given host PID is part of one of the containers and add it to the map */
+func (m *PidMap) addPid(pid int) *PidInfo {
+	ns, err := m.getPidNs(pid)
+	if err != nil {
+		return nil
+	}
+	c, ok := m.ns[ns]
+	if !ok {
+		return nil
+	}
+	nspids, err := m.getNsPids(pid)
+	if err != nil || len(nspids) <= c.level {
+		return nil
+	}
+
+	info := &PidInfo{
+		Pod:          c.pod,
+		Container:    c.container,
+		HostPid:      pid,
+		ContainerPid: nspids[c.level],
+	}
+	m.pids[pid] = info
+	return info
+}
+
+/* Walk through all processes and rebuild the map. Must be called with the lock held */
+func (m *PidMap) refresh() {
+	m.pids = make(map[int]*PidInfo)
+	m.others = make(map[int]bool)
+	m.refreshed = time.Now()
+
+	dir, err := os.ReadDir(m.procfsPath)
+	if err != nil {
+		return
+	}
+	for _, d := range dir {
+		if pid, err := strconv.Atoi(d.Name()); err == nil && d.IsDir() {
+			m.addPid(pid)
+		}
+	}
+}
+
+/* Create a new PID map with all processes of the given containers */
+func (p *PodDb) NewPidMap(containers []*Container) *PidMap {
+	m := &PidMap{
+		procfsPath: *p.procfsPath,
+		ns:         make(map[string]*pidNs),
+	}
+
+	for _, c := range containers {
+		for _, t := range c.Tasks {
+			ns, err := m.getPidNs(t)
+			if err != nil {
+				continue
+			}
+			if _, ok := m.ns[ns]; ok {
+				continue
+			}
+			if nspids, err := m.getNsPids(t); err == nil {
+				m.ns[ns] = &pidNs{
+					pod:       *c.Pod,
+					container: *c.Id,
+					level:     len(nspids) - 1,
+				}
+			}
+		}
+	}
+	m.refresh()
+
+	return m
+}
+
+/* Translate a host PID to the PID inside its container. New processes are added on the fly */
+func (m *PidMap) Lookup(pid int) (int, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if time.Since(m.refreshed) > pidMapRefreshDelay {
+		m.refresh()
+	}
+	if info, ok := m.pids[pid]; ok {
+		return info.ContainerPid, true
+	}
+	if m.others[pid] {
+		return 0, false
+	}
+	if info := m.addPid(pid); info != nil {
+		return info.ContainerPid, true
+	}
+	m.others[pid] = true
+
+	return 0, false
+}
+
+/*
+ * Get all processes of the containers, sorted by host PID. The processes are rescanned at most once per
+ * pidMapRefreshDelay, the processes started since then are included only if they are already looked up.
+ */
+func (m *PidMap) Get() []PidInfo {
+	res := []PidInfo{}
+
+	m.lock.Lock()
+	if time.Since(m.refreshed) > pidMapRefreshDelay {
+		m.refresh()
+	}
+	for _, p := range m.pids {
+		res = append(res, *p)
+	}
+	m.lock.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].HostPid < res[j].HostPid
+	})
+
+	return res
+}
+
+/*
+ * Find the path of an open file of the task by its device and inode, as seen inside the container.
+ * Only files, opened by the task at the time of the call, can be found.
+ */
+func (m *PidMap) FindFile(pid int, major, minor uint32, ino uint64) (string, bool) {
+	fdDir := fmt.Sprintf("%s/%d/fd", m.procfsPath, pid)
+	dir, err := os.ReadDir(fdDir)
+	if err != nil {
+		return "", false
+	}
+	for _, d := range dir {
+		var st unix.Stat_t
+		fd := filepath.Join(fdDir, d.Name())
+		if err := unix.Stat(fd, &st); err != nil {
+			continue
+		}
+		if st.Ino != ino || unix.Major(uint64(st.Dev)) != major || unix.Minor(uint64(st.Dev)) != minor {
+			continue
+		}
+		if path, err := os.Readlink(fd); err == nil {
+			return path, true
+		}
+	}
+
+	return "", false
+}
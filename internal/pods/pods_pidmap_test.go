@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package pods
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* Add a task to a fake procfs, in the given PID name space with the given PIDs in the nested name spaces */
+func addFakeTask(t *testing.T, procfs string, ns int, nspids ...int) {
+	dir := filepath.Join(procfs, strconv.Itoa(nspids[0]))
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "ns"), 0750))
+	assert.Nil(t, os.Symlink(fmt.Sprintf("pid:[%d]", ns), filepath.Join(dir, "ns/pid")))
+	status := "Name:\ttask\nNSpid:"
+	for _, p := range nspids {
+		status += fmt.Sprintf("\t%d", p)
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "status"), []byte(status+"\n"), 0640))
+}
+
+func TestPidMap(t *testing.T) {
+	procfs := t.TempDir()
+	addFakeTask(t, procfs, 1000, 1)
+	addFakeTask(t, procfs, 1000, 50)
+	addFakeTask(t, procfs, 2000, 100, 1)
+	addFakeTask(t, procfs, 2000, 101, 7)
+	addFakeTask(t, procfs, 3000, 200, 1)
+	addFakeTask(t, procfs, 4000, 300, 20, 1)
+
+	pod, cont, nested := "pod", "cont", "nested"
+	db := &PodDb{procfsPath: &procfs}
+	m := db.NewPidMap([]*Container{
+		{Id: &cont, Pod: &pod, Tasks: []int{100}},
+		{Id: &nested, Pod: &pod, Tasks: []int{300, 999}},
+	})
+
+	for pid, cpid := range map[int]int{100: 1, 101: 7, 300: 1} {
+		p, ok := m.Lookup(pid)
+		assert.True(t, ok, pid)
+		assert.Equal(t, cpid, p, pid)
+	}
+	for _, pid := range []int{1, 50, 200, 999} {
+		_, ok := m.Lookup(pid)
+		assert.False(t, ok, pid)
+	}
+	assert.Equal(t, []PidInfo{
+		{Pod: pod, Container: cont, HostPid: 100, ContainerPid: 1},
+		{Pod: pod, Container: cont, HostPid: 101, ContainerPid: 7},
+		{Pod: pod, Container: nested, HostPid: 300, ContainerPid: 1},
+	}, m.Get())
+
+	/* New tasks are found on lookup, without a rescan of all processes */
+	addFakeTask(t, procfs, 2000, 102, 8)
+	addFakeTask(t, procfs, 2000, 103, 9)
+	assert.Nil(t, os.RemoveAll(filepath.Join(procfs, "101")))
+	p, ok := m.Lookup(102)
+	assert.True(t, ok)
+	assert.Equal(t, 8, p)
+	pids := []int{}
+	for _, i := range m.Get() {
+		pids = append(pids, i.HostPid)
+	}
+	assert.Equal(t, []int{100, 101, 102, 300}, pids)
+
+	/* The processes are rescanned when the map is old */
+	m.refreshed = time.Now().Add(-2 * pidMapRefreshDelay)
+	pids = []int{}
+	for _, i := range m.Get() {
+		pids = append(pids, i.HostPid)
+	}
+	assert.Equal(t, []int{100, 102, 103, 300}, pids)
+	_, ok = m.Lookup(101)
+	assert.False(t, ok)
+}
@@ -27,6 +27,7 @@ import (
 
 var (
 	defaultContainer = "unknown"
+	procRuntime      = "procfs"
 )
 
 type podProc struct {
@@ -40,7 +41,7 @@ type podProc struct {
 }
 
 func getProcDiscover(ctx context.Context, procfsPath *string) (podsDiscover, error) {
-	ctr := podProc{
+	ctr := &podProc{
 		ctx:  ctx,
 		path: *procfsPath,
 		pids: make([]int, 0),
@@ -64,7 +65,12 @@ func getProcDiscover(ctx context.Context, procfsPath *string) (podsDiscover, err
 }
 
 func (p *podProc) getNSinum(pid int, ns string) (int, error) {
-	if name, err := os.Readlink(fmt.Sprintf("%s/%d/ns/%s", p.path, pid, ns)); err == nil {
+	return NamespaceInode(p.path, pid, ns)
+}
+
+/* Get the inode of a name space of the task, i.e. "net" or "uts", using the given procfs */
+func NamespaceInode(procfs string, pid int, ns string) (int, error) {
+	if name, err := os.Readlink(fmt.Sprintf("%s/%d/ns/%s", procfs, pid, ns)); err == nil {
 		f := func(c rune) bool {
 			return c == '[' || c == ']'
 		}
@@ -139,9 +145,10 @@ func (p *podProc) getPodInfo(ppid, pid int) error {
 			p.podb[*name] = &pod{
 				Containers: map[string]*Container{
 					defaultContainer: &Container{
-						Id:    &defaultContainer,
-						Pod:   name,
-						Tasks: []int{pid},
+						Id:      &defaultContainer,
+						Pod:     name,
+						Runtime: &procRuntime,
+						Tasks:   []int{pid},
 					},
 				},
 			}
@@ -227,7 +234,15 @@ func (p *podProc) walkChildren(ppid, pid int) error {
 	return nil
 }
 
-func (p podProc) podScan() (*map[string]*pod, error) {
+func (p *podProc) runtime() string {
+	return procRuntime
+}
+
+func (p *podProc) endpoint() string {
+	return p.path
+}
+
+func (p *podProc) podScan() (*map[string]*pod, error) {
 	// Reset the pods databse
 	p.podb = make(map[string]*pod)
 
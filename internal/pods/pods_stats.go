@@ -0,0 +1,383 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Resource usage of the containers, reported by the CRI or read from the cgroup of the container.
+ */
+package pods
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	sysfsPathDefault = "/sys"
+	cgroupRoot       = "fs/cgroup"
+
+	StatsSourceCri    = "cri"
+	StatsSourceCgroup = "cgroup"
+
+	SortCpu    = "cpu"
+	SortMemory = "memory"
+	SortIo     = "io"
+)
+
+type statsDiscover interface {
+	containerStats(c *Container) (*ContainerStats, error)
+}
+
+type ContainerStats struct {
+	Source       string    /* Where the stats come from - cri or cgroup */
+	Time         time.Time /* Time of the measurement */
+	CpuUsageNs   uint64    /* Total CPU time, used by the container */
+	CpuPercent   float64   /* CPU usage since the previous measurement, 100% is one fully used CPU */
+	MemoryBytes  uint64    /* Working set of the container */
+	IoReadBytes  uint64
+	IoWriteBytes uint64
+}
+
+type cpuSample struct {
+	usage uint64
+	time  time.Time
+}
+
+/* Read a file with "<key> <value>" lines and return the value of the given key */
+func readKeyValue(file, key string) (uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		words := strings.Fields(scan.Text())
+		if len(words) == 2 && words[0] == key {
+			return strconv.ParseUint(words[1], 10, 64)
+		}
+	}
+
+	return 0, fmt.Errorf("Cannot find %s in %s", key, file)
+}
+
+func readValue(file string) (uint64, error) {
+	if data, err := os.ReadFile(file); err == nil {
+		return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	} else {
+		return 0, err
+	}
+}
+
+/* Sum read and written bytes of all devices from cgroup v2 io.stat */
+func readIoStat(file string, st *ContainerStats) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		for _, w := range strings.Fields(scan.Text()) {
+			kv := strings.SplitN(w, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch kv[0] {
+			case "rbytes":
+				st.IoReadBytes += v
+			case "wbytes":
+				st.IoWriteBytes += v
+			}
+		}
+	}
+
+	return nil
+}
+
+/* Sum read and written bytes of all devices from cgroup v1 blkio.throttle.io_service_bytes */
+func readBlkioStat(file string, st *ContainerStats) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		words := strings.Fields(scan.Text())
+		if len(words) != 3 {
+			continue
+		}
+		v, err := strconv.ParseUint(words[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch words[1] {
+		case "Read":
+			st.IoReadBytes += v
+		case "Write":
+			st.IoWriteBytes += v
+		}
+	}
+
+	return nil
+}
+
+/* Get cgroup paths of a task, as "<controllers>": "<path>". The cgroup v2 path has an empty key */
+func (p *PodDb) getCgroups(pid int) (map[string]string, error) {
+	res := make(map[string]string)
+
+	f, err := os.Open(fmt.Sprintf("%s/%d/cgroup", *p.procfsPath, pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		words := strings.SplitN(scan.Text(), ":", 3)
+		if len(words) == 3 {
+			res[words[1]] = words[2]
+		}
+	}
+
+	return res, nil
+}
+
+/*
+ * Get the directory of a cgroup controller of a task. Containers usually mount their own cgroup
+ * on /sys/fs/cgroup, so look there first. If it is not available, use the host sysfs. That works
+ * only if the tracer does not run in its own cgroup name space.
+ */
+func (p *PodDb) cgroupDir(pid int, cgroups map[string]string, controller, file string) string {
+	dirs := []string{
+		filepath.Join(*p.procfsPath, strconv.Itoa(pid), "root/sys", cgroupRoot, controller),
+	}
+	for c, path := range cgroups {
+		if c == controller || (controller != "" && checkStringContains(strings.Split(c, ","), controller)) {
+			dirs = append(dirs, filepath.Join(*p.sysfsPath, cgroupRoot, controller, path))
+		}
+	}
+
+	for _, d := range dirs {
+		if _, err := os.Stat(filepath.Join(d, file)); err == nil {
+			return d
+		}
+	}
+
+	return ""
+}
+
+func checkStringContains(arr []string, val string) bool {
+	for _, v := range arr {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+/* Read the resource usage of a container from its cgroup, both v2 and v1 are supported */
+func (p *PodDb) cgroupStats(c *Container, st *ContainerStats) error {
+	if len(c.Tasks) < 1 {
+		return fmt.Errorf("No tasks in container %s", *c.Id)
+	}
+	pid := c.Tasks[0]
+	cgroups, err := p.getCgroups(pid)
+	if err != nil {
+		return err
+	}
+
+	/* cgroup v2 */
+	if d := p.cgroupDir(pid, cgroups, "", "cpu.stat"); d != "" {
+		if st.Source == "" {
+			if v, err := readKeyValue(filepath.Join(d, "cpu.stat"), "usage_usec"); err == nil {
+				st.CpuUsageNs = v * 1000
+			}
+			if v, err := readValue(filepath.Join(d, "memory.current")); err == nil {
+				st.MemoryBytes = v
+			}
+			st.Source = StatsSourceCgroup
+		}
+		return readIoStat(filepath.Join(d, "io.stat"), st)
+	}
+
+	/* cgroup v1 */
+	found := false
+	if st.Source == "" {
+		if d := p.cgroupDir(pid, cgroups, "cpuacct", "cpuacct.usage"); d != "" {
+			if v, err := readValue(filepath.Join(d, "cpuacct.usage")); err == nil {
+				st.CpuUsageNs = v
+				found = true
+			}
+		}
+		if d := p.cgroupDir(pid, cgroups, "memory", "memory.usage_in_bytes"); d != "" {
+			if v, err := readValue(filepath.Join(d, "memory.usage_in_bytes")); err == nil {
+				st.MemoryBytes = v
+				found = true
+			}
+		}
+		if found {
+			st.Source = StatsSourceCgroup
+		}
+	}
+	if d := p.cgroupDir(pid, cgroups, "blkio", "blkio.throttle.io_service_bytes"); d != "" {
+		found = true
+		readBlkioStat(filepath.Join(d, "blkio.throttle.io_service_bytes"), st)
+	}
+
+	if !found && st.Source == "" {
+		return fmt.Errorf("Cannot find the cgroup of container %s", *c.Id)
+	}
+	return nil
+}
+
+/* Get the resource usage of a container, from the CRI or from its cgroup */
+func (p *PodDb) containerStats(b podsDiscover, c *Container) (*ContainerStats, error) {
+	st := &ContainerStats{}
+
+	if sd, ok := b.(statsDiscover); ok {
+		if s, err := sd.containerStats(c); err == nil {
+			st = s
+		}
+	}
+	/* Block I/O is not reported by the CRI, look for it in the cgroup */
+	if err := p.cgroupStats(c, st); err != nil && st.Source == "" {
+		return nil, err
+	}
+	if st.Time.IsZero() {
+		st.Time = time.Now()
+	}
+
+	key := statsId(c)
+	if old, ok := p.cpuSamples[key]; ok && st.CpuUsageNs >= old.usage && st.Time.After(old.time) && st.CpuPercent == 0 {
+		st.CpuPercent = float64(st.CpuUsageNs-old.usage) * 100 / float64(st.Time.Sub(old.time).Nanoseconds())
+	}
+	p.cpuSamples[key] = cpuSample{
+		usage: st.CpuUsageNs,
+		time:  st.Time,
+	}
+
+	return st, nil
+}
+
+/* Identify a container in the stats, the same name may be reused by a new container in the runtime */
+func statsId(c *Container) string {
+	return *c.Pod + "/" + *c.Id + "/" + c.cid
+}
+
+/*
+ * Update the resource usage of all containers in the database. The containers are shared with the
+ * readers of the database, the stats are kept separately and are set only in copies of the containers.
+ */
+func (p *PodDb) ScanStats() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.pods == nil {
+		return
+	}
+	samples := make(map[string]cpuSample)
+	old := p.cpuSamples
+	p.cpuSamples = samples
+	p.stats = make(map[string]*ContainerStats)
+	for _, pd := range *p.pods {
+		for _, c := range pd.Containers {
+			key := statsId(c)
+			if s, ok := old[key]; ok {
+				samples[key] = s
+			}
+			if st, err := p.containerStats(c.discover, c); err == nil {
+				p.stats[key] = st
+			}
+		}
+	}
+}
+
+/* Copy of a container with its last stats. Must be called with the lock held */
+func (p *PodDb) withStats(c *Container) *Container {
+	res := *c
+	if st, ok := p.stats[statsId(c)]; ok {
+		s := *st
+		res.Stats = &s
+	}
+	return &res
+}
+
+/* Get all pods with the resource usage of their containers, from the last ScanStats */
+func (p *PodDb) GetStats() *map[string]*pod {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.pods == nil {
+		return nil
+	}
+	res := make(map[string]*pod)
+	for pn, pd := range *p.pods {
+		res[pn] = &pod{
+			Containers: make(map[string]*Container),
+		}
+		for cn, c := range pd.Containers {
+			res[pn].Containers[cn] = p.withStats(c)
+		}
+	}
+	return &res
+}
+
+func statsKey(c *Container, by string) float64 {
+	if c.Stats == nil {
+		return -1
+	}
+	switch by {
+	case SortCpu:
+		return c.Stats.CpuPercent
+	case SortMemory:
+		return float64(c.Stats.MemoryBytes)
+	case SortIo:
+		return float64(c.Stats.IoReadBytes + c.Stats.IoWriteBytes)
+	}
+	return -1
+}
+
+/*
+ * Get the top N containers, sorted by resource usage from the last ScanStats. All containers are returned,
+ * if top is 0. The returned containers are copies, with their stats set.
+ */
+func (p *PodDb) TopContainers(by string, top int) ([]*Container, error) {
+	res := []*Container{}
+
+	if by != SortCpu && by != SortMemory && by != SortIo {
+		return nil, fmt.Errorf("Unknown sort key %s, must be one of %s, %s or %s", by, SortCpu, SortMemory, SortIo)
+	}
+
+	p.lock.RLock()
+	if p.pods != nil {
+		for _, pd := range *p.pods {
+			for _, c := range pd.Containers {
+				res = append(res, p.withStats(c))
+			}
+		}
+	}
+	p.lock.RUnlock()
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return statsKey(res[i], by) > statsKey(res[j], by)
+	})
+	if top > 0 && top < len(res) {
+		res = res[:top]
+	}
+
+	return res, nil
+}
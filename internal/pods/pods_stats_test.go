@@ -0,0 +1,212 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package pods
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* A discovery backend, that reports the stats of the containers as the CRI, in the given order */
+type fakeStats struct {
+	fakeDiscover
+	lock    sync.Mutex
+	samples map[string][]*ContainerStats
+}
+
+func (f *fakeStats) containerStats(c *Container) (*ContainerStats, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	s := f.samples[*c.Id]
+	if len(s) == 0 {
+		return nil, os.ErrNotExist
+	}
+	res := *s[0]
+	if len(s) > 1 {
+		f.samples[*c.Id] = s[1:]
+	}
+	return &res, nil
+}
+
+func newStatsDb(t *testing.T) (*PodDb, string, string) {
+	procfs, sysfs := t.TempDir(), t.TempDir()
+	return &PodDb{
+		procfsPath: &procfs,
+		sysfsPath:  &sysfs,
+		cpuSamples: make(map[string]cpuSample),
+	}, procfs, sysfs
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for f, data := range files {
+		p := filepath.Join(dir, f)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0750))
+		assert.Nil(t, os.WriteFile(p, []byte(data), 0640))
+	}
+}
+
+func TestCgroupStats(t *testing.T) {
+	db, procfs, sysfs := newStatsDb(t)
+	pod, v2, v1, none := "pod", "v2", "v1", "none"
+
+	writeFiles(t, procfs, map[string]string{
+		"100/cgroup": "0::/kubepods/pod1/c2\n",
+		"200/cgroup": "12:blkio:/kubepods/pod1/c1\n5:memory:/kubepods/pod1/c1\n4:cpu,cpuacct:/kubepods/pod1/c1\n",
+		"300/cgroup": "0::/kubepods/pod1/c3\n",
+	})
+	writeFiles(t, filepath.Join(sysfs, cgroupRoot), map[string]string{
+		"kubepods/pod1/c2/cpu.stat":       "usage_usec 1500\nuser_usec 1000\nsystem_usec 500\n",
+		"kubepods/pod1/c2/memory.current": "4096\n",
+		"kubepods/pod1/c2/io.stat": "259:0 rbytes=1000 wbytes=2000 rios=1 wios=2\n" +
+			"259:1 rbytes=10 wbytes=20 rios=1 wios=2\n",
+		"cpuacct/kubepods/pod1/c1/cpuacct.usage":                 "2500\n",
+		"memory/kubepods/pod1/c1/memory.usage_in_bytes":          "8192\n",
+		"blkio/kubepods/pod1/c1/blkio.throttle.io_service_bytes": "8:0 Read 300\n8:0 Write 400\n8:0 Sync 700\n8:16 Read 5\nTotal 705\n",
+	})
+
+	st, err := db.containerStats(nil, &Container{Id: &v2, Pod: &pod, Tasks: []int{100}})
+	assert.Nil(t, err)
+	assert.Equal(t, StatsSourceCgroup, st.Source)
+	assert.Equal(t, uint64(1500000), st.CpuUsageNs)
+	assert.Equal(t, uint64(4096), st.MemoryBytes)
+	assert.Equal(t, uint64(1010), st.IoReadBytes)
+	assert.Equal(t, uint64(2020), st.IoWriteBytes)
+	assert.False(t, st.Time.IsZero())
+
+	st, err = db.containerStats(nil, &Container{Id: &v1, Pod: &pod, Tasks: []int{200}})
+	assert.Nil(t, err)
+	assert.Equal(t, StatsSourceCgroup, st.Source)
+	assert.Equal(t, uint64(2500), st.CpuUsageNs)
+	assert.Equal(t, uint64(8192), st.MemoryBytes)
+	assert.Equal(t, uint64(305), st.IoReadBytes)
+	assert.Equal(t, uint64(400), st.IoWriteBytes)
+
+	/* No cgroup files, or no tasks */
+	_, err = db.containerStats(nil, &Container{Id: &none, Pod: &pod, Tasks: []int{300}})
+	assert.NotNil(t, err)
+	_, err = db.containerStats(nil, &Container{Id: &none, Pod: &pod})
+	assert.NotNil(t, err)
+}
+
+func TestCpuPercent(t *testing.T) {
+	db, _, _ := newStatsDb(t)
+	pod, name := "pod", "app"
+	now := time.Now()
+	b := &fakeStats{samples: map[string][]*ContainerStats{
+		name: {
+			{Source: StatsSourceCri, Time: now, CpuUsageNs: 1000000000},
+			{Source: StatsSourceCri, Time: now.Add(2 * time.Second), CpuUsageNs: 2000000000},
+			/* The counter is reset, i.e. the container is restarted */
+			{Source: StatsSourceCri, Time: now.Add(3 * time.Second), CpuUsageNs: 100},
+			{Source: StatsSourceCri, Time: now.Add(4 * time.Second), CpuUsageNs: 100 + 250000000},
+		},
+	}}
+	c := &Container{Id: &name, Pod: &pod, cid: "c1"}
+
+	percent := []float64{}
+	for i := 0; i < 4; i++ {
+		st, err := db.containerStats(b, c)
+		assert.Nil(t, err)
+		percent = append(percent, st.CpuPercent)
+	}
+	assert.InDeltaSlice(t, []float64{0, 50, 0, 25}, percent, 0.001)
+
+	/* A new container with the same name starts without a previous sample */
+	b.samples[name] = []*ContainerStats{{Source: StatsSourceCri, Time: now.Add(5 * time.Second), CpuUsageNs: 300000000}}
+	st, err := db.containerStats(b, &Container{Id: &name, Pod: &pod, cid: "c2"})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(0), st.CpuPercent)
+}
+
+func TestTopContainers(t *testing.T) {
+	db, _, _ := newStatsDb(t)
+	now := time.Now()
+	b := &fakeStats{samples: make(map[string][]*ContainerStats)}
+	all := map[string]*pod{"pod": {Containers: make(map[string]*Container)}}
+	for i, u := range []struct {
+		cpu, mem, io uint64
+	}{{1, 30, 200}, {3, 10, 300}, {2, 20, 100}} {
+		name, pn := "c"+strconv.Itoa(i), "pod"
+		all["pod"].Containers[name] = &Container{Id: &name, Pod: &pn, cid: name, discover: b}
+		b.samples[name] = []*ContainerStats{
+			{Source: StatsSourceCri, Time: now, CpuUsageNs: 0, MemoryBytes: u.mem, IoReadBytes: u.io},
+			{Source: StatsSourceCri, Time: now.Add(time.Second), CpuUsageNs: u.cpu * 10000000, MemoryBytes: u.mem,
+				IoReadBytes: u.io, IoWriteBytes: u.io},
+		}
+	}
+	none := "none"
+	all["pod"].Containers[none] = &Container{Id: &none, Pod: &none, cid: none, discover: b}
+	db.pods = &all
+
+	names := func(res []*Container) []string {
+		n := []string{}
+		for _, c := range res {
+			n = append(n, *c.Id)
+		}
+		return n
+	}
+
+	db.ScanStats()
+	db.ScanStats()
+	res, err := db.TopContainers(SortCpu, 0)
+	assert.Nil(t, err)
+	/* Containers without stats are the last */
+	assert.Equal(t, []string{"c1", "c2", "c0", "none"}, names(res))
+	assert.InDelta(t, 3, res[0].Stats.CpuPercent, 0.001)
+	assert.Nil(t, res[3].Stats)
+	res, err = db.TopContainers(SortMemory, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c0", "c2"}, names(res))
+	res, err = db.TopContainers(SortIo, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c1", "c0", "c2", "none"}, names(res))
+	_, err = db.TopContainers("disk", 1)
+	assert.NotNil(t, err)
+
+	/* The shared containers are not changed, the stats are set only in the returned copies */
+	for _, c := range (*db.Get())["pod"].Containers {
+		assert.Nil(t, c.Stats)
+	}
+	assert.Equal(t, uint64(30), (*db.GetStats())["pod"].Containers["c0"].Stats.MemoryBytes)
+}
+
+/* The containers are encoded by the handlers without the lock, while the stats may be updated */
+func TestStatsConcurrentRead(t *testing.T) {
+	db, _, _ := newStatsDb(t)
+	name, pn := "app", "pod"
+	b := &fakeStats{samples: map[string][]*ContainerStats{
+		name: {{Source: StatsSourceCri, MemoryBytes: 1}},
+	}}
+	db.pods = &map[string]*pod{pn: {Containers: map[string]*Container{
+		name: {Id: &name, Pod: &pn, cid: name, discover: b},
+	}}}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			db.ScanStats()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		res, err := db.TopContainers(SortMemory, 0)
+		assert.Nil(t, err)
+		_, err = json.Marshal(res)
+		assert.Nil(t, err)
+		_, err = json.Marshal(db.Get())
+		assert.Nil(t, err)
+	}
+	wg.Wait()
+}
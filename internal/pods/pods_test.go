@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package pods
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDiscover struct {
+	name string
+}
+
+func (f *fakeDiscover) podScan() (*map[string]*pod, error) {
+	return nil, nil
+}
+
+func (f *fakeDiscover) runtime() string {
+	return f.name
+}
+
+func (f *fakeDiscover) endpoint() string {
+	return ""
+}
+
+func podWith(containers map[string]*Container) *map[string]*pod {
+	return &map[string]*pod{"pod": {Containers: containers}}
+}
+
+func TestMergePods(t *testing.T) {
+	all := make(map[string]*pod)
+
+	mergePods(all, podWith(map[string]*Container{
+		"app":     {Tasks: []int{100}, cid: "a1"},
+		"sidecar": {Tasks: []int{}, cid: "s1"},
+	}), &fakeDiscover{"containerd"})
+	/* The same containers by ID or by tasks, the tasks of the sidecar are not known */
+	mergePods(all, podWith(map[string]*Container{
+		"app":     {Tasks: []int{100, 101}, cid: "a2"},
+		"sidecar": {Tasks: []int{}, cid: "s1"},
+		"db":      {Tasks: []int{}},
+	}), &fakeDiscover{"crio"})
+	assert.ElementsMatch(t, []string{"app", "sidecar", "db"}, keys(all["pod"].Containers))
+	assert.Equal(t, "containerd", all["pod"].Containers["app"].discover.runtime())
+	assert.Equal(t, "crio", all["pod"].Containers["db"].discover.runtime())
+
+	/* Different containers with the same name do not overwrite each other, i.e. from two endpoints of a runtime */
+	mergePods(all, podWith(map[string]*Container{
+		"app": {Tasks: []int{200}, cid: "a3"},
+	}), &fakeDiscover{"crio"})
+	mergePods(all, podWith(map[string]*Container{
+		"app": {Tasks: []int{300}, cid: "a4"},
+	}), &fakeDiscover{"crio"})
+	assert.ElementsMatch(t, []string{"app", "app@crio", "app@crio-2", "sidecar", "db"}, keys(all["pod"].Containers))
+	assert.Equal(t, "a1", all["pod"].Containers["app"].cid)
+	assert.Equal(t, "a3", all["pod"].Containers["app@crio"].cid)
+	assert.Equal(t, "a4", all["pod"].Containers["app@crio-2"].cid)
+}
+
+func keys(m map[string]*Container) []string {
+	res := []string{}
+	for k := range m {
+		res = append(res, k)
+	}
+	return res
+}
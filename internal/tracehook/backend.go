@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Backends, that provide trace hooks. The hook managers, run as external executables, and the native
+ * hooks are backends. Other backends can be compiled in the tracer and passed to the hooks database.
+ */
+package tracehook
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+var (
+	/* Context of the trace session, passed to the hook managers. Lists are comma separated, one item per container */
+	EnvNode          = "TRACER_NODE"
+	EnvSession       = "TRACER_SESSION"
+	EnvUserContext   = "TRACER_USER_CONTEXT"
+	EnvPods          = "TRACER_PODS"
+	EnvPodNamespaces = "TRACER_POD_NAMESPACES"
+	EnvContainers    = "TRACER_CONTAINERS"
+	EnvContainerIds  = "TRACER_CONTAINER_IDS"
+	EnvCgroups       = "TRACER_CGROUPS" /* cgroup v2 paths of the containers */
+	EnvContext       = "TRACER_CONTEXT" /* The whole context as JSON, including all cgroups and name spaces */
+)
+
+/* Description of a hook, provided by a backend */
+type HookDescription struct {
+	Description []string      /* Multi line user description of the hook */
+	Manifest    *HookManifest /* Optional, the arguments of hooks with a manifest are validated */
+}
+
+/* A traced container, as passed to the hooks */
+type HookContainer struct {
+	Pod        string
+	Namespace  string `json:",omitempty"` /* Kubernetes name space of the pod */
+	Name       string
+	Id         string            `json:",omitempty"` /* ID of the container in its runtime */
+	Runtime    string            `json:",omitempty"`
+	Cgroups    map[string]string `json:",omitempty"` /* Cgroup paths by controllers, the cgroup v2 path has an empty key */
+	Namespaces map[string]int    `json:",omitempty"` /* Inodes of the name spaces by type, i.e. "net" */
+}
+
+/* Context of the trace session, in which the hook runs */
+type HookContext struct {
+	Node       string
+	Session    string
+	User       string /* User context of the trace session */
+	Containers []HookContainer
+}
+
+/* Environment variables, describing the context */
+func (c *HookContext) environment() []string {
+	pods, namespaces, names, ids, cgroups := []string{}, []string{}, []string{}, []string{}, []string{}
+
+	for _, cn := range c.Containers {
+		pods = append(pods, cn.Pod)
+		namespaces = append(namespaces, cn.Namespace)
+		names = append(names, cn.Name)
+		ids = append(ids, cn.Id)
+		cgroups = append(cgroups, cn.Cgroups[""])
+	}
+	res := []string{
+		EnvNode + "=" + c.Node,
+		EnvSession + "=" + c.Session,
+		EnvUserContext + "=" + c.User,
+		EnvPods + "=" + strings.Join(pods, ","),
+		EnvPodNamespaces + "=" + strings.Join(namespaces, ","),
+		EnvContainers + "=" + strings.Join(names, ","),
+		EnvContainerIds + "=" + strings.Join(ids, ","),
+		EnvCgroups + "=" + strings.Join(cgroups, ","),
+	}
+	if js, err := json.Marshal(c); err == nil {
+		res = append(res, EnvContext+"="+string(js))
+	}
+
+	return res
+}
+
+/* Parameters of a hook run */
+type RunRequest struct {
+	Pids    []int    /* Tasks to be traced */
+	Parent  []int    /* Parents of the tasks, the processes they start later are traced as well */
+	Params  []string /* Arguments of the hook, validated if the hook has a manifest */
+	Context HookContext
+}
+
+type Backend interface {
+	/* Name of the backend, its hooks are addressed as "<backend name>/<hook name>" */
+	Name() string
+	/* Names of all hooks, provided by the backend */
+	List() ([]string, error)
+	Describe(hook string) (*HookDescription, error)
+	/* Reasons, why the hook cannot be used on this node. Empty if the hook can be used */
+	Check(hook string) []string
+	/* Start the hook, it reports its state through the returned session */
+	Run(hook string, req *RunRequest) (*Session, error)
+	Stop(s *Session, wait bool) error
+	/* Clean up leftovers of previous runs, i.e. after a crash of the tracer */
+	Reset()
+}
+
+/*
+ * Create a session of a hook, run by a backend. The backend reports the location of the traces, the
+ * traced tasks and when the trace is ready. Optional filter of the traces is applied by the tracer.
+ */
+func NewSession(filter func(string) bool) *Session {
+	return &Session{
+		proto:  newProtocol(ProtocolVersion),
+		filter: filter,
+	}
+}
+
+/* Report the location and the format of the collected traces */
+func (s *Session) SetOutput(path, format string) {
+	s.cmdOutLock.Lock()
+	s.cmdOut = append(s.cmdOut, path)
+	s.cmdOutLock.Unlock()
+	s.proto.handle(&hookMessage{Type: MsgOutput, Path: path, Format: format})
+}
+
+/* Report the PIDs, actually filtered by the hook */
+func (s *Session) SetPids(pids []int) {
+	s.proto.handle(&hookMessage{Type: MsgPids, Pids: pids})
+}
+
+/* Report that the trace is running */
+func (s *Session) SetReady() {
+	s.proto.handle(&hookMessage{Type: MsgReady})
+}
+
+/* Report a non fatal problem */
+func (s *Session) Warning(msg string) {
+	s.proto.handle(&hookMessage{Type: MsgWarning, Message: msg})
+}
+
+/* Report a fatal problem of the hook */
+func (s *Session) Fail(err error) {
+	s.proto.handle(&hookMessage{Type: MsgError, Message: err.Error()})
+}
@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracehook
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* In-process backend with a single hook, that records its calls */
+type fakeBackend struct {
+	req    *RunRequest
+	stops  int
+	resets int
+}
+
+func (b *fakeBackend) Name() string {
+	return "fake"
+}
+
+func (b *fakeBackend) List() ([]string, error) {
+	return []string{"sample", "broken"}, nil
+}
+
+func (b *fakeBackend) Describe(hook string) (*HookDescription, error) {
+	return &HookDescription{Description: []string{"Fake " + hook}}, nil
+}
+
+func (b *fakeBackend) Check(hook string) []string {
+	if hook == "broken" {
+		return []string{"Broken hook"}
+	}
+	return []string{}
+}
+
+func (b *fakeBackend) Run(hook string, req *RunRequest) (*Session, error) {
+	b.req = req
+	s := NewSession(nil)
+	s.SetOutput("/fake/trace", FormatSched)
+	s.SetPids(req.Pids)
+	s.SetReady()
+	return s, nil
+}
+
+func (b *fakeBackend) Stop(s *Session, wait bool) error {
+	b.stops++
+	return nil
+}
+
+func (b *fakeBackend) Reset() {
+	b.resets++
+}
+
+func TestBackend(t *testing.T) {
+	hooks := t.TempDir()
+	tracefs := t.TempDir()
+	fb := &fakeBackend{}
+	policy := OrphanRemoveAll
+
+	/* The compiled in backends take precedence over the managers with the same name */
+	dir := filepath.Join(hooks, "fake")
+	assert.Nil(t, os.Mkdir(dir, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(fakeManager), 0750))
+	db, err := NewTraceHooksDb(&HookConfig{
+		HooksPath: &hooks,
+		Tracefs:   &tracefs,
+		Backends:  []Backend{fb},
+
+		OrphanPolicy: &policy,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fb.resets)
+
+	name := "trace_fake"
+	_, err = db.GetHook(&name)
+	assert.NotNil(t, err)
+	name = "fake/broken"
+	_, err = db.GetHook(&name)
+	assert.NotNil(t, err)
+
+	name = "fake/sample"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Fake sample"}, th.Description)
+
+	pids := []int{1, 2}
+	parent := []int{3}
+	params := []string{"--any"}
+	hctx := HookContext{Node: "node", Session: "1", User: "test"}
+	s, err := db.Run(th, &pids, &parent, &params, &hctx)
+	assert.Nil(t, err)
+	assert.Equal(t, &RunRequest{Pids: pids, Parent: parent, Params: params, Context: hctx}, fb.req)
+	assert.Nil(t, db.WaitStart(s))
+	file, format := s.TraceFile()
+	assert.Equal(t, "/fake/trace", file)
+	assert.Equal(t, FormatSched, format)
+	assert.Equal(t, pids, s.Status().Pids)
+
+	assert.Nil(t, db.Stop(s, true))
+	assert.Equal(t, 1, fb.stops)
+
+	/* Failures, reported by the backend, stop the session start */
+	s = NewSession(nil)
+	s.Fail(fmt.Errorf("Failed"))
+	assert.NotNil(t, s.proto.waitReady())
+}
+
+var envManager = `#!/bin/sh
+case "$1" in
+	--get-all) echo trace_env ;;
+	--describe) echo "Save the environment" ;;
+	--run) env > env.out; echo /fake/trace; sleep 10 ;;
+esac
+`
+
+func TestHookContext(t *testing.T) {
+	db, _ := fakeHooksDb(t)
+	dir := filepath.Join(*db.topDir, "env")
+	assert.Nil(t, os.Mkdir(dir, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(envManager), 0750))
+	_, err := db.Rescan()
+	assert.Nil(t, err)
+
+	hctx := HookContext{
+		Node:    "node",
+		Session: "42",
+		User:    "test",
+		Containers: []HookContainer{
+			{Pod: "web", Namespace: "default", Name: "app", Id: "c1", Cgroups: map[string]string{"": "/web/app"}},
+			{Pod: "web", Namespace: "default", Name: "sidecar", Id: "c2", Namespaces: map[string]int{"net": 1}},
+		},
+	}
+	name := "env/trace_env"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	pids := []int{os.Getpid()}
+	s, err := db.Run(th, &pids, nil, nil, &hctx)
+	assert.Nil(t, err)
+	assert.Nil(t, db.WaitStart(s))
+	/* The hook is interrupted, its exit status does not matter */
+	db.Stop(s, true)
+
+	env := readFile(t, filepath.Join(dir, "env.out"))
+	for _, e := range []string{
+		EnvNode + "=node",
+		EnvSession + "=42",
+		EnvUserContext + "=test",
+		EnvPods + "=web,web",
+		EnvPodNamespaces + "=default,default",
+		EnvContainers + "=app,sidecar",
+		EnvContainerIds + "=c1,c2",
+		EnvCgroups + "=/web/app,",
+	} {
+		assert.Contains(t, env, e+"\n")
+	}
+	for _, l := range strings.Split(env, "\n") {
+		if strings.HasPrefix(l, EnvContext+"=") {
+			var res HookContext
+			assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(l, EnvContext+"=")), &res))
+			assert.Equal(t, hctx, res)
+		}
+	}
+}
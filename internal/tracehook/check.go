@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Preflight checks of the trace hooks, to find out if they can be used on the current node.
+ */
+package tracehook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var (
+	FeatureTracefs = "tracefs"
+)
+
+/*
+ * Check if the kernel features, required by the hook, are available. Each feature is a path,
+ * relative to the tracefs mount point, i.e. "events/syscalls" or "dynamic_events".
+ */
+func (h *TraceHooks) checkFeatures(th *TraceHook) []string {
+	res := []string{}
+
+	for _, f := range th.Features {
+		if h.tracefs == nil {
+			res = append(res, fmt.Sprintf("Feature %s is not available: tracefs is not found", f))
+			continue
+		}
+		if f == FeatureTracefs {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(h.tracefs.Dir, f)); err != nil {
+			res = append(res, fmt.Sprintf("Feature %s is not available in the kernel", f))
+		}
+	}
+
+	return res
+}
+
+/* Run all preflight checks of the hook and set its availability */
+func (h *TraceHooks) checkHook(th *TraceHook) {
+	th.Unavailable = h.checkFeatures(th)
+	if len(th.Unavailable) == 0 {
+		th.Unavailable = th.manager.backend.Check(th.Name)
+	}
+	th.Available = len(th.Unavailable) == 0
+}
+
+/*
+ * Get the hooks of all managers. Unavailable hooks are included only if all is set, the hooks and the
+ * managers, refused by the hook policy, are always included.
+ */
+func (h *TraceHooks) List(all bool) *map[string]*hookManager {
+	res := make(map[string]*hookManager)
+
+	for d, m := range *h.Get() {
+		if all || m.Refused != "" {
+			res[d] = m
+			continue
+		}
+		cm := *m
+		cm.Tracers = make(map[string]*TraceHook)
+		for n, th := range m.Tracers {
+			if th.Available || th.Refused != "" {
+				cm.Tracers[n] = th
+			}
+		}
+		if len(cm.Tracers) > 0 {
+			res[d] = &cm
+		}
+	}
+
+	return &res
+}
@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracehook
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var checkManager = `#!/bin/sh
+case "$1" in
+	--protocol-version) echo 1 ;;
+	--get-all) echo trace_good trace_bad ;;
+	--describe) echo "Checked trace hook" ;;
+	--check)
+		if [ "$2" = "trace_bad" ]; then
+			echo "Missing kernel feature"
+			exit 1
+		fi
+		;;
+esac
+`
+
+func TestCheck(t *testing.T) {
+	db, tracefs := fakeHooksDb(t)
+	dir := filepath.Join(*db.topDir, "check")
+	assert.Nil(t, os.Mkdir(dir, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(checkManager), 0750))
+	_, err := db.Rescan()
+	assert.Nil(t, err)
+
+	name := "trace_good"
+	_, err = db.GetHook(&name)
+	assert.Nil(t, err)
+	name = "trace_bad"
+	_, err = db.GetHook(&name)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Missing kernel feature")
+
+	all := *db.List(true)
+	assert.False(t, all[dir].Tracers["trace_bad"].Available)
+	assert.Equal(t, []string{"Missing kernel feature"}, all[dir].Tracers["trace_bad"].Unavailable)
+	avail := *db.List(false)
+	assert.Equal(t, 1, len(avail[dir].Tracers))
+	assert.True(t, avail[dir].Tracers["trace_good"].Available)
+
+	/* The native syscalls hook requires the syscalls events */
+	assert.True(t, avail[NativeManager].Tracers["syscalls"].Available)
+	assert.Nil(t, os.RemoveAll(filepath.Join(tracefs, "events/syscalls")))
+	_, err = db.Rescan()
+	assert.Nil(t, err)
+	_, ok := (*db.List(false))[NativeManager]
+	assert.False(t, ok)
+	assert.Equal(t, 1, len((*db.List(true))[NativeManager].Tracers["syscalls"].Unavailable))
+}
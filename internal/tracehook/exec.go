@@ -0,0 +1,239 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Backend of the hooks, provided by a hook manager - an external executable named "manager.*".
+ */
+package tracehook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var outputSeq uint64 /* Used to name the output pipes */
+
+type execBackend struct {
+	h        *TraceHooks
+	name     string
+	dir      string
+	fexec    string
+	protocol int                      /* Version of the protocol, used by the manager. 0 is the legacy one */
+	manifest map[string]*HookManifest /* Manifest of the hooks, if the manager has one */
+}
+
+func newExecBackend(h *TraceHooks, dir, fexec string) *execBackend {
+	return &execBackend{
+		h:     h,
+		name:  h.managerName(dir),
+		dir:   dir,
+		fexec: fexec,
+	}
+}
+
+func (b *execBackend) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "./"+b.fexec, args...)
+	cmd.Env = b.h.env
+	cmd.Dir = b.dir
+	return cmd
+}
+
+func (b *execBackend) Name() string {
+	return b.name
+}
+
+/* Call the manager to get available trace hooks */
+func (b *execBackend) List() ([]string, error) {
+	var out bytes.Buffer
+
+	all := b.command(context.Background(), "--get-all")
+	all.Stdout = &out
+	if err := all.Run(); err != nil {
+		return nil, err
+	}
+	b.protocol = b.getProtocolVersion()
+
+	manifest, err := loadManifest(b.dir)
+	if err != nil {
+		/* Broken manifest, ignore it and use the hooks without argument validation */
+		fmt.Fprintln(os.Stderr, err)
+	}
+	b.manifest = manifest
+
+	return strings.Fields(out.String()), nil
+}
+
+func (b *execBackend) Describe(hook string) (*HookDescription, error) {
+	var out bytes.Buffer
+
+	desc := b.command(context.Background(), "--describe", hook)
+	desc.Stdout = &out
+	if err := desc.Run(); err != nil {
+		return nil, err
+	}
+	res := &HookDescription{
+		Description: []string{},
+		Manifest:    b.manifest[hook],
+	}
+	for _, d := range strings.Split(out.String(), "\n") {
+		if str := strings.TrimSpace(d); len(str) > 0 {
+			res.Description = append(res.Description, str)
+		}
+	}
+
+	return res, nil
+}
+
+/*
+ * Ask the manager if the hook can be used on this node. The manager prints the reasons why the hook
+ * is not usable, one per line, and exits with non zero code. Only managers, that speak the protocol,
+ * support the check.
+ */
+func (b *execBackend) Check(hook string) []string {
+	res := []string{}
+
+	if b.protocol <= protocolLegacy {
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.h.startTimeout)
+	defer cancel()
+	cmd := b.command(ctx, "--check", hook)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		for _, l := range strings.Split(out.String(), "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				res = append(res, l)
+			}
+		}
+		if len(res) == 0 {
+			res = append(res, fmt.Sprintf("Check failed: %v", err))
+		}
+	}
+
+	return res
+}
+
+func readOutput(s *bufio.Scanner, l *sync.RWMutex, b *[]string) {
+	for s.Scan() {
+		l.Lock()
+		*b = append(*b, s.Text())
+		l.Unlock()
+	}
+}
+
+func (b *execBackend) Run(hook string, req *RunRequest) (*Session, error) {
+	var ret Session
+
+	hargs := []string{"--pid"}
+	for _, p := range req.Pids {
+		hargs = append(hargs, strconv.Itoa(p))
+	}
+
+	/* Trace the children of the parents, i.e. processes started in the container by its shim */
+	if len(req.Parent) > 0 {
+		hargs = append(hargs, "--parent")
+		for _, p := range req.Parent {
+			hargs = append(hargs, strconv.Itoa(p))
+		}
+	}
+
+	hargs = append(hargs, req.Params...)
+
+	/* Pass the arguments as a JSON array, to keep arguments with white spaces intact */
+	jargs, err := json.Marshal(hargs)
+	if err != nil {
+		return nil, err
+	}
+	ret.cmd = b.command(context.Background(), "--run", hook, "--args-json", string(jargs))
+	ret.cmd.Env = append(append([]string{}, b.h.env...), req.Context.environment()...)
+	ret.format = FormatFtrace
+	if m, ok := b.manifest[hook]; ok && m.Format != "" {
+		ret.format = m.Format
+	}
+	var protoWrite *os.File
+	if b.protocol > protocolLegacy {
+		protoRead, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		protoWrite = w
+		ret.proto = newProtocol(b.protocol)
+		ret.proto.owner = ret.Own
+		ret.cmd.ExtraFiles = []*os.File{protoWrite}
+		ret.cmd.Env = append(ret.cmd.Env,
+			fmt.Sprintf("%s=%d", EnvProtocolFd, protocolFd),
+			fmt.Sprintf("%s=%d", EnvProtocolVersion, b.protocol))
+		go ret.proto.read(protoRead)
+		/* The manager has its own copy of the write end, close ours when it is started */
+		defer protoWrite.Close()
+	}
+	if b.protocol >= protocolPipe {
+		/* Pipe for the traces, the hook does not need access to the file system of the tracer */
+		outRead, outWrite, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		ret.output = outRead
+		ret.outputName = fmt.Sprintf("pipe:%d", atomic.AddUint64(&outputSeq, 1))
+		ret.cmd.ExtraFiles = append(ret.cmd.ExtraFiles, outWrite)
+		ret.cmd.Env = append(ret.cmd.Env, fmt.Sprintf("%s=%d", EnvOutputFd, outputFd))
+		defer outWrite.Close()
+	}
+	/* Run the hook in its own process group, to be able to stop all its children */
+	ret.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	b.h.setLimits(ret.cmd)
+	ret.exited = make(chan struct{})
+	stdoutIn, _ := ret.cmd.StdoutPipe()
+	stderrIn, _ := ret.cmd.StderrPipe()
+	if err := ret.cmd.Start(); err != nil {
+		if ret.output != nil {
+			ret.output.Close()
+		}
+		return nil, err
+	}
+
+	scannerOut := bufio.NewScanner(stdoutIn)
+	scannerErr := bufio.NewScanner(stderrIn)
+	ret.cmdWg.Add(2)
+	go func() {
+		readOutput(scannerOut, &ret.cmdOutLock, &ret.cmdOut)
+		ret.cmdWg.Done()
+	}()
+	go func() {
+		readOutput(scannerErr, &ret.cmdErrLock, &ret.cmdErr)
+		ret.cmdWg.Done()
+	}()
+
+	b.h.runLock.Lock()
+	b.h.running[&ret] = true
+	b.h.runLock.Unlock()
+	go b.h.waitProcess(&ret)
+
+	return &ret, nil
+}
+
+func (b *execBackend) Stop(s *Session, wait bool) error {
+	if wait {
+		return b.h.stopProcess(s)
+	}
+	go b.h.stopProcess(s)
+
+	return nil
+}
+
+func (b *execBackend) Reset() {
+	b.command(context.Background(), "--clear").Run()
+}
@@ -7,15 +7,18 @@
 package tracehook
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"strconv"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/vmware-labs/container-tracer/internal/ftrace"
 )
 
 var (
@@ -24,18 +27,48 @@ var (
 	EnvProcfs       = "TRACER_PROCFS_PATH"
 	EnvSysfs        = "TRACER_SYSFS_PATH"
 	EnvHooks        = "TRACER_HOOKS"
+	EnvTracefs      = "TRACER_TRACEFS_PATH"
+	EnvStartTimeout = "TRACER_HOOK_START_TIMEOUT"
+	EnvStopTimeout  = "TRACER_HOOK_STOP_TIMEOUT"
+	EnvCpuLimit     = "TRACER_HOOK_CPU_LIMIT"
+	EnvMemoryLimit  = "TRACER_HOOK_MEMORY_LIMIT"
 )
 
+/* Open the tracefs, given in the configuration. The tests replace it with a fake tracefs */
+var openTracefs = ftrace.New
+
 type HookConfig struct {
 	HooksPath *string /* Path to directory with trace hooks. */
 	Sysfs     *string /* /sys fs  mountpoint. */
 	Procfs    *string /* /proc fs  mountpoint. */
+	Tracefs   *string /* tracefs mountpoint, auto detected if not set. */
+
+	StartTimeout *time.Duration /* Time to wait for a hook to start. */
+	StopTimeout  *time.Duration /* Time to wait for a hook to stop, before sending a stronger signal. */
+	CpuLimit     *uint64        /* Limit of the CPU time of the hook processes in seconds, 0 for no limit. */
+	MemoryLimit  *uint64        /* Limit of the address space of the hook processes in MiB, 0 for no limit. */
+
+	Backends []Backend /* Additional backends of trace hooks, compiled in the tracer. */
+
+	StateFile    *string /* File with the trace resources, owned by the tracer. Not persisted if not set. */
+	OrphanPolicy *string /* What to do with the orphaned trace resources: keep, remove or remove-all. */
+
+	PolicyFile *string /* Policy with the allowed hook managers and hooks. All are allowed if not set. */
 }
 
 type TraceHook struct {
 	Name        string
+	FullName    string /* Qualified name of the hook, as "<manager>/<hook>" */
 	manager     *hookManager
-	Description []string `json:"Description"`
+	manifest    *HookManifest
+	Description []string               `json:"Description"`
+	Version     string                 `json:",omitempty"`
+	Features    []string               `json:",omitempty"` /* Kernel features, required by the hook */
+	Format      string                 `json:",omitempty"` /* Format of the traces */
+	Schema      map[string]interface{} `json:",omitempty"` /* JSON Schema of the hook arguments */
+	Available   bool                   /* The hook can be used on this node */
+	Unavailable []string               `json:",omitempty"` /* Reasons, why the hook cannot be used */
+	Refused     string                 `json:",omitempty"` /* Reason, why the hook is refused by the hook policy */
 }
 
 type Session struct {
@@ -45,18 +78,60 @@ type Session struct {
 	cmdErr     []string
 	cmdErrLock sync.RWMutex
 	cmdWg      sync.WaitGroup
+	exited     chan struct{} /* Closed when the hook process exits */
+	reapLock   sync.Mutex    /* Protect the signals to the process group from its reaping */
+	reaped     bool          /* The hook process is reaped, its process group id may be reused */
+	proto      *hookProtocol /* Set if the hook speaks the versioned protocol */
+	format     string        /* Format of the traces, if the hook uses the legacy protocol */
+	output     io.ReadCloser /* Read end of the output pipe, passed to the hook */
+	outputName string
+	outputLock sync.Mutex
+	outputUsed bool /* The output pipe is read by the tracer */
+	filter     func(string) bool
+	waitErr    error
+	native     *nativeSession
+	backend    Backend /* Backend, that runs the hook */
+
+	resLock     sync.Mutex
+	resources   []*TraceResource /* Kernel resources, created for the session */
+	resDb       *resourceDb
+	resSession  string
+	resHook     string
+	resReleased bool /* The session is stopped and its resources are removed */
 }
 
+/* Hooks, provided by a backend */
 type hookManager struct {
-	dir     string
-	fexec   string
-	Tracers map[string]*TraceHook
+	Name     string /* Name of the backend, i.e. the path of the manager directory relative to the hooks directory */
+	Protocol int    /* Version of the protocol, used by the manager. 0 is the legacy one */
+	Tracers  map[string]*TraceHook
+	Refused  string `json:",omitempty"` /* Reason, why the manager is refused by the hook policy */
+	backend  Backend
 }
 
 type TraceHooks struct {
 	topDir   *string
 	env      []string
+	procfs   string
+	sysfs    string
+	tracefs  *ftrace.Tracefs
+	scanLock sync.Mutex /* Serialize the rescans of the hooks */
+	runLock  sync.Mutex /* Protect the running hook processes */
+	running  map[*Session]bool
+
+	startTimeout time.Duration
+	stopTimeout  time.Duration
+	cpuLimit     uint64
+	memLimit     uint64
+
+	backends  []Backend /* Backends, compiled in the tracer */
+	resources *resourceDb
+
+	policyFile string
+
+	lock     sync.RWMutex /* Protect the managers, replaced on each rescan, and the policy */
 	managers map[string]*hookManager
+	policy   *HookPolicy
 }
 
 func (s *Session) GetOutput() (*[]string, *[]string) {
@@ -74,16 +149,151 @@ func (s *Session) GetOutput() (*[]string, *[]string) {
 	return &out, &err
 }
 
+/* Get the hook state, reported through the protocol. Nil for hooks, using the legacy protocol */
+func (s *Session) Status() *HookStatus {
+	if s.proto == nil {
+		return nil
+	}
+	return s.proto.getStatus()
+}
+
+/*
+ * Get the filter of the collected traces, applied by the tracer. Nil if all traces are relevant.
+ * Used by hooks, which events cannot be filtered in the kernel.
+ */
+func (s *Session) Filter() func(string) bool {
+	return s.filter
+}
+
+/* Check if the hook writes the traces to the output pipe */
+func (s *Session) usesPipe() bool {
+	if s.proto == nil || s.output == nil {
+		return false
+	}
+	st := s.proto.getStatus()
+	return len(st.Outputs) > 0 && st.Outputs[0].Pipe
+}
+
+/*
+ * Get the location and the format of the collected traces. If the traces are written to the output
+ * pipe, the location is a unique name of the pipe and the traces must be read with Output()
+ */
+func (s *Session) TraceFile() (string, string) {
+	if s.proto != nil {
+		if st := s.proto.getStatus(); len(st.Outputs) > 0 {
+			if s.usesPipe() {
+				return s.outputName, st.Outputs[0].Format
+			}
+			return st.Outputs[0].Path, st.Outputs[0].Format
+		}
+		return "", ""
+	}
+
+	out, _ := s.GetOutput()
+	if len(*out) > 0 {
+		return (*out)[0], s.format
+	}
+	return "", ""
+}
+
+/*
+ * Get the output pipe with the traces, nil if the hook does not write to it. The caller reads the pipe
+ * until EOF, the hook blocks when the pipe is full.
+ */
+func (s *Session) Output() io.ReadCloser {
+	if !s.usesPipe() {
+		return nil
+	}
+	s.outputLock.Lock()
+	defer s.outputLock.Unlock()
+
+	s.outputUsed = true
+	return s.output
+}
+
+/* Close the output pipe, if it is not read by the tracer */
+func (s *Session) closeOutput() {
+	s.outputLock.Lock()
+	defer s.outputLock.Unlock()
+
+	if s.output != nil && !s.outputUsed {
+		s.output.Close()
+	}
+}
+
+/* Split a hook name to the name of the manager and the name of the hook. The manager is optional */
+func splitHookName(name string) (string, string) {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+/*
+ * Get a hook by its qualified name "<manager>/<hook>", or by its name only. A name without
+ * manager is resolved only if exactly one manager provides a hook with that name.
+ */
 func (h *TraceHooks) GetHook(name *string) (*TraceHook, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	mname, hname := splitHookName(*name)
+	found := []*TraceHook{}
 	for _, a := range h.managers {
-		if tr, ok := a.Tracers[*name]; ok {
-			return tr, nil
+		if mname != "" && a.Name != mname {
+			continue
+		}
+		if tr, ok := a.Tracers[hname]; ok {
+			found = append(found, tr)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("Cannot find trace hook %s", *name)
+	}
+	if len(found) > 1 {
+		names := []string{}
+		for _, tr := range found {
+			names = append(names, tr.FullName)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Trace hook %s is provided by more than one manager, use one of %s",
+			*name, strings.Join(names, ", "))
+	}
+	tr := found[0]
+	if !tr.Available {
+		return nil, fmt.Errorf("Trace hook %s is not available on this node: %s",
+			tr.FullName, strings.Join(tr.Unavailable, ", "))
+	}
+	return tr, nil
+}
+
+/* Name of a manager, by its directory. Managers in the top hooks directory are named after it */
+func (h *TraceHooks) managerName(dir string) string {
+	if rel, err := filepath.Rel(*h.topDir, dir); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return filepath.Base(dir)
+}
+
+/* Find hooks with the same name, provided by different managers. Returns their qualified names */
+func duplicateHooks(managers map[string]*hookManager) map[string][]string {
+	all := make(map[string][]string)
+	for _, m := range managers {
+		for n, th := range m.Tracers {
+			all[n] = append(all[n], th.FullName)
 		}
 	}
-	return nil, fmt.Errorf("Cannot find trace hook %s", *name)
+	res := make(map[string][]string)
+	for n, q := range all {
+		if len(q) > 1 {
+			sort.Strings(q)
+			res[n] = q
+		}
+	}
+	return res
 }
 
-func (h *TraceHooks) scanManagers(dir *string) error {
+func (h *TraceHooks) scanManagers(managers map[string]Backend, dir *string) error {
 	/* Walk all subdirectories and look for hook managers */
 	files, err := ioutil.ReadDir(*dir)
 	if err != nil {
@@ -97,159 +307,226 @@ func (h *TraceHooks) scanManagers(dir *string) error {
 
 		if f.IsDir() {
 			p := *dir + "/" + f.Name()
-			if e := h.scanManagers(&p); e != nil {
+			if e := h.scanManagers(managers, &p); e != nil {
 				return e
 			}
 		} else if strings.HasPrefix(f.Name(), managerPrefix) {
-			h.managers[*dir] = &hookManager{
-				dir:     *dir,
-				fexec:   f.Name(),
-				Tracers: make(map[string]*TraceHook),
-			}
+			managers[*dir] = newExecBackend(h, *dir, f.Name())
 		}
 	}
 
 	return nil
 }
 
-/* Call the manager to get available trace hooks and description of each of them */
-func (h *TraceHooks) scanTraceHooks(dir *string) error {
-	all := exec.Command("./"+h.managers[*dir].fexec, "--get-all")
-	all.Env = h.env
-	all.Dir = *dir
-
-	var allOut bytes.Buffer
-	all.Stdout = &allOut
-	if e := all.Run(); e != nil {
-		/* Failed to run this hook manager, skip it */
+/* Get the hooks of a backend and the description of each of them */
+func (h *TraceHooks) scanBackend(b Backend) *hookManager {
+	names, err := b.List()
+	if err != nil {
+		/* Failed to get the hooks of this backend, skip it */
 		return nil
 	}
+	hm := &hookManager{
+		Name:    b.Name(),
+		Tracers: make(map[string]*TraceHook),
+		backend: b,
+	}
+	if eb, ok := b.(*execBackend); ok {
+		hm.Protocol = eb.protocol
+	}
 
-	for _, s := range strings.Fields(allOut.String()) {
-		desc := exec.Command("./"+h.managers[*dir].fexec, "--describe", s)
-		desc.Env = h.env
-		desc.Dir = *dir
-
-		var descOut bytes.Buffer
-		desc.Stdout = &descOut
-		if e := desc.Run(); e != nil {
+	for _, s := range names {
+		th := &TraceHook{
+			Name:     s,
+			FullName: hm.Name + "/" + s,
+			manager:  hm,
+		}
+		/* The manager runs the hook to describe and check it, refused hooks must not be run at all */
+		if err := h.checkPolicy(th, false); err != nil {
+			fmt.Fprintf(os.Stderr, "Trace hook %s is refused: %v\n", th.FullName, err)
+			th.Description = []string{}
+			th.Refused = err.Error()
+			th.Unavailable = []string{"Refused by the hook policy: " + th.Refused}
+			hm.Tracers[s] = th
 			continue
 		}
-		dstrip := []string{}
-		for _, d := range strings.Split(descOut.String(), "\n") {
-			str := strings.TrimSpace(d)
-			if len(str) > 0 {
-				dstrip = append(dstrip, str)
-			}
+		desc, err := b.Describe(s)
+		if err != nil {
+			continue
 		}
-		h.managers[*dir].Tracers[s] = &TraceHook{
-			Name:        s,
-			manager:     h.managers[*dir],
-			Description: dstrip,
+		th.Description = desc.Description
+		if m := desc.Manifest; m != nil {
+			th.manifest = m
+			th.Version = m.Version
+			th.Features = m.Features
+			th.Format = m.Format
+			th.Schema = m.Schema()
 		}
+		h.checkHook(th)
+		hm.Tracers[s] = th
 	}
 
-	return nil
+	return hm
 }
 
-func readOutput(s *bufio.Scanner, l *sync.RWMutex, b *[]string) {
-	for s.Scan() {
-		l.Lock()
-		*b = append(*b, s.Text())
-		l.Unlock()
+/* Validate the arguments of a hook, if it has a manifest */
+func (th *TraceHook) Validate(params []string) error {
+	if th.manifest == nil {
+		return nil
 	}
+	return th.manifest.Validate(params)
 }
 
-func (h *TraceHooks) Run(th *TraceHook, pids *[]int, parent *[]int, params *[]string, user *string) (*Session, error) {
-	var ret Session
-
-	if pids == nil || len(*pids) < 1 {
-		return nil, fmt.Errorf("No tasks are provided")
+/* Validate the arguments of a hook and add the defaults of the missing ones, if it has a manifest */
+func (th *TraceHook) arguments(params []string) ([]string, error) {
+	if th.manifest == nil {
+		return params, nil
 	}
-	args := []string{}
-	args = append(args, "--run")
-	args = append(args, th.Name)
+	return th.manifest.WithDefaults(params)
+}
 
-	args = append(args, "--args")
-	sargs := "--pid"
-	for _, p := range *pids {
-		sargs += " " + strconv.Itoa(p)
+/* Run a hook on the given tasks, by the backend that provides it */
+func (h *TraceHooks) Run(th *TraceHook, pids *[]int, parent *[]int, params *[]string, hctx *HookContext) (*Session, error) {
+	req := RunRequest{
+		Parent: []int{},
+		Params: []string{},
 	}
 
-	/* temporary disable parent filtering, due to an issue with trace instance deletion
+	if pids == nil || len(*pids) < 1 {
+		return nil, fmt.Errorf("No tasks are provided")
+	}
+	req.Pids = *pids
 	if parent != nil {
-		sargs += " --parent"
-		for _, p := range *parent {
-			sargs += " " + strconv.Itoa(p)
-		}
+		req.Parent = *parent
 	}
-	*/
-
-	for _, p := range *params {
-		sargs += " " + p
+	if params != nil {
+		req.Params = *params
 	}
-	args = append(args, sargs)
-	ret.cmd = exec.Command("./"+th.manager.fexec, args...)
-	ret.cmd.Env = h.env
-	ret.cmd.Dir = th.manager.dir
-	stdoutIn, _ := ret.cmd.StdoutPipe()
-	stderrIn, _ := ret.cmd.StderrPipe()
-	if err := ret.cmd.Start(); err != nil {
+	var err error
+	if req.Params, err = th.arguments(req.Params); err != nil {
 		return nil, err
 	}
+	if hctx != nil {
+		req.Context = *hctx
+	}
+	/* The files may be modified after the discovery, verify them again */
+	if err := h.checkPolicy(th, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Trace hook %s is refused: %v\n", th.FullName, err)
+		/* Pick up the refusal in the list of the hooks */
+		go h.Rescan()
+		return nil, fmt.Errorf("Trace hook %s is refused by the hook policy: %v", th.FullName, err)
+	}
 
-	scannerOut := bufio.NewScanner(stdoutIn)
-	scannerErr := bufio.NewScanner(stderrIn)
-	ret.cmdWg.Add(2)
-	go func() {
-		readOutput(scannerOut, &ret.cmdOutLock, &ret.cmdOut)
-		ret.cmdWg.Done()
-	}()
-	go func() {
-		readOutput(scannerErr, &ret.cmdErrLock, &ret.cmdErr)
-		ret.cmdWg.Done()
-	}()
-	return &ret, nil
+	s, err := th.manager.backend.Run(th.Name, &req)
+	if err != nil {
+		return nil, err
+	}
+	s.backend = th.manager.backend
+	s.setOwner(h.resources, req.Context.Session, th.FullName)
+
+	return s, nil
 }
 
 func (h *TraceHooks) Stop(s *Session, wait bool) error {
-	if err := s.cmd.Process.Signal(os.Interrupt); err != nil {
-		return err
-	}
-
+	/* The hook may exit before the tracer starts reading its output, keep the pipe until the stop */
+	defer s.closeOutput()
+	err := s.backend.Stop(s, wait)
 	if wait {
-		s.cmdWg.Wait()
-		if err := s.cmd.Wait(); err != nil {
-			return err
-		}
+		s.releaseResources()
 	}
-
-	return nil
+	return err
 }
 
+/*
+ * Discover all available hooks and replace the current ones. The hooks in use by running sessions
+ * are not affected, as the sessions keep their own references to them.
+ */
 func (h *TraceHooks) discoverHooks() error {
-	/* Reset trace manager database */
-	h.managers = make(map[string]*hookManager)
+	h.scanLock.Lock()
+	defer h.scanLock.Unlock()
+
+	backends := make(map[string]Backend)
+	managers := make(map[string]*hookManager)
+
+	if err := h.reloadPolicy(); err != nil {
+		return err
+	}
 
 	/* Traverse through all subdirectories looking for files with 'managerPrefix' */
-	if e := h.scanManagers(h.topDir); e != nil {
+	if e := h.scanManagers(backends, h.topDir); e != nil {
 		return e
 	}
 
-	/* Walked through all discovered managers and get available trace hooks */
-	for d := range h.managers {
-		if e := h.scanTraceHooks(&d); e != nil {
-			return e
+	/* The backends, compiled in the tracer, take precedence over the managers with the same name */
+	for _, b := range h.backends {
+		for d, o := range backends {
+			if o.Name() == b.Name() {
+				fmt.Fprintf(os.Stderr, "Hook manager in %s is ignored, its name %s is reserved\n", d, o.Name())
+				delete(backends, d)
+			}
 		}
+		backends[b.Name()] = b
 	}
+
+	/* Walk through all discovered backends and get available trace hooks */
+	policy := h.getPolicy()
+	for d, b := range backends {
+		/* Do not run the managers, refused by the policy */
+		if eb, ok := b.(*execBackend); ok {
+			if err := policy.checkManager(eb); err != nil {
+				fmt.Fprintf(os.Stderr, "Hook manager %s is refused: %v\n", eb.name, err)
+				managers[d] = &hookManager{
+					Name:    eb.name,
+					Tracers: make(map[string]*TraceHook),
+					Refused: err.Error(),
+					backend: b,
+				}
+				continue
+			}
+		}
+		if m := h.scanBackend(b); m != nil {
+			managers[d] = m
+		}
+	}
+	for n, q := range duplicateHooks(managers) {
+		fmt.Fprintf(os.Stderr, "Trace hook %s is provided by %s, it must be used with a qualified name\n",
+			n, strings.Join(q, ", "))
+	}
+
+	h.lock.Lock()
+	h.managers = managers
+	h.lock.Unlock()
 	return nil
 }
 
 /* Create a new database with trace hooks in given directory */
 func NewTraceHooksDb(cfg *HookConfig) (*TraceHooks, error) {
 	db := TraceHooks{
-		topDir: cfg.HooksPath,
-		env:    os.Environ(),
+		topDir:       cfg.HooksPath,
+		env:          os.Environ(),
+		running:      make(map[*Session]bool),
+		startTimeout: DefaultStartTimeout,
+		stopTimeout:  DefaultStopTimeout,
+	}
+
+	if cfg.StartTimeout != nil && *cfg.StartTimeout > 0 {
+		db.startTimeout = *cfg.StartTimeout
+	}
+	if cfg.StopTimeout != nil && *cfg.StopTimeout > 0 {
+		db.stopTimeout = *cfg.StopTimeout
+	}
+	if cfg.CpuLimit != nil {
+		db.cpuLimit = *cfg.CpuLimit
+	}
+	if cfg.MemoryLimit != nil {
+		db.memLimit = *cfg.MemoryLimit * 1024 * 1024
+	}
+	if cfg.PolicyFile != nil {
+		db.policyFile = *cfg.PolicyFile
+	}
+	if db.policyFile != "" {
+		if _, found := os.LookupEnv(envNoBytecode); !found {
+			db.env = append(db.env, envNoBytecode+"=1")
+		}
 	}
 
 	/* Pass /proc custom moint point to the trace hook scripts */
@@ -272,6 +549,47 @@ func NewTraceHooksDb(cfg *HookConfig) (*TraceHooks, error) {
 		db.topDir = &DefaultHookPath
 	}
 
+	sysfs := ""
+	if cfg.Sysfs != nil {
+		sysfs = *cfg.Sysfs
+	}
+	db.sysfs = "/sys"
+	if sysfs != "" {
+		db.sysfs = sysfs
+	}
+	db.procfs = "/proc"
+	if cfg.Procfs != nil && *cfg.Procfs != "" {
+		db.procfs = *cfg.Procfs
+	}
+	var err error
+	if cfg.Tracefs != nil && *cfg.Tracefs != "" {
+		db.tracefs, err = openTracefs(*cfg.Tracefs)
+	} else {
+		db.tracefs, err = ftrace.Find(db.procfs, sysfs)
+	}
+	if err != nil {
+		/* Native hooks are not available, but the hooks run by a manager may still work */
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		db.backends = append(db.backends, &nativeBackend{h: &db})
+	}
+	db.backends = append(db.backends, cfg.Backends...)
+
+	stateFile, policy := "", ""
+	if cfg.StateFile != nil {
+		stateFile = *cfg.StateFile
+	}
+	if cfg.OrphanPolicy != nil {
+		policy = *cfg.OrphanPolicy
+	}
+	if db.resources, err = newResourceDb(db.tracefs, stateFile, policy); err != nil {
+		return nil, err
+	}
+	/* Find the resources, left by a crash of the tracer or created by someone else */
+	if err = db.resources.load(); err != nil {
+		return nil, err
+	}
+
 	if e := db.discoverHooks(); e != nil {
 		return nil, e
 	}
@@ -282,15 +600,42 @@ func NewTraceHooksDb(cfg *HookConfig) (*TraceHooks, error) {
 }
 
 func (h *TraceHooks) Get() *map[string]*hookManager {
-	return &h.managers
+	res := make(map[string]*hookManager)
+
+	h.lock.RLock()
+	for d, m := range h.managers {
+		res[d] = m
+	}
+	h.lock.RUnlock()
+
+	return &res
 }
 
-/* Reset all tracing subsystems */
+/*
+ * Clean up the orphaned trace resources, according to the orphan policy. With the remove-all policy,
+ * the backends are reset as well, to remove the leftovers they do not report to the tracer.
+ */
 func (h *TraceHooks) ResetAll() {
-	for d, m := range h.managers {
-		cmd := exec.Command("./"+m.fexec, "--clear")
-		cmd.Env = h.env
-		cmd.Dir = d
-		cmd.Run()
+	if !h.resources.cleanup() {
+		return
 	}
+	policy := h.getPolicy()
+	for _, m := range *h.Get() {
+		if m.Refused != "" {
+			continue
+		}
+		/* The files may be modified after the discovery, verify them again */
+		if b, ok := m.backend.(*execBackend); ok {
+			if err := policy.checkManager(b); err != nil {
+				fmt.Fprintf(os.Stderr, "Hook manager %s is not reset, it is refused: %v\n", m.Name, err)
+				continue
+			}
+		}
+		m.backend.Reset()
+	}
+}
+
+/* Get the kernel trace resources, used by the running sessions, and the orphaned ones */
+func (h *TraceHooks) Resources() []TraceResource {
+	return h.resources.list()
 }
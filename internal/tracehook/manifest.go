@@ -0,0 +1,391 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Optional manifest of trace hooks, describing the hooks and their arguments.
+ */
+package tracehook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	manifestFiles = []string{
+		"manifest.yaml",
+		"manifest.yml",
+		"manifest.json",
+	}
+	schemaVersion = "https://json-schema.org/draft/2020-12/schema"
+
+	/* Arguments, that are set by the tracer and cannot be passed by the user */
+	reservedArgs = []string{
+		"pid",
+		"parent",
+		"instance",
+	}
+
+	ArgString  = "string"
+	ArgInteger = "integer"
+	ArgNumber  = "number"
+	ArgBoolean = "boolean"
+	ArgArray   = "array"
+)
+
+type HookArgument struct {
+	Name        string        `json:"name"`
+	Short       string        `json:"short,omitempty"` /* Optional one letter alias */
+	Type        string        `json:"type"`            /* string, integer, number, boolean or array */
+	Items       string        `json:"items,omitempty"` /* Type of the array items, string by default */
+	Description string        `json:"description,omitempty"`
+	Default     interface{}   `json:"default,omitempty"` /* Passed to the hook, if the argument is not given */
+	Enum        []interface{} `json:"enum,omitempty"`
+	Required    bool          `json:"required,omitempty"`
+}
+
+type HookManifest struct {
+	Name        string         `json:"name"`
+	Version     string         `json:"version,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Arguments   []HookArgument `json:"arguments,omitempty"`
+	Features    []string       `json:"features,omitempty"` /* Kernel features, required by the hook */
+	Format      string         `json:"format,omitempty"`   /* Format of the traces, ftrace by default */
+}
+
+type managerManifest struct {
+	Hooks []HookManifest `json:"hooks"`
+}
+
+/* Load the manifest of the hooks in the given directory, if there is any */
+func loadManifest(dir string) (map[string]*HookManifest, error) {
+	for _, f := range manifestFiles {
+		data, err := os.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			continue
+		}
+		var m managerManifest
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("Broken manifest %s: %v", filepath.Join(dir, f), err)
+		}
+		res := make(map[string]*HookManifest)
+		for i := range m.Hooks {
+			h := &m.Hooks[i]
+			if err := h.check(); err != nil {
+				return nil, fmt.Errorf("Broken manifest %s: %v", filepath.Join(dir, f), err)
+			}
+			res[h.Name] = h
+		}
+		return res, nil
+	}
+
+	return nil, nil
+}
+
+func validType(t string) bool {
+	return t == ArgString || t == ArgInteger || t == ArgNumber || t == ArgBoolean || t == ArgArray
+}
+
+/* Verify that the manifest of a hook is consistent */
+func (m *HookManifest) check() error {
+	if m.Name == "" {
+		return fmt.Errorf("Hook without a name")
+	}
+	switch m.Format {
+	case "", FormatFtrace, FormatFuncgraph, FormatSched, FormatIo:
+	default:
+		return fmt.Errorf("Unsupported trace format %s of hook %s", m.Format, m.Name)
+	}
+	for i := range m.Arguments {
+		a := &m.Arguments[i]
+		if a.Name == "" {
+			return fmt.Errorf("Argument without a name in hook %s", m.Name)
+		}
+		if a.Type == "" {
+			a.Type = ArgString
+		}
+		if a.Type == ArgArray && a.Items == "" {
+			a.Items = ArgString
+		}
+		if !validType(a.Type) || (a.Type == ArgArray && (a.Items == ArgArray || !validType(a.Items))) {
+			return fmt.Errorf("Invalid type of argument %s in hook %s", a.Name, m.Name)
+		}
+		for _, r := range reservedArgs {
+			if a.Name == r {
+				return fmt.Errorf("Argument %s in hook %s is reserved", a.Name, m.Name)
+			}
+		}
+		if err := a.checkDefault(); err != nil {
+			return fmt.Errorf("%v in hook %s", err, m.Name)
+		}
+	}
+
+	return nil
+}
+
+/* Convert a value of the manifest to an argument of the hook. Numbers are decoded as float64 */
+func manifestValue(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+/* Values of the default of an argument, nil if it has no default */
+func (a *HookArgument) defaultValues() []string {
+	if a.Default == nil {
+		return nil
+	}
+	items, ok := a.Default.([]interface{})
+	if !ok {
+		items = []interface{}{a.Default}
+	}
+	res := []string{}
+	for _, v := range items {
+		res = append(res, manifestValue(v))
+	}
+	return res
+}
+
+/* Check the default of an argument against its type */
+func (a *HookArgument) checkDefault() error {
+	if a.Default == nil {
+		return nil
+	}
+	items, list := a.Default.([]interface{})
+	t := a.Type
+	if t == ArgArray {
+		t = a.Items
+		if !list || len(items) < 1 {
+			return fmt.Errorf("Default of argument %s must be a non empty array", a.Name)
+		}
+	} else {
+		if list {
+			return fmt.Errorf("Default of argument %s must be %s", a.Name, t)
+		}
+		items = []interface{}{a.Default}
+	}
+	for _, v := range items {
+		switch v.(type) {
+		case string, float64, int, bool:
+		default:
+			return fmt.Errorf("Default of argument %s must be %s", a.Name, t)
+		}
+		if err := checkValue(a, t, manifestValue(v)); err != nil {
+			return fmt.Errorf("Invalid default of argument %s: %v", a.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *HookManifest) getArgument(name string) *HookArgument {
+	for i := range m.Arguments {
+		if m.Arguments[i].Name == name || (m.Arguments[i].Short != "" && m.Arguments[i].Short == name) {
+			return &m.Arguments[i]
+		}
+	}
+	return nil
+}
+
+/* Describe the arguments of the hook as a JSON Schema of an object */
+func (m *HookManifest) Schema() map[string]interface{} {
+	props := make(map[string]interface{})
+	required := []string{}
+
+	for _, a := range m.Arguments {
+		p := map[string]interface{}{
+			"type": a.Type,
+		}
+		if a.Description != "" {
+			p["description"] = a.Description
+		}
+		if a.Default != nil {
+			p["default"] = a.Default
+		}
+		if len(a.Enum) > 0 {
+			if a.Type == ArgArray {
+				p["items"] = map[string]interface{}{"type": a.Items, "enum": a.Enum}
+			} else {
+				p["enum"] = a.Enum
+			}
+		} else if a.Type == ArgArray {
+			p["items"] = map[string]interface{}{"type": a.Items}
+		}
+		props[a.Name] = p
+		if a.Required {
+			required = append(required, a.Name)
+		}
+	}
+
+	res := map[string]interface{}{
+		"$schema":              schemaVersion,
+		"title":                m.Name,
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	if m.Description != "" {
+		res["description"] = m.Description
+	}
+	if len(required) > 0 {
+		res["required"] = required
+	}
+
+	return res
+}
+
+/* Check a single value against the type of an argument */
+func checkValue(a *HookArgument, t string, val string) error {
+	var err error
+
+	switch t {
+	case ArgInteger:
+		_, err = strconv.ParseInt(val, 0, 64)
+	case ArgNumber:
+		_, err = strconv.ParseFloat(val, 64)
+	case ArgBoolean:
+		_, err = strconv.ParseBool(val)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid value %s of argument %s, must be %s", val, a.Name, t)
+	}
+
+	if len(a.Enum) > 0 {
+		for _, e := range a.Enum {
+			if fmt.Sprint(e) == val {
+				return nil
+			}
+		}
+		return fmt.Errorf("Invalid value %s of argument %s, must be one of %v", val, a.Name, a.Enum)
+	}
+
+	return nil
+}
+
+/* Get the argument, if the given parameter is "--<name>" or "-<short>" of a known argument */
+func (m *HookManifest) paramArgument(param string) *HookArgument {
+	if !strings.HasPrefix(param, "-") {
+		return nil
+	}
+	return m.getArgument(strings.TrimLeft(param, "-"))
+}
+
+/*
+ * Parse the given arguments of a hook, in format "--name value ...", and check their values. The number
+ * of values depends on the type of the argument, so values may start with a dash, i.e. "--filter -foo":
+ * a scalar has exactly one value, a boolean has an optional one and an array takes all values up to
+ * the next known argument.
+ */
+func (m *HookManifest) parseParams(params []string) (map[string][]string, error) {
+	res := make(map[string][]string)
+
+	for i := 0; i < len(params); {
+		a := m.paramArgument(params[i])
+		if a == nil {
+			if !strings.HasPrefix(params[i], "-") {
+				return nil, fmt.Errorf("Unexpected value %s, an argument name is expected", params[i])
+			}
+			return nil, fmt.Errorf("Unknown argument %s of hook %s", params[i], m.Name)
+		}
+		vals := []string{}
+		i++
+		switch a.Type {
+		case ArgBoolean:
+			if i < len(params) && m.paramArgument(params[i]) == nil {
+				vals = append(vals, params[i])
+				i++
+			}
+		case ArgArray:
+			for ; i < len(params) && m.paramArgument(params[i]) == nil; i++ {
+				vals = append(vals, params[i])
+			}
+		default:
+			if i < len(params) {
+				vals = append(vals, params[i])
+				i++
+			}
+		}
+
+		if a.Type == ArgArray && len(vals) < 1 {
+			return nil, fmt.Errorf("Argument %s expects at least one value", a.Name)
+		}
+		if a.Type != ArgArray && a.Type != ArgBoolean && len(vals) != 1 {
+			return nil, fmt.Errorf("Argument %s expects exactly one value", a.Name)
+		}
+		t := a.Type
+		if t == ArgArray {
+			t = a.Items
+		}
+		for _, v := range vals {
+			if err := checkValue(a, t, v); err != nil {
+				return nil, err
+			}
+		}
+		res[a.Name] = append(res[a.Name], vals...)
+	}
+
+	return res, nil
+}
+
+/*
+ * Parse the arguments of a hook, in format "--name value ...", and validate them against its manifest.
+ * The values of each argument are returned by the argument name, the defaults are set for the missing ones.
+ */
+func (m *HookManifest) Parse(params []string) (map[string][]string, error) {
+	res, err := m.parseParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range m.Arguments {
+		if _, ok := res[a.Name]; ok {
+			continue
+		}
+		if d := a.defaultValues(); d != nil {
+			res[a.Name] = d
+		} else if a.Required {
+			return nil, fmt.Errorf("Missing required argument %s of hook %s", a.Name, m.Name)
+		}
+	}
+
+	return res, nil
+}
+
+/*
+ * Validate the arguments of a hook and add the defaults of the missing ones, as the hook receives
+ * them. Boolean arguments are passed without a value if their default is true and skipped if false.
+ */
+func (m *HookManifest) WithDefaults(params []string) ([]string, error) {
+	if _, err := m.Parse(params); err != nil {
+		return nil, err
+	}
+	given, _ := m.parseParams(params)
+	res := append([]string{}, params...)
+
+	for _, a := range m.Arguments {
+		d := a.defaultValues()
+		if _, ok := given[a.Name]; ok || d == nil {
+			continue
+		}
+		if a.Type == ArgBoolean {
+			if on, _ := strconv.ParseBool(d[0]); on {
+				res = append(res, "--"+a.Name)
+			}
+			continue
+		}
+		res = append(append(res, "--"+a.Name), d...)
+	}
+
+	return res, nil
+}
+
+/* Validate the arguments of a hook against its manifest. The arguments are in format "--name value ..." */
+func (m *HookManifest) Validate(params []string) error {
+	_, err := m.Parse(params)
+	return err
+}
@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracehook
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testManifest = `
+hooks:
+  - name: trace
+    version: "1.0"
+    description: Test trace hook
+    format: sched
+    arguments:
+      - name: event
+        short: e
+        type: array
+        description: Events to trace
+        enum: [read, write, open]
+        default: [read, write]
+      - name: time
+        short: t
+        type: integer
+        default: 100
+      - name: ratio
+        type: number
+      - name: verbose
+        type: boolean
+        default: true
+      - name: quiet
+        type: boolean
+        default: false
+      - name: mode
+        enum: [fast, full]
+        required: true
+`
+
+func writeManifest(t *testing.T, data string) string {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manifest.yaml"), []byte(data), 0640))
+	return dir
+}
+
+func TestManifestLoad(t *testing.T) {
+	m, err := loadManifest(t.TempDir())
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+
+	m, err = loadManifest(writeManifest(t, testManifest))
+	assert.Nil(t, err)
+	if assert.Contains(t, m, "trace") {
+		h := m["trace"]
+		assert.Equal(t, FormatSched, h.Format)
+		assert.Equal(t, 6, len(h.Arguments))
+		/* The types are set to their defaults */
+		assert.Equal(t, ArgString, h.Arguments[0].Items)
+		assert.Equal(t, ArgString, h.Arguments[5].Type)
+	}
+
+	for _, b := range []string{
+		"hooks: [",
+		"hooks:\n  - description: no name\n",
+		"hooks:\n  - name: trace\n    format: binary\n",
+		"hooks:\n  - name: trace\n    arguments:\n      - type: string\n",
+		"hooks:\n  - name: trace\n    arguments:\n      - name: x\n        type: object\n",
+		"hooks:\n  - name: trace\n    arguments:\n      - name: x\n        type: array\n        items: array\n",
+		"hooks:\n  - name: trace\n    arguments:\n      - name: pid\n",
+		"hooks:\n  - name: trace\n    arguments:\n      - name: x\n        type: integer\n        default: ten\n",
+		"hooks:\n  - name: trace\n    arguments:\n      - name: x\n        type: integer\n        default: [1]\n",
+		"hooks:\n  - name: trace\n    arguments:\n      - name: x\n        type: array\n        default: []\n",
+		"hooks:\n  - name: trace\n    arguments:\n      - name: x\n        type: array\n        default: a\n",
+		"hooks:\n  - name: trace\n    arguments:\n      - name: x\n        enum: [a, b]\n        default: c\n",
+		"hooks:\n  - name: trace\n    arguments:\n      - name: x\n        default: {a: b}\n",
+	} {
+		_, err := loadManifest(writeManifest(t, b))
+		assert.NotNil(t, err, b)
+	}
+}
+
+func TestManifestParse(t *testing.T) {
+	m, err := loadManifest(writeManifest(t, testManifest))
+	assert.Nil(t, err)
+	h := m["trace"]
+
+	args, err := h.Parse([]string{"-e", "open", "--ratio", "-0.5", "--quiet", "--mode", "fast"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		"event":   {"open"},
+		"ratio":   {"-0.5"},
+		"quiet":   nil,
+		"mode":    {"fast"},
+		"time":    {"100"},
+		"verbose": {"true"},
+	}, args)
+
+	/* The defaults are passed to the hooks, unless the arguments are given */
+	params, err := h.WithDefaults([]string{"--mode", "full", "-t", "5"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"--mode", "full", "-t", "5", "--event", "read", "write", "--verbose"}, params)
+
+	for _, p := range [][]string{
+		{},
+		{"--mode"},
+		{"--mode", "slow"},
+		{"--mode", "fast", "full"},
+		{"--mode", "fast", "--time", "ten"},
+		{"--mode", "fast", "--ratio", "half"},
+		{"--mode", "fast", "--verbose", "yes"},
+		{"--mode", "fast", "--verbose", "true", "false"},
+		{"--mode", "fast", "--event"},
+		{"--mode", "fast", "--event", "read", "close"},
+		{"--mode", "fast", "--unknown", "1"},
+		{"mode", "fast"},
+	} {
+		assert.NotNil(t, h.Validate(p), p)
+		_, err := h.WithDefaults(p)
+		assert.NotNil(t, err, p)
+	}
+	assert.Nil(t, h.Validate([]string{"--mode", "fast", "--verbose", "false", "-e", "read", "open"}))
+}
+
+func TestManifestDashValues(t *testing.T) {
+	m, err := loadManifest(writeManifest(t, `
+hooks:
+  - name: trace
+    arguments:
+      - name: filter
+        short: f
+      - name: args
+        type: array
+      - name: offset
+        type: integer
+      - name: verbose
+        short: v
+        type: boolean
+`))
+	assert.Nil(t, err)
+	h := m["trace"]
+
+	/* The values are told from the arguments by the type, not by a leading dash */
+	args, err := h.Parse([]string{"--filter", "-foo", "--args", "-x", "--y", "-v", "--offset", "-5", "--verbose"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		"filter":  {"-foo"},
+		"args":    {"-x", "--y"},
+		"offset":  {"-5"},
+		"verbose": nil,
+	}, args)
+	args, err = h.Parse([]string{"-v", "false", "-f", "--args", "--args", "-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		"filter":  {"--args"},
+		"args":    {"-1"},
+		"verbose": {"false"},
+	}, args)
+
+	for _, p := range [][]string{
+		{"--filter"},
+		{"--args", "--filter", "a"},
+		{"--verbose", "-x"},
+		{"--offset", "-x"},
+		{"-x"},
+	} {
+		assert.NotNil(t, h.Validate(p), p)
+	}
+}
+
+func TestManifestSchema(t *testing.T) {
+	m, err := loadManifest(writeManifest(t, testManifest))
+	assert.Nil(t, err)
+
+	s := m["trace"].Schema()
+	assert.Equal(t, schemaVersion, s["$schema"])
+	assert.Equal(t, "trace", s["title"])
+	assert.Equal(t, "Test trace hook", s["description"])
+	assert.Equal(t, "object", s["type"])
+	assert.Equal(t, false, s["additionalProperties"])
+	assert.Equal(t, []string{"mode"}, s["required"])
+
+	props := s["properties"].(map[string]interface{})
+	assert.Equal(t, 6, len(props))
+	event := props["event"].(map[string]interface{})
+	assert.Equal(t, ArgArray, event["type"])
+	assert.Equal(t, "Events to trace", event["description"])
+	assert.Equal(t, []interface{}{"read", "write"}, event["default"])
+	assert.Equal(t, map[string]interface{}{"type": ArgString, "enum": []interface{}{"read", "write", "open"}}, event["items"])
+	assert.Equal(t, map[string]interface{}{"type": ArgInteger, "default": float64(100)}, props["time"])
+	assert.Equal(t, map[string]interface{}{"type": ArgNumber}, props["ratio"])
+	assert.Equal(t, map[string]interface{}{"type": ArgString, "enum": []interface{}{"fast", "full"}}, props["mode"])
+
+	/* Without required arguments and description */
+	s = (&HookManifest{Name: "empty"}).Schema()
+	assert.NotContains(t, s, "required")
+	assert.NotContains(t, s, "description")
+	assert.Empty(t, s["properties"])
+}
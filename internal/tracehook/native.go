@@ -0,0 +1,485 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Native trace hooks, implemented in Go and compiled in the tracer. They use the tracefs directly
+ * and do not depend on any external trace helper applications.
+ */
+package tracehook
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmware-labs/container-tracer/internal/ftrace"
+)
+
+var (
+	NativeManager       = "native"
+	instancePrefix      = "kube_"
+	instanceNameLen     = 16 - len(instancePrefix)
+	instanceNameChars   = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	instanceRetries     = 10
+	instanceRemoveTries = 20
+	instanceRemoveDelay = 500 * time.Millisecond
+	pidsCheckDelay      = time.Second
+
+	/* All native hooks, by name */
+	nativeHooks = map[string]nativeHook{
+		"syscalls": &syscallsHook{},
+		"probes":   &probesHook{},
+		"net":      &netHook{},
+		"sched":    &schedHook{},
+		"io":       &ioHook{},
+	}
+)
+
+/* Context of a native hook run */
+type nativeRun struct {
+	hooks   *TraceHooks
+	session *Session
+	tfs     *ftrace.Tracefs
+	inst    *ftrace.Instance
+	procfs  string
+	sysfs   string
+	pids    []int
+	parent  []int /* Parents of the tasks, only their children are traced */
+	args    map[string][]string
+
+	containers []HookContainer /* Traced containers, from the context of the session */
+
+	/* Set by the hook setup */
+	allTasks   bool             /* Do not filter the events by PID, i.e. for events in softirq context */
+	unfiltered *ftrace.Instance /* Instance for the events, that cannot be filtered by PID */
+}
+
+type nativeHook interface {
+	manifest() *HookManifest
+	/* Configure the instance for tracing, returns a function that reverts the configuration */
+	setup(r *nativeRun) (func(), error)
+}
+
+/* Backend of the native hooks */
+type nativeBackend struct {
+	h *TraceHooks
+}
+
+type nativeSession struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	merger   *traceMerger /* Set if the traces of several instances are merged */
+}
+
+/* Merges the traces of several instances, line by line, into the output pipe of the session */
+type traceMerger struct {
+	pipes []*os.File
+	out   *os.File
+	lock  sync.Mutex
+	wg    sync.WaitGroup
+}
+
+/* Build a user description of a native hook from its manifest */
+func describeManifest(m *HookManifest) []string {
+	res := []string{m.Description}
+
+	for _, a := range m.Arguments {
+		n := "--" + a.Name
+		if a.Short != "" {
+			n = "-" + a.Short + ", " + n
+		}
+		res = append(res, fmt.Sprintf("%s : %s", n, a.Description))
+	}
+	return res
+}
+
+func (b *nativeBackend) Name() string {
+	return NativeManager
+}
+
+func (b *nativeBackend) List() ([]string, error) {
+	res := []string{}
+
+	for n, nh := range nativeHooks {
+		if err := nh.manifest().check(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+func (b *nativeBackend) Describe(hook string) (*HookDescription, error) {
+	nh, ok := nativeHooks[hook]
+	if !ok {
+		return nil, fmt.Errorf("Cannot find native hook %s", hook)
+	}
+	man := nh.manifest()
+	return &HookDescription{
+		Description: describeManifest(man),
+		Manifest:    man,
+	}, nil
+}
+
+/* The native hooks depend only on the kernel features, described in their manifests */
+func (b *nativeBackend) Check(hook string) []string {
+	return []string{}
+}
+
+func (h *TraceHooks) createInstance() (*ftrace.Instance, error) {
+	var err error
+
+	for i := 0; i < instanceRetries; i++ {
+		name := []byte(instancePrefix)
+		for j := 0; j < instanceNameLen; j++ {
+			name = append(name, instanceNameChars[rand.Intn(len(instanceNameChars))])
+		}
+		var inst *ftrace.Instance
+		if inst, err = h.tracefs.CreateInstance(string(name)); err == nil {
+			return inst, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Failed to create a trace instance: %v", err)
+}
+
+/* The instance is busy while its trace_pipe is open, retry until the reader closes it */
+func removeInstance(inst *ftrace.Instance) error {
+	var err error
+
+	for i := 0; i < instanceRemoveTries; i++ {
+		if err = inst.Remove(); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(instanceRemoveDelay)
+	}
+
+	return err
+}
+
+/*
+ * Create an instance for the events, that cannot be filtered by PID, i.e. the events in interrupt context.
+ * It is not filtered by the tracer, its traces are merged with the traces of the main instance.
+ */
+func (r *nativeRun) unfilteredInstance() (*ftrace.Instance, error) {
+	if r.unfiltered != nil {
+		return r.unfiltered, nil
+	}
+	inst, err := r.hooks.createInstance()
+	if err != nil {
+		return nil, err
+	}
+	r.session.Own(ResourceInstance, inst.Name)
+	r.unfiltered = inst
+	return inst, nil
+}
+
+/* Remove the instances of a run, that failed with the given error. Failures to remove them are reported too */
+func (r *nativeRun) removeInstances(err error) error {
+	for _, inst := range []*ftrace.Instance{r.inst, r.unfiltered} {
+		if inst == nil {
+			continue
+		}
+		if e := removeInstance(inst); e != nil {
+			err = fmt.Errorf("%v, failed to remove trace instance %s: %v", err, inst.Name, e)
+		}
+	}
+	return err
+}
+
+/* Read the traces of the given instances and write them to the output pipe of the session */
+func (s *Session) mergeTraces(insts ...*ftrace.Instance) (*traceMerger, error) {
+	m := &traceMerger{}
+
+	for _, i := range insts {
+		f, err := i.OpenTracePipe()
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.pipes = append(m.pipes, f)
+	}
+	outRead, outWrite, err := os.Pipe()
+	if err != nil {
+		m.close()
+		return nil, err
+	}
+	m.out = outWrite
+	s.output = outRead
+	s.outputName = fmt.Sprintf("pipe:%d", atomic.AddUint64(&outputSeq, 1))
+	for _, f := range m.pipes {
+		m.wg.Add(1)
+		go m.copy(f)
+	}
+
+	return m, nil
+}
+
+func (m *traceMerger) copy(f *os.File) {
+	defer m.wg.Done()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		m.lock.Lock()
+		_, err := m.out.Write(append(sc.Bytes(), '\n'))
+		m.lock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+/* Close the trace pipes and the output, which unblocks the readers, and wait for them */
+func (m *traceMerger) close() {
+	for _, f := range m.pipes {
+		f.Close()
+	}
+	if m.out != nil {
+		m.out.Close()
+	}
+	m.wg.Wait()
+}
+
+/*
+ * Trace events of the given tasks and their children. The parents of the container tasks are filtered
+ * too, in order to trace the processes they start later in the container, i.e. "kubectl exec" sessions.
+ */
+func startTrace(inst *ftrace.Instance, pids []int) error {
+	if err := inst.SetOption("event-fork", true); err != nil {
+		return err
+	}
+	if err := inst.SetEventPid(pids); err != nil {
+		return err
+	}
+	/* Function tracing is optional, the kernel may be compiled without it */
+	if inst.SetOption("function-fork", true) == nil {
+		inst.SetFtracePid(pids)
+	}
+
+	return inst.TracingOn(true)
+}
+
+/*
+ * Stop tracing and clear the PID filters. The fork options must be disabled before clearing the filters,
+ * otherwise the kernel keeps adding the children of the traced tasks and the instance cannot be removed.
+ */
+func stopTrace(inst *ftrace.Instance) {
+	inst.TracingOn(false)
+	inst.SetOption("event-fork", false)
+	inst.SetOption("function-fork", false)
+	inst.SetEventPid([]int{})
+	inst.SetFtracePid([]int{})
+}
+
+/* Enable the given events, which are available in the kernel. Returns the enabled events, by system */
+func (r *nativeRun) enableEvents(events map[string][]string) (map[string][]string, error) {
+	res := make(map[string][]string)
+
+	for sys, all := range events {
+		avail, err := r.tfs.Events(sys)
+		if err != nil {
+			continue
+		}
+		for _, e := range all {
+			if !containsString(avail, e) {
+				continue
+			}
+			if err := r.inst.EnableEvent(sys, e, true); err != nil {
+				r.disableEvents(res)
+				return nil, err
+			}
+			res[sys] = append(res[sys], e)
+		}
+	}
+
+	return res, nil
+}
+
+func (r *nativeRun) disableEvents(events map[string][]string) {
+	for sys, all := range events {
+		for _, e := range all {
+			r.inst.EnableEvent(sys, e, false)
+		}
+	}
+}
+
+/*
+ * Add a filter, that skips the events of the parents, to the given filter. Only the children of the
+ * parents are interesting.
+ */
+func (r *nativeRun) parentFilter(filter string) string {
+	res := []string{}
+
+	for _, p := range r.parent {
+		res = append(res, fmt.Sprintf("common_pid != %d", p))
+	}
+	if len(res) == 0 {
+		return filter
+	}
+	if filter != "" {
+		return fmt.Sprintf("(%s) && %s", filter, strings.Join(res, " && "))
+	}
+	return strings.Join(res, " && ")
+}
+
+/* Check if at least one of the tasks is still alive */
+func (h *TraceHooks) pidsAlive(pids []int) bool {
+	for _, p := range pids {
+		if _, err := os.Stat(filepath.Join(h.procfs, strconv.Itoa(p))); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+/* Wait until the session is stopped, its time expires or all traced tasks exit. Then clean up */
+func (h *TraceHooks) waitNative(s *Session, run *nativeRun, duration time.Duration, cleanup func()) {
+	var timeout <-chan time.Time
+
+	if duration > 0 {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(pidsCheckDelay)
+	defer ticker.Stop()
+
+	for wait := true; wait; {
+		select {
+		case <-s.native.stop:
+			wait = false
+		case <-timeout:
+			wait = false
+		case <-ticker.C:
+			wait = h.pidsAlive(run.pids)
+		}
+	}
+
+	stopTrace(run.inst)
+	if run.unfiltered != nil {
+		run.unfiltered.TracingOn(false)
+	}
+	cleanup()
+	/* The instances cannot be removed while their trace pipes are open */
+	if s.native.merger != nil {
+		s.native.merger.close()
+	}
+
+	for _, inst := range []*ftrace.Instance{run.inst, run.unfiltered} {
+		if inst == nil {
+			continue
+		}
+		if err := removeInstance(inst); err != nil {
+			s.cmdErrLock.Lock()
+			s.cmdErr = append(s.cmdErr, fmt.Sprintf("Failed to remove trace instance %s: %v", inst.Name, err))
+			s.cmdErrLock.Unlock()
+		}
+	}
+	/* The resources, that are not removed, are kept by the tracer as orphans */
+	s.releaseResources()
+	close(s.native.done)
+}
+
+func (b *nativeBackend) Run(hook string, req *RunRequest) (*Session, error) {
+	h := b.h
+
+	nh, ok := nativeHooks[hook]
+	if !ok {
+		return nil, fmt.Errorf("Cannot find native hook %s", hook)
+	}
+	if h.tracefs == nil {
+		return nil, fmt.Errorf("Tracefs is not available")
+	}
+	man := nh.manifest()
+	args, err := man.Parse(req.Params)
+	if err != nil {
+		return nil, err
+	}
+	var duration time.Duration
+	if t, ok := args["time"]; ok && len(t) > 0 {
+		if ms, err := strconv.Atoi(t[0]); err == nil {
+			duration = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	ret := NewSession(nil)
+	inst, err := h.createInstance()
+	if err != nil {
+		return nil, err
+	}
+	ret.Own(ResourceInstance, inst.Name)
+	run := &nativeRun{
+		hooks:   h,
+		session: ret,
+		tfs:     h.tracefs,
+		inst:    inst,
+		procfs:  h.procfs,
+		sysfs:   h.sysfs,
+		pids:    req.Pids,
+		parent:  req.Parent,
+		args:    args,
+
+		containers: req.Context.Containers,
+	}
+	cleanup, err := nh.setup(run)
+	if err != nil {
+		return nil, run.removeInstances(err)
+	}
+	traced := append(append([]int{}, req.Pids...), req.Parent...)
+	if run.allTasks {
+		err = inst.TracingOn(true)
+	} else {
+		err = startTrace(inst, traced)
+	}
+	ret.native = &nativeSession{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err == nil && run.unfiltered != nil {
+		if err = run.unfiltered.TracingOn(true); err == nil {
+			ret.native.merger, err = ret.mergeTraces(inst, run.unfiltered)
+		}
+	}
+	if err != nil {
+		stopTrace(inst)
+		if run.unfiltered != nil {
+			run.unfiltered.TracingOn(false)
+		}
+		cleanup()
+		return nil, run.removeInstances(err)
+	}
+
+	if ret.native.merger != nil {
+		ret.proto.handle(&hookMessage{Type: MsgOutput, Path: ret.outputName, Format: man.Format, Pipe: true})
+	} else {
+		ret.SetOutput(inst.TracePipe(), man.Format)
+	}
+	ret.SetPids(traced)
+	ret.SetReady()
+	go h.waitNative(ret, run, duration, cleanup)
+
+	return ret, nil
+}
+
+func (b *nativeBackend) Stop(s *Session, wait bool) error {
+	s.native.stopOnce.Do(func() {
+		close(s.native.stop)
+	})
+	if wait {
+		<-s.native.done
+	}
+	return nil
+}
+
+/* The trace instances and dynamic events of the native hooks are reported to the tracer, which removes them */
+func (b *nativeBackend) Reset() {
+}
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Native trace hook for block and file system I/O. The block requests and the file system events are
+ * filtered by PID. The requests complete in interrupt context of any task, so their completions are
+ * recorded unfiltered in a separate instance. The logger pairs the completions with the requests of the
+ * container tasks and drops the rest.
+ */
+package tracehook
+
+import "fmt"
+
+var (
+	blockSystem = "block"
+	ioComplete  = "block_rq_complete"
+	ioEvents    = map[string][]string{
+		blockSystem: {"block_rq_issue"},
+		"ext4":      {"ext4_sync_file_enter", "ext4_sync_file_exit", "ext4_da_write_begin", "ext4_write_begin"},
+		"xfs": {"xfs_file_buffered_read", "xfs_file_buffered_write", "xfs_file_direct_read",
+			"xfs_file_direct_write", "xfs_file_fsync"},
+	}
+)
+
+type ioHook struct{}
+
+func (ih *ioHook) manifest() *HookManifest {
+	return &HookManifest{
+		Name:        "io",
+		Version:     "1.0",
+		Description: "Trace block and file system I/O of given container, for I/O latency analysis",
+		Features:    []string{"tracefs", "events/block/block_rq_issue", "events/block/block_rq_complete"},
+		Format:      FormatIo,
+		Arguments: []HookArgument{
+			{
+				Name:        "block-only",
+				Short:       "b",
+				Type:        ArgBoolean,
+				Description: "Trace only the block requests, without the ext4 and xfs file system events.",
+			},
+			{
+				Name:        "time",
+				Short:       "t",
+				Type:        ArgInteger,
+				Description: "Duration of the trace in milliseconds.",
+			},
+		},
+	}
+}
+
+func (ih *ioHook) setup(r *nativeRun) (func(), error) {
+	events := ioEvents
+	if b, ok := r.args["block-only"]; ok && (len(b) == 0 || b[0] == "true") {
+		events = map[string][]string{blockSystem: ioEvents[blockSystem]}
+	}
+
+	enabled, err := r.enableEvents(events)
+	if err != nil {
+		return nil, err
+	}
+	avail, _ := r.tfs.Events(blockSystem)
+	if len(enabled[blockSystem]) != len(ioEvents[blockSystem]) || !containsString(avail, ioComplete) {
+		r.disableEvents(enabled)
+		return nil, fmt.Errorf("Block request events are not available")
+	}
+
+	/* The completions are not filtered, most of them are of other tasks */
+	inst, err := r.unfilteredInstance()
+	if err == nil {
+		err = inst.EnableEvent(blockSystem, ioComplete, true)
+	}
+	if err != nil {
+		r.disableEvents(enabled)
+		return nil, err
+	}
+
+	return func() {
+		r.disableEvents(enabled)
+		inst.EnableEvent(blockSystem, ioComplete, false)
+	}, nil
+}
@@ -0,0 +1,305 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Native trace hook for the network stack events of a container network name space. Most of the
+ * network work is done in softirq context, so the events cannot be filtered by PID. All events are
+ * filtered in the kernel: the device events by the host side devices of the container, the socket
+ * events by the network name space of the socket.
+ */
+package tracehook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vmware-labs/container-tracer/internal/pods"
+)
+
+var (
+	/* Events, filtered in the kernel by the network device */
+	netDevEvents = map[string][]string{
+		"net": {"net_dev_queue", "net_dev_xmit", "netif_receive_skb"},
+	}
+	/*
+	 * Socket events, filtered in the kernel by the network name space of the socket. The tracepoints
+	 * have no name space field, it is fetched by a tracepoint probe from the "sk" tracepoint argument.
+	 */
+	netSockEvents = map[string][]string{
+		"tcp":  {"tcp_retransmit_skb", "tcp_retransmit_synack", "tcp_probe", "tcp_send_reset", "tcp_receive_reset"},
+		"sock": {"inet_sock_set_state"},
+	}
+	netSockArgs = []string{
+		"netns=sk->__sk_common.skc_net.net->ns.inum",
+		"state=sk->__sk_common.skc_state",
+		"sport=sk->__sk_common.skc_num",
+		"saddr=sk->__sk_common.skc_rcv_saddr:x32",
+		"daddr=sk->__sk_common.skc_daddr:x32",
+	}
+	netDevField = "name"
+	netNsField  = "netns"
+	hostPid     = 1
+)
+
+type netHook struct{}
+
+/* Network name spaces and devices of a container */
+type netScope struct {
+	namespaces []int    /* Inodes of the network name spaces */
+	devices    []string /* Host side devices, i.e. the veth peers of the container devices */
+}
+
+func (nh *netHook) manifest() *HookManifest {
+	return &HookManifest{
+		Name:        "net",
+		Version:     "1.0",
+		Description: "Trace network stack events in the network name space of given container",
+		Features:    []string{"tracefs", "events/net", "events/tcp"},
+		Arguments: []HookArgument{
+			{
+				Name:        "event",
+				Short:       "e",
+				Type:        ArgArray,
+				Items:       ArgString,
+				Description: "List of events to be traced, i.e. tcp_retransmit_skb. If no events are specified, all supported are traced.",
+			},
+			{
+				Name:        "time",
+				Short:       "t",
+				Type:        ArgInteger,
+				Description: "Duration of the trace in milliseconds.",
+			},
+		},
+	}
+}
+
+func readInt(file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+/* Get host network devices by their index */
+func hostDevices(sysfs string) map[int]string {
+	res := make(map[int]string)
+
+	dir, err := os.ReadDir(filepath.Join(sysfs, "class/net"))
+	if err != nil {
+		return res
+	}
+	for _, d := range dir {
+		if i, err := readInt(filepath.Join(sysfs, "class/net", d.Name(), "ifindex")); err == nil {
+			res[i] = d.Name()
+		}
+	}
+	return res
+}
+
+/*
+ * Find the host side peers of the container devices. The iflink of a veth device is the index of its
+ * peer, the sysfs of the container is used to read it, as it shows the container network name space.
+ */
+func (r *nativeRun) containerDevices(pid int) []string {
+	res := []string{}
+
+	sys := filepath.Join(r.procfs, strconv.Itoa(pid), "root/sys/class/net")
+	dir, err := os.ReadDir(sys)
+	if err != nil {
+		return res
+	}
+	host := hostDevices(r.sysfs)
+	for _, d := range dir {
+		idx, err := readInt(filepath.Join(sys, d.Name(), "ifindex"))
+		if err != nil {
+			continue
+		}
+		link, err := readInt(filepath.Join(sys, d.Name(), "iflink"))
+		if err != nil || link == idx {
+			continue
+		}
+		if n, ok := host[link]; ok {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+/*
+ * Get the network name spaces of the containers and their devices. The name spaces are passed in the
+ * context of the session, or are looked up by the traced tasks. The tasks must not be in the host name space.
+ */
+func (r *nativeRun) netScope() (*netScope, error) {
+	res := &netScope{
+		namespaces: []int{},
+		devices:    []string{},
+	}
+	host, _ := pods.NamespaceInode(r.procfs, hostPid, "net")
+	wanted := make(map[int]bool)
+	for _, c := range r.containers {
+		if ns, ok := c.Namespaces["net"]; ok && ns != 0 {
+			wanted[ns] = true
+		}
+	}
+
+	seen := make(map[int]bool)
+	for _, p := range r.pids {
+		ns, err := pods.NamespaceInode(r.procfs, p, "net")
+		if err != nil || seen[ns] || (len(wanted) > 0 && !wanted[ns]) {
+			continue
+		}
+		seen[ns] = true
+		res.namespaces = append(res.namespaces, ns)
+		res.devices = append(res.devices, r.containerDevices(p)...)
+	}
+	/* The tasks may be gone, the name spaces are still known from the context */
+	for ns := range wanted {
+		if !seen[ns] {
+			res.namespaces = append(res.namespaces, ns)
+		}
+	}
+	if len(res.namespaces) == 0 {
+		return nil, fmt.Errorf("Cannot find the network name space of the container")
+	}
+	for _, ns := range res.namespaces {
+		if ns == host {
+			return nil, fmt.Errorf("The container is in the host network name space, its events cannot be separated")
+		}
+	}
+
+	return res, nil
+}
+
+/* Get the available events of the given trace systems. If events are requested, only they are returned */
+func (r *nativeRun) netEvents(systems map[string][]string, found map[string]bool) map[string][]string {
+	res := make(map[string][]string)
+	want := r.args["event"]
+
+	for sys, events := range systems {
+		avail, err := r.tfs.Events(sys)
+		if err != nil {
+			continue
+		}
+		for _, e := range events {
+			if len(want) > 0 && !containsString(want, e) {
+				continue
+			}
+			if containsString(avail, e) {
+				res[sys] = append(res[sys], e)
+				found[e] = true
+			}
+		}
+	}
+
+	return res
+}
+
+func containsString(arr []string, val string) bool {
+	for _, a := range arr {
+		if a == val {
+			return true
+		}
+	}
+	return false
+}
+
+func (nh *netHook) setup(r *nativeRun) (func(), error) {
+	scope, err := r.netScope()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	devEvents := r.netEvents(netDevEvents, found)
+	sockEvents := r.netEvents(netSockEvents, found)
+	requested := len(r.args["event"]) > 0
+	for _, e := range r.args["event"] {
+		if !found[e] {
+			return nil, fmt.Errorf("Event %s is not supported or not available in the system", e)
+		}
+	}
+
+	group := r.inst.Name
+	enabled := make(map[string][]string)
+	probes := []string{}
+	cleanup := func() {
+		for sys, events := range enabled {
+			for _, e := range events {
+				r.inst.EnableEvent(sys, e, false)
+				r.inst.ClearFilter(sys, e)
+			}
+		}
+		for _, e := range probes {
+			r.tfs.RemoveDynamicEvent(group + "/" + e)
+		}
+	}
+	enable := func(sys, e, filter string) error {
+		if filter != "" {
+			if err := r.inst.SetFilter(sys, e, filter); err != nil {
+				return err
+			}
+		}
+		enabled[sys] = append(enabled[sys], e)
+		return r.inst.EnableEvent(sys, e, true)
+	}
+
+	/* Device events of the container are filtered by its host side devices */
+	if len(scope.devices) == 0 && requested && len(devEvents) > 0 {
+		return nil, fmt.Errorf("Cannot find the host side network devices of the container")
+	}
+	if len(scope.devices) > 0 {
+		f := []string{}
+		for _, d := range scope.devices {
+			f = append(f, fmt.Sprintf("%s == \"%s\"", netDevField, d))
+		}
+		for sys, events := range devEvents {
+			for _, e := range events {
+				if err := enable(sys, e, strings.Join(f, " || ")); err != nil {
+					cleanup()
+					return nil, err
+				}
+			}
+		}
+	}
+
+	/* Socket events are traced by tracepoint probes in the group of the instance, filtered by name space */
+	f := []string{}
+	for _, ns := range scope.namespaces {
+		f = append(f, fmt.Sprintf("%s == %d", netNsField, ns))
+	}
+	skipped := []string{}
+	for _, events := range sockEvents {
+		for _, e := range events {
+			def := fmt.Sprintf("t:%s/%s %s %s", group, e, e, strings.Join(netSockArgs, " "))
+			if err := r.tfs.AddDynamicEvent(def); err != nil {
+				/* The kernel does not support tracepoint probes with BTF arguments */
+				if requested {
+					cleanup()
+					return nil, fmt.Errorf("Event %s cannot be filtered by the network name space: %v", e, err)
+				}
+				skipped = append(skipped, e)
+				continue
+			}
+			r.session.Own(ResourceDynamicEvent, group+"/"+e)
+			probes = append(probes, e)
+			if err := enable(group, e, strings.Join(f, " || ")); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+	}
+	if len(enabled) == 0 {
+		cleanup()
+		return nil, fmt.Errorf("No network events are available")
+	}
+	if len(skipped) > 0 {
+		r.session.Warning(fmt.Sprintf("Events %s cannot be filtered by the network name space and are not traced",
+			strings.Join(skipped, ", ")))
+	}
+
+	r.allTasks = true
+	return cleanup, nil
+}
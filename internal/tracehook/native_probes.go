@@ -0,0 +1,303 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Native trace hook for dynamic kernel and user space probes. The probes are created through the
+ * tracefs dynamic_events in a group, named as the trace instance of the session, and are removed
+ * when the session stops.
+ */
+package tracehook
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	probeKinds = []struct {
+		arg  string /* Name of the hook argument */
+		cmd  string /* Type of the dynamic event, p for probes and r for return probes */
+		user bool   /* Probe in a user space binary */
+	}{
+		{"kprobe", "p", false},
+		{"kretprobe", "r", false},
+		{"uprobe", "p", true},
+		{"uretprobe", "r", true},
+	}
+	probeNameLen = 32
+	maxSymlinks  = 40 /* As the kernel, when resolving a path */
+)
+
+type probesHook struct{}
+
+func (ph *probesHook) manifest() *HookManifest {
+	return &HookManifest{
+		Name:        "probes",
+		Version:     "1.0",
+		Description: "Trace dynamic kernel and user space probes in given container",
+		Features:    []string{"tracefs", "dynamic_events"},
+		Arguments: []HookArgument{
+			{
+				Name:        "kprobe",
+				Short:       "k",
+				Type:        ArgArray,
+				Items:       ArgString,
+				Description: "List of kernel probes, as \"SYMBOL[+OFFSET] [FETCHARGS]\", i.e. \"do_sys_openat2 dfd=%di:s32\".",
+			},
+			{
+				Name:        "kretprobe",
+				Short:       "r",
+				Type:        ArgArray,
+				Items:       ArgString,
+				Description: "List of kernel return probes, as \"SYMBOL [FETCHARGS]\", i.e. \"do_sys_openat2 ret=$retval\".",
+			},
+			{
+				Name:        "uprobe",
+				Short:       "u",
+				Type:        ArgArray,
+				Items:       ArgString,
+				Description: "List of user space probes, as \"PATH:SYMBOL[+OFFSET] [FETCHARGS]\" or \"PATH:0xOFFSET [FETCHARGS]\". The path is inside the container.",
+			},
+			{
+				Name:        "uretprobe",
+				Type:        ArgArray,
+				Items:       ArgString,
+				Description: "List of user space return probes, as \"PATH:SYMBOL [FETCHARGS]\". The path is inside the container.",
+			},
+			{
+				Name:        "filter",
+				Short:       "f",
+				Type:        ArgString,
+				Description: "ftrace filter expression, applied to all probes.",
+			},
+			{
+				Name:        "time",
+				Short:       "t",
+				Type:        ArgInteger,
+				Description: "Duration of the trace in milliseconds.",
+			},
+		},
+	}
+}
+
+/* Event names can have only alphanumeric characters and underscores */
+func probeName(kind, target string, idx int) string {
+	n := []byte{}
+	for _, c := range []byte(target) {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			n = append(n, c)
+		} else {
+			n = append(n, '_')
+		}
+		if len(n) >= probeNameLen {
+			break
+		}
+	}
+	return fmt.Sprintf("%s_%s_%d", kind, n, idx)
+}
+
+/* Convert the address of a function in an ELF file to the file offset, as expected by uprobes */
+func elfSymbolOffset(file, symbol string) (uint64, error) {
+	f, err := elf.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	syms, _ := f.Symbols()
+	if dyn, err := f.DynamicSymbols(); err == nil {
+		syms = append(syms, dyn...)
+	}
+	for _, s := range syms {
+		if s.Name != symbol || elf.ST_TYPE(s.Info) != elf.STT_FUNC || s.Value == 0 {
+			continue
+		}
+		for _, p := range f.Progs {
+			if p.Type == elf.PT_LOAD && (p.Flags&elf.PF_X) != 0 &&
+				s.Value >= p.Vaddr && s.Value < p.Vaddr+p.Memsz {
+				return s.Value - p.Vaddr + p.Off, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("Cannot find function %s in %s", symbol, file)
+}
+
+/*
+ * Resolve a path in the given root file system, as a task with that root sees it. The symbolic links are
+ * followed inside the root, an absolute link or ".." must not resolve to a file of the host.
+ */
+func resolveInRoot(root, path string) (string, error) {
+	res := "/"
+	rest := strings.Split(path, "/")
+	links := 0
+
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			res = filepath.Dir(res)
+			continue
+		}
+		next := filepath.Join(res, c)
+		st, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if st.Mode()&os.ModeSymlink == 0 {
+			res = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("Too many symbolic links in %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			res = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+
+	return filepath.Join(root, res), nil
+}
+
+/* Find the binary in the root file system of one of the traced tasks */
+func (r *nativeRun) containerPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("Path %s must be absolute", path)
+	}
+	for _, p := range r.pids {
+		hp, err := resolveInRoot(filepath.Join(r.procfs, strconv.Itoa(p), "root"), path)
+		if err != nil {
+			continue
+		}
+		if f, err := elf.Open(hp); err == nil {
+			f.Close()
+			return hp, nil
+		}
+	}
+
+	return "", fmt.Errorf("Cannot find ELF binary %s in the container", path)
+}
+
+/* Resolve "PATH:SYMBOL[+OFFSET]" or "PATH:0xOFFSET" to the host path and the file offset */
+func (r *nativeRun) resolveUprobe(target string) (string, uint64, error) {
+	i := strings.LastIndex(target, ":")
+	if i < 1 || i == len(target)-1 {
+		return "", 0, fmt.Errorf("Invalid user space probe %s, must be PATH:SYMBOL or PATH:0xOFFSET", target)
+	}
+	path, sym := target[:i], target[i+1:]
+	hp, err := r.containerPath(path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if strings.HasPrefix(sym, "0x") {
+		off, err := strconv.ParseUint(sym[2:], 16, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("Invalid offset %s of user space probe", sym)
+		}
+		return hp, off, nil
+	}
+
+	var add uint64
+	if j := strings.Index(sym, "+"); j > 0 {
+		if add, err = strconv.ParseUint(sym[j+1:], 0, 64); err != nil {
+			return "", 0, fmt.Errorf("Invalid offset %s of user space probe", sym[j+1:])
+		}
+		sym = sym[:j]
+	}
+	off, err := elfSymbolOffset(hp, sym)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hp, off + add, nil
+}
+
+/* Build the definition of a dynamic event from a probe, given by the user */
+func (r *nativeRun) probeDefinition(cmd string, user bool, spec string, idx int) (string, string, error) {
+	if strings.ContainsAny(spec, "\n\r") {
+		return "", "", fmt.Errorf("Invalid probe %s", spec)
+	}
+	words := strings.Fields(spec)
+	if len(words) < 1 || strings.HasPrefix(words[0], "-") {
+		return "", "", fmt.Errorf("Invalid probe %s", spec)
+	}
+
+	target := words[0]
+	name := probeName(cmd, target, idx)
+	if user {
+		path, off, err := r.resolveUprobe(target)
+		if err != nil {
+			return "", "", err
+		}
+		name = probeName(cmd, filepath.Base(target), idx)
+		target = fmt.Sprintf("%s:0x%x", path, off)
+	}
+	def := fmt.Sprintf("%s:%s/%s %s", cmd, r.inst.Name, name, target)
+	if len(words) > 1 {
+		def += " " + strings.Join(words[1:], " ")
+	}
+
+	return name, def, nil
+}
+
+func (ph *probesHook) setup(r *nativeRun) (func(), error) {
+	group := r.inst.Name
+	events := []string{}
+	filter := r.parentFilter(strings.Join(r.args["filter"], " "))
+
+	cleanup := func() {
+		r.inst.EnableEvent(group, "", false)
+		if filter != "" {
+			r.inst.ClearFilter(group, "")
+		}
+		for _, e := range events {
+			r.tfs.RemoveDynamicEvent(group + "/" + e)
+		}
+	}
+
+	idx := 0
+	for _, k := range probeKinds {
+		for _, spec := range r.args[k.arg] {
+			name, def, err := r.probeDefinition(k.cmd, k.user, spec, idx)
+			if err == nil {
+				err = r.tfs.AddDynamicEvent(def)
+			}
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+			r.session.Own(ResourceDynamicEvent, group+"/"+name)
+			events = append(events, name)
+			idx++
+		}
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("No probes are specified")
+	}
+
+	if filter != "" {
+		if err := r.inst.SetFilter(group, "", filter); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	if err := r.inst.EnableEvent(group, "", true); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	return cleanup, nil
+}
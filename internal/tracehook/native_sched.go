@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Native trace hook for the scheduler events of the container tasks. The events are analyzed by the
+ * logger for run queue latency, off-CPU time and block reasons.
+ */
+package tracehook
+
+import "fmt"
+
+var (
+	schedSystem = "sched"
+	schedEvents = []string{
+		"sched_switch",
+		"sched_wakeup",
+		"sched_wakeup_new",
+		"sched_process_fork",
+		"sched_process_exec",
+		"sched_process_exit",
+	}
+	/* The logger cannot analyze the scheduling without these */
+	schedRequired = []string{
+		"sched_switch",
+		"sched_wakeup",
+	}
+)
+
+type schedHook struct{}
+
+func (sh *schedHook) manifest() *HookManifest {
+	return &HookManifest{
+		Name:        "sched",
+		Version:     "1.0",
+		Description: "Trace scheduling of given container, for run queue latency and off-CPU analysis",
+		Features:    []string{"tracefs", "events/sched/sched_switch", "events/sched/sched_wakeup"},
+		Format:      FormatSched,
+		Arguments: []HookArgument{
+			{
+				Name:        "time",
+				Short:       "t",
+				Type:        ArgInteger,
+				Description: "Duration of the trace in milliseconds.",
+			},
+		},
+	}
+}
+
+func (sh *schedHook) setup(r *nativeRun) (func(), error) {
+	/* Older kernels may not have some of the events, the switch and the wakeup are mandatory */
+	enabled, err := r.enableEvents(map[string][]string{schedSystem: schedEvents})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range schedRequired {
+		if !containsString(enabled[schedSystem], e) {
+			r.disableEvents(enabled)
+			return nil, fmt.Errorf("Scheduler event %s is not available", e)
+		}
+	}
+
+	return func() { r.disableEvents(enabled) }, nil
+}
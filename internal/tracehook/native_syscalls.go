@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Native trace hook for system calls, the Go implementation of trace-hooks/ftrace/trace_syscalls.
+ */
+package tracehook
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	syscallsSystem = "syscalls"
+	syscallsEnter  = "sys_enter_"
+)
+
+type syscallsHook struct{}
+
+func (sh *syscallsHook) manifest() *HookManifest {
+	return &HookManifest{
+		Name:        "syscalls",
+		Version:     "1.0",
+		Description: "Trace system calls, used by given container",
+		Features:    []string{"tracefs", "events/syscalls"},
+		Arguments: []HookArgument{
+			{
+				Name:        "syscall",
+				Short:       "s",
+				Type:        ArgArray,
+				Items:       ArgString,
+				Description: "List of system call names to be traced. If no system calls are specified, all available are traced.",
+			},
+			{
+				Name:        "filter",
+				Short:       "f",
+				Type:        ArgString,
+				Description: "ftrace filter expression, applied to the traced system calls, i.e. \"ret < 0\".",
+			},
+			{
+				Name:        "time",
+				Short:       "t",
+				Type:        ArgInteger,
+				Description: "Duration of the trace in milliseconds.",
+			},
+		},
+	}
+}
+
+func (sh *syscallsHook) setup(r *nativeRun) (func(), error) {
+	inst, args := r.inst, r.args
+	events := []string{}
+
+	if len(args["syscall"]) > 0 {
+		all, err := r.tfs.Events(syscallsSystem)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range args["syscall"] {
+			found := false
+			for _, e := range all {
+				if e == s || e == syscallsEnter+s {
+					events = append(events, e)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("Event %s is not available in the system", s)
+			}
+		}
+	}
+
+	cleanup := func() {
+		if len(events) > 0 {
+			for _, e := range events {
+				inst.EnableEvent(syscallsSystem, e, false)
+			}
+		} else {
+			inst.EnableEvent(syscallsSystem, "", false)
+		}
+		inst.ClearFilter(syscallsSystem, "")
+	}
+
+	if f := r.parentFilter(strings.Join(args["filter"], " ")); f != "" {
+		if err := inst.SetFilter(syscallsSystem, "", f); err != nil {
+			return nil, err
+		}
+	}
+	if len(events) > 0 {
+		for _, e := range events {
+			if err := inst.EnableEvent(syscallsSystem, e, true); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+	} else if err := inst.EnableEvent(syscallsSystem, "", true); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	return cleanup, nil
+}
@@ -0,0 +1,416 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracehook
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware-labs/container-tracer/internal/ftrace"
+)
+
+/* The tests use plain directories as a tracefs */
+func init() {
+	openTracefs = ftrace.NewFake
+}
+
+/* Create a hooks database with no hook managers and a fake tracefs */
+func fakeHooksDb(t *testing.T) (*TraceHooks, string) {
+	hooks := t.TempDir()
+	tracefs := t.TempDir()
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(tracefs, "instances"), 0750))
+	for _, e := range []string{"sys_enter_openat", "sys_enter_read"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(tracefs, "events/syscalls", e), 0750))
+	}
+
+	db, err := NewTraceHooksDb(&HookConfig{
+		HooksPath: &hooks,
+		Tracefs:   &tracefs,
+	})
+	assert.Nil(t, err)
+	return db, tracefs
+}
+
+func readFile(t *testing.T, file string) string {
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func instances(t *testing.T, tracefs string) []string {
+	res := []string{}
+	dir, err := os.ReadDir(filepath.Join(tracefs, "instances"))
+	assert.Nil(t, err)
+	for _, d := range dir {
+		res = append(res, d.Name())
+	}
+	return res
+}
+
+func atoi(t *testing.T, s string) int {
+	i, err := strconv.Atoi(s)
+	assert.Nil(t, err)
+	return i
+}
+
+func TestNativeSyscalls(t *testing.T) {
+	db, tracefs := fakeHooksDb(t)
+
+	name := "syscalls"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	assert.NotNil(t, th.Schema)
+
+	pids := []int{os.Getpid()}
+	params := []string{"--syscall", "unknown"}
+	_, err = db.Run(th, &pids, nil, &params, nil)
+	assert.NotNil(t, err)
+
+	params = []string{"-s", "openat", "--filter", "ret < 0"}
+	s, err := db.Run(th, &pids, nil, &params, nil)
+	assert.Nil(t, err)
+	out, _ := s.GetOutput()
+	assert.Equal(t, 1, len(*out))
+
+	inst := filepath.Dir((*out)[0])
+	assert.Equal(t, filepath.Join(tracefs, "instances"), filepath.Dir(inst))
+	assert.Equal(t, "1", readFile(t, filepath.Join(inst, "tracing_on")))
+	assert.Equal(t, "1", readFile(t, filepath.Join(inst, "options/event-fork")))
+	assert.Equal(t, "1", readFile(t, filepath.Join(inst, "events/syscalls/sys_enter_openat/enable")))
+	assert.Equal(t, "ret < 0", readFile(t, filepath.Join(inst, "events/syscalls/filter")))
+	assert.Equal(t, pids[0], atoi(t, readFile(t, filepath.Join(inst, "set_event_pid"))))
+
+	assert.Nil(t, db.Stop(s, true))
+	assert.Nil(t, db.Stop(s, true))
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(inst)
+		return os.IsNotExist(err)
+	}, 2*instanceRemoveDelay, instanceRemoveDelay/10)
+}
+
+func TestNativeParent(t *testing.T) {
+	db, tracefs := fakeHooksDb(t)
+
+	name := "syscalls"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+
+	pids := []int{os.Getpid()}
+	parent := []int{os.Getppid()}
+	params := []string{"-s", "openat", "--filter", "ret < 0"}
+	s, err := db.Run(th, &pids, &parent, &params, nil)
+	assert.Nil(t, err)
+	out, _ := s.GetOutput()
+	inst := filepath.Dir((*out)[0])
+	assert.Equal(t, filepath.Join(tracefs, "instances"), filepath.Dir(inst))
+	assert.Equal(t, fmt.Sprintf("%d %d", pids[0], parent[0]), readFile(t, filepath.Join(inst, "set_event_pid")))
+	assert.Equal(t, fmt.Sprintf("(ret < 0) && common_pid != %d", parent[0]),
+		readFile(t, filepath.Join(inst, "events/syscalls/filter")))
+	assert.ElementsMatch(t, append(pids, parent...), s.Status().Pids)
+
+	assert.Nil(t, db.Stop(s, true))
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(inst)
+		return os.IsNotExist(err)
+	}, 2*instanceRemoveDelay, instanceRemoveDelay/10)
+}
+
+func TestInstanceLifecycle(t *testing.T) {
+	db, _ := fakeHooksDb(t)
+
+	inst, err := db.createInstance()
+	assert.Nil(t, err)
+	assert.Nil(t, startTrace(inst, []int{1, 2}))
+	assert.Equal(t, "1", readFile(t, filepath.Join(inst.Dir, "options/event-fork")))
+	assert.Equal(t, "1", readFile(t, filepath.Join(inst.Dir, "options/function-fork")))
+	assert.Equal(t, "1 2", readFile(t, filepath.Join(inst.Dir, "set_event_pid")))
+	assert.Equal(t, "1 2", readFile(t, filepath.Join(inst.Dir, "set_ftrace_pid")))
+	assert.True(t, inst.IsTracingOn())
+
+	/* The fork options must be cleared, before the instance is removed */
+	stopTrace(inst)
+	assert.False(t, inst.IsTracingOn())
+	assert.Equal(t, "0", readFile(t, filepath.Join(inst.Dir, "options/event-fork")))
+	assert.Equal(t, "0", readFile(t, filepath.Join(inst.Dir, "options/function-fork")))
+	assert.Equal(t, "", readFile(t, filepath.Join(inst.Dir, "set_event_pid")))
+	assert.Equal(t, "", readFile(t, filepath.Join(inst.Dir, "set_ftrace_pid")))
+
+	assert.Nil(t, removeInstance(inst))
+	_, err = os.Stat(inst.Dir)
+	assert.True(t, os.IsNotExist(err))
+	/* Removing an already removed instance is not an error */
+	assert.Nil(t, removeInstance(inst))
+}
+
+func TestNativeProbes(t *testing.T) {
+	db, tracefs := fakeHooksDb(t)
+
+	name := "probes"
+	_, err := db.GetHook(&name)
+	assert.NotNil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(tracefs, "dynamic_events"), []byte{}, 0640))
+	_, err = db.Rescan()
+	assert.Nil(t, err)
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+
+	pids := []int{os.Getpid()}
+	params := []string{}
+	_, err = db.Run(th, &pids, nil, &params, nil)
+	assert.NotNil(t, err)
+	params = []string{"--uprobe", "/no/such/binary:main"}
+	_, err = db.Run(th, &pids, nil, &params, nil)
+	assert.NotNil(t, err)
+
+	/* The C library is the user space binary, traced in the container of the test process */
+	libs, _ := filepath.Glob("/usr/lib*/*/libc.so.6")
+	if len(libs) == 0 {
+		t.Skip("C library is not found")
+	}
+	exe := libs[0]
+	params = []string{"--kprobe", "do_sys_openat2 dfd=%di", "--uretprobe", exe + ":malloc ret=$retval"}
+	s, err := db.Run(th, &pids, nil, &params, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	out, _ := s.GetOutput()
+	inst := filepath.Base(filepath.Dir((*out)[0]))
+
+	events, err := db.tracefs.DynamicEvents(inst)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	defs := readFile(t, filepath.Join(tracefs, "dynamic_events"))
+	assert.Contains(t, defs, "p:"+inst+"/p_do_sys_openat2_0 do_sys_openat2 dfd=%di")
+	assert.Contains(t, defs, "r:"+inst+"/r_libc_so_6_malloc_1 ")
+	/* The links are resolved in the root of the container */
+	real, err := filepath.EvalSymlinks(exe)
+	assert.Nil(t, err)
+	assert.Contains(t, defs, filepath.Join("/proc", strconv.Itoa(pids[0]), "root", real)+":0x")
+	assert.Equal(t, "1", readFile(t, filepath.Join(tracefs, "instances", inst, "events", inst, "enable")))
+
+	assert.Nil(t, db.Stop(s, true))
+	events, err = db.tracefs.DynamicEvents(inst)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(events))
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "usr/bin"), 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "usr/bin/busybox"), []byte{}, 0750))
+	assert.Nil(t, os.Symlink("usr/bin", filepath.Join(root, "bin")))
+	assert.Nil(t, os.Symlink("/usr/bin/busybox", filepath.Join(root, "usr/bin/sh")))
+	assert.Nil(t, os.Symlink("../../../../../../etc/hostname", filepath.Join(root, "usr/bin/up")))
+	assert.Nil(t, os.Symlink("/etc/hostname", filepath.Join(root, "usr/bin/abs")))
+	assert.Nil(t, os.Symlink("loop", filepath.Join(root, "loop")))
+
+	for path, res := range map[string]string{
+		"/bin/sh":           "usr/bin/busybox",
+		"/bin/../bin/./sh":  "usr/bin/busybox",
+		"/../../usr/bin/sh": "usr/bin/busybox",
+		"/usr/bin/busybox":  "usr/bin/busybox",
+		"/usr/bin/up":       "",
+		"/usr/bin/abs":      "",
+		"/loop":             "",
+		"/no/such/file":     "",
+	} {
+		hp, err := resolveInRoot(root, path)
+		if res == "" {
+			/* The links must not escape to the files of the host */
+			assert.NotNil(t, err, path)
+			continue
+		}
+		assert.Nil(t, err, path)
+		assert.Equal(t, filepath.Join(root, res), hp, path)
+	}
+}
+
+func TestNativeSched(t *testing.T) {
+	db, tracefs := fakeHooksDb(t)
+
+	name := "sched"
+	_, err := db.GetHook(&name)
+	assert.NotNil(t, err)
+	for _, e := range []string{"sched_switch", "sched_wakeup", "sched_process_exit"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(tracefs, "events/sched", e), 0750))
+	}
+	_, err = db.Rescan()
+	assert.Nil(t, err)
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatSched, th.Format)
+
+	pids := []int{os.Getpid()}
+	params := []string{}
+	s, err := db.Run(th, &pids, nil, &params, nil)
+	assert.Nil(t, err)
+	path, format := s.TraceFile()
+	assert.Equal(t, FormatSched, format)
+
+	inst := filepath.Dir(path)
+	assert.Equal(t, "1", readFile(t, filepath.Join(inst, "events/sched/sched_switch/enable")))
+	assert.Equal(t, "1", readFile(t, filepath.Join(inst, "events/sched/sched_process_exit/enable")))
+	_, err = os.Stat(filepath.Join(inst, "events/sched/sched_wakeup_new/enable"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Stop(s, true))
+
+	/* The mandatory events are gone, i.e. the kernel is changed after the hooks are scanned */
+	assert.Nil(t, os.RemoveAll(filepath.Join(tracefs, "events/sched/sched_wakeup")))
+	_, err = db.Run(th, &pids, nil, &params, nil)
+	assert.NotNil(t, err)
+	assert.Empty(t, instances(t, tracefs))
+}
+
+func TestNativeNet(t *testing.T) {
+	hooks := t.TempDir()
+	tracefs := t.TempDir()
+	procfs := t.TempDir()
+	sysfs := t.TempDir()
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(tracefs, "instances"), 0750))
+	for _, e := range []string{"net/net_dev_xmit", "net/netif_receive_skb", "tcp/tcp_retransmit_skb"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(tracefs, "events", e), 0750))
+	}
+	/* The host with a veth device and a container, connected to it */
+	assert.Nil(t, os.MkdirAll(filepath.Join(procfs, "1/ns"), 0750))
+	assert.Nil(t, os.Symlink("net:[1000]", filepath.Join(procfs, "1/ns/net")))
+	assert.Nil(t, os.MkdirAll(filepath.Join(sysfs, "class/net/veth12"), 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(sysfs, "class/net/veth12/ifindex"), []byte("12\n"), 0640))
+	assert.Nil(t, os.MkdirAll(filepath.Join(procfs, "100/ns"), 0750))
+	assert.Nil(t, os.Symlink("net:[2000]", filepath.Join(procfs, "100/ns/net")))
+	eth := filepath.Join(procfs, "100/root/sys/class/net/eth0")
+	assert.Nil(t, os.MkdirAll(eth, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(eth, "ifindex"), []byte("2\n"), 0640))
+	assert.Nil(t, os.WriteFile(filepath.Join(eth, "iflink"), []byte("12\n"), 0640))
+
+	db, err := NewTraceHooksDb(&HookConfig{
+		HooksPath: &hooks,
+		Tracefs:   &tracefs,
+		Procfs:    &procfs,
+		Sysfs:     &sysfs,
+	})
+	assert.Nil(t, err)
+	name := "net"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+
+	/* Tasks in the host network name space cannot be traced */
+	pids := []int{1}
+	params := []string{}
+	_, err = db.Run(th, &pids, nil, &params, nil)
+	assert.NotNil(t, err)
+	pids = []int{100}
+	params = []string{"--event", "tcp_probe"}
+	_, err = db.Run(th, &pids, nil, &params, nil)
+	assert.NotNil(t, err)
+
+	/* The name space of the container is passed in the context, the task in the host one is skipped */
+	pids = []int{1, 100}
+	params = []string{}
+	ctx := &HookContext{Containers: []HookContainer{{Namespaces: map[string]int{"net": 2000}}}}
+	s, err := db.Run(th, &pids, nil, &params, ctx)
+	assert.Nil(t, err)
+	path, _ := s.TraceFile()
+	inst := filepath.Dir(path)
+	group := filepath.Base(inst)
+	assert.Equal(t, "name == \"veth12\"", readFile(t, filepath.Join(inst, "events/net/net_dev_xmit/filter")))
+	_, err = os.Stat(filepath.Join(inst, "set_event_pid"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, s.Filter())
+
+	/* The socket events are traced by tracepoint probes, filtered by the name space in the kernel */
+	assert.Contains(t, readFile(t, filepath.Join(tracefs, "dynamic_events")),
+		"t:"+group+"/tcp_retransmit_skb tcp_retransmit_skb netns=sk->__sk_common.skc_net.net->ns.inum")
+	assert.Equal(t, "netns == 2000", readFile(t, filepath.Join(inst, "events", group, "tcp_retransmit_skb/filter")))
+	assert.Equal(t, "1", readFile(t, filepath.Join(inst, "events", group, "tcp_retransmit_skb/enable")))
+	assert.NoFileExists(t, filepath.Join(inst, "events/tcp/tcp_retransmit_skb/enable"))
+	assert.Contains(t, resourceNames(db.Resources()), group+"/tcp_retransmit_skb")
+	assert.Nil(t, db.Stop(s, true))
+	assert.NotContains(t, readFile(t, filepath.Join(tracefs, "dynamic_events")), group)
+
+	/* Without tracepoint probes, the socket events are not traced at all */
+	assert.Nil(t, os.Remove(filepath.Join(tracefs, "dynamic_events")))
+	assert.Nil(t, os.Mkdir(filepath.Join(tracefs, "dynamic_events"), 0750))
+	pids = []int{100}
+	params = []string{"--event", "tcp_retransmit_skb"}
+	_, err = db.Run(th, &pids, nil, &params, nil)
+	assert.NotNil(t, err)
+	params = []string{}
+	s, err = db.Run(th, &pids, nil, &params, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(s.Status().Warnings))
+	path, _ = s.TraceFile()
+	assert.NoDirExists(t, filepath.Join(filepath.Dir(path), "events", filepath.Base(filepath.Dir(path))))
+	assert.Nil(t, db.Stop(s, true))
+}
+
+func TestNativeIo(t *testing.T) {
+	db, tracefs := fakeHooksDb(t)
+
+	for _, e := range []string{"block/block_rq_issue", "block/block_rq_complete", "ext4/ext4_sync_file_enter"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(tracefs, "events", e), 0750))
+	}
+	_, err := db.Rescan()
+	assert.Nil(t, err)
+	name := "io"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+
+	pids := []int{os.Getpid()}
+	params := []string{"--block-only"}
+	s, err := db.Run(th, &pids, nil, &params, nil)
+	assert.Nil(t, err)
+	path, format := s.TraceFile()
+	assert.Equal(t, FormatIo, format)
+	/* The traces of the two instances are merged in the output pipe */
+	assert.True(t, strings.HasPrefix(path, "pipe:"))
+	assert.NotNil(t, s.Output())
+	var main, complete string
+	for _, d := range instances(t, tracefs) {
+		inst := filepath.Join(tracefs, "instances", d)
+		if _, err := os.Stat(filepath.Join(inst, "set_event_pid")); err == nil {
+			main = inst
+		} else {
+			complete = inst
+		}
+	}
+	/* The requests are filtered by PID, their completions are not */
+	if assert.NotEmpty(t, main) && assert.NotEmpty(t, complete) {
+		assert.Equal(t, strconv.Itoa(os.Getpid()), readFile(t, filepath.Join(main, "set_event_pid")))
+		assert.Equal(t, "1", readFile(t, filepath.Join(main, "events/block/block_rq_issue/enable")))
+		_, err = os.Stat(filepath.Join(main, "events/ext4"))
+		assert.True(t, os.IsNotExist(err))
+		assert.Equal(t, "1", readFile(t, filepath.Join(complete, "events/block/block_rq_complete/enable")))
+		assert.Equal(t, "1", readFile(t, filepath.Join(complete, "tracing_on")))
+	}
+	assert.Nil(t, db.Stop(s, true))
+	/* Both instances are removed and the output is closed */
+	assert.Empty(t, instances(t, tracefs))
+	_, err = io.ReadAll(s.Output())
+	assert.Nil(t, err)
+
+	params = []string{}
+	s, err = db.Run(th, &pids, nil, &params, nil)
+	assert.Nil(t, err)
+	main = ""
+	for _, d := range instances(t, tracefs) {
+		inst := filepath.Join(tracefs, "instances", d)
+		if _, err := os.Stat(filepath.Join(inst, "set_event_pid")); err == nil {
+			main = inst
+		}
+	}
+	if assert.NotEmpty(t, main) {
+		assert.Equal(t, "1", readFile(t, filepath.Join(main, "events/ext4/ext4_sync_file_enter/enable")))
+	}
+	assert.Nil(t, db.Stop(s, true))
+}
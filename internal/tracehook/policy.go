@@ -0,0 +1,241 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Optional policy of the trace hooks - the hook managers and hooks, that are allowed to run, with
+ * the SHA-256 digests of their files. The managers are run as root, with a policy only the listed
+ * managers and hooks, which files are not modified, are run. All files in the directory of a manager
+ * must be in the policy, as the manager may load any of them.
+ */
+package tracehook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	EnvHookPolicy = "TRACER_HOOK_POLICY"
+
+	/* The managers must not write compiled python modules, these files are not in the policy */
+	envNoBytecode = "PYTHONDONTWRITEBYTECODE"
+)
+
+/* Allowed manager, by its name */
+type ManagerPolicy struct {
+	Sha256 string            `json:"sha256"`          /* Digest of the manager executable */
+	Files  map[string]string `json:"files,omitempty"` /* Digests of all other files in the manager directory, by path relative to it */
+	Hooks  map[string]string `json:"hooks,omitempty"` /* Allowed hooks, with the digest of the hook file "<hook>.*" */
+}
+
+type HookPolicy struct {
+	Managers map[string]*ManagerPolicy `json:"managers"`
+}
+
+func validDigest(d string) bool {
+	if len(d) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(d)
+	return err == nil
+}
+
+/* Load the policy from a YAML or JSON file */
+func loadPolicy(file string) (*HookPolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p HookPolicy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("Broken hook policy %s: %v", file, err)
+	}
+	for n, m := range p.Managers {
+		if m == nil || !validDigest(m.Sha256) {
+			return nil, fmt.Errorf("Broken hook policy %s: invalid digest of manager %s", file, n)
+		}
+		files := make(map[string]string, len(m.Files))
+		for f, d := range m.Files {
+			if !validDigest(d) {
+				return nil, fmt.Errorf("Broken hook policy %s: invalid digest of file %s of manager %s", file, f, n)
+			}
+			c := filepath.Clean(f)
+			if filepath.IsAbs(c) || c == "." || c == ".." || strings.HasPrefix(c, "../") {
+				return nil, fmt.Errorf("Broken hook policy %s: file %s is not in the directory of manager %s", file, f, n)
+			}
+			files[c] = d
+		}
+		m.Files = files
+		for h, d := range m.Hooks {
+			if !validDigest(d) {
+				return nil, fmt.Errorf("Broken hook policy %s: invalid digest of hook %s of manager %s", file, h, n)
+			}
+		}
+	}
+
+	return &p, nil
+}
+
+/* Check if the SHA-256 digest of the file matches the given one */
+func verifyFile(path, digest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), digest) {
+		return fmt.Errorf("Digest of %s does not match the hook policy", path)
+	}
+	return nil
+}
+
+/* Check if the file, relative to the manager directory, is a file of an allowed hook */
+func (m *ManagerPolicy) hookFile(file string) bool {
+	if strings.ContainsRune(file, filepath.Separator) {
+		return false
+	}
+	for h := range m.Hooks {
+		if strings.HasPrefix(file, h+".") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Check if the manager is allowed to run. All files in the manager directory must be in the policy,
+ * an unknown file may shadow a module, loaded by the manager. The files of the hooks are verified
+ * separately, a modified hook is refused without refusing its manager. All managers are allowed, if
+ * there is no policy.
+ */
+func (p *HookPolicy) checkManager(b *execBackend) error {
+	if p == nil {
+		return nil
+	}
+	m, ok := p.Managers[b.name]
+	if !ok {
+		return fmt.Errorf("Manager %s is not in the hook policy", b.name)
+	}
+	files := map[string]string{b.fexec: m.Sha256}
+	for f, d := range m.Files {
+		files[f] = d
+	}
+
+	found := make(map[string]bool)
+	err := filepath.WalkDir(b.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.dir, path)
+		if err != nil {
+			return err
+		}
+		if digest, ok := files[rel]; ok {
+			found[rel] = true
+			return verifyFile(path, digest)
+		}
+		if m.hookFile(rel) {
+			return nil
+		}
+		return fmt.Errorf("File %s is not in the hook policy", path)
+	})
+	if err != nil {
+		return err
+	}
+	for f := range files {
+		if !found[f] {
+			return fmt.Errorf("Cannot find file %s of manager %s", f, b.name)
+		}
+	}
+
+	return nil
+}
+
+/* Check if the hook of an allowed manager is allowed to run */
+func (p *HookPolicy) checkHook(b *execBackend, hook string) error {
+	if p == nil {
+		return nil
+	}
+	m, ok := p.Managers[b.name]
+	if !ok {
+		return fmt.Errorf("Manager %s is not in the hook policy", b.name)
+	}
+	digest, ok := m.Hooks[hook]
+	if !ok {
+		return fmt.Errorf("Hook %s is not in the hook policy", hook)
+	}
+
+	/* The managers run the hooks from files, named after them */
+	files := []string{}
+	all, err := os.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range all {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), hook+".") {
+			files = append(files, f.Name())
+		}
+	}
+	if len(files) != 1 {
+		return fmt.Errorf("Cannot find a single file of hook %s in %s", hook, b.dir)
+	}
+
+	return verifyFile(filepath.Join(b.dir, files[0]), digest)
+}
+
+/* Check if the hook and its manager are allowed to run. The hooks, compiled in the tracer, are always allowed */
+func (h *TraceHooks) checkPolicy(th *TraceHook, manager bool) error {
+	b, ok := th.manager.backend.(*execBackend)
+	if !ok {
+		return nil
+	}
+	p := h.getPolicy()
+	if manager {
+		if err := p.checkManager(b); err != nil {
+			return err
+		}
+	}
+	return p.checkHook(b, th.Name)
+}
+
+func (h *TraceHooks) getPolicy() *HookPolicy {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.policy
+}
+
+/* Load the policy again, it may be changed. If the new policy is broken, the previous one is used */
+func (h *TraceHooks) reloadPolicy() error {
+	if h.policyFile == "" {
+		return nil
+	}
+	p, err := loadPolicy(h.policyFile)
+	if err != nil {
+		if h.getPolicy() == nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%v, using the previous hook policy\n", err)
+		return nil
+	}
+	h.lock.Lock()
+	h.policy = p
+	h.lock.Unlock()
+
+	return nil
+}
@@ -0,0 +1,181 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracehook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* A manager, that loads a module and runs its hooks from files. Each of its runs is recorded */
+var policyManager = `#!/bin/sh
+. ./lib.sh
+echo "$1" >> "$TEST_RUNS/$(basename "$PWD")"
+case "$1" in
+	--get-all) echo trace_good trace_bad trace_unlisted ;;
+	--describe) echo "Policy trace hook" ;;
+	--run) ./$2.sh ;;
+esac
+`
+
+var policyHook = `#!/bin/sh
+echo /trace/pipe
+sleep 10
+`
+
+func digest(t *testing.T, file string) string {
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var policyLib = "HOOK_LIB=1\n"
+
+func TestHookPolicy(t *testing.T) {
+	hooks := t.TempDir()
+	runs := t.TempDir()
+	t.Setenv("TEST_RUNS", runs)
+	for _, m := range []string{"allowed", "unlisted"} {
+		dir := filepath.Join(hooks, m)
+		assert.Nil(t, os.Mkdir(dir, 0750))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(policyManager), 0750))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, "lib.sh"), []byte(policyLib), 0640))
+		for _, h := range []string{"trace_good", "trace_bad"} {
+			assert.Nil(t, os.WriteFile(filepath.Join(dir, h+".sh"), []byte(policyHook), 0750))
+		}
+	}
+	allowed := filepath.Join(hooks, "allowed")
+	manager := fmt.Sprintf(`
+managers:
+  allowed:
+    sha256: "%s"
+    files:
+      lib.sh: "%s"
+    hooks:
+      trace_good: "%s"
+      trace_bad: "%s"
+`, digest(t, filepath.Join(allowed, "manager.sh")), digest(t, filepath.Join(allowed, "lib.sh")),
+		digest(t, filepath.Join(allowed, "trace_good.sh")), strings.Repeat("0", 64))
+	policy := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.Nil(t, os.WriteFile(policy, []byte(manager), 0640))
+
+	/* Each hook must have a valid digest, the files must be in the manager directory */
+	for _, b := range []string{
+		"managers:\n  allowed:\n    sha256: 1234\n",
+		manager + "      trace_unlisted: \"\"\n",
+		strings.Replace(manager, "lib.sh:", "../lib.sh:", 1),
+	} {
+		broken := filepath.Join(t.TempDir(), "broken.yaml")
+		assert.Nil(t, os.WriteFile(broken, []byte(b), 0640))
+		_, err := NewTraceHooksDb(&HookConfig{HooksPath: &hooks, PolicyFile: &broken})
+		assert.NotNil(t, err)
+	}
+
+	db, err := NewTraceHooksDb(&HookConfig{HooksPath: &hooks, PolicyFile: &policy})
+	assert.Nil(t, err)
+
+	/* The refused manager is not run at all */
+	assert.NoFileExists(t, filepath.Join(runs, "unlisted"))
+	list := *db.List(false)
+	if assert.Contains(t, list, filepath.Join(hooks, "unlisted")) {
+		m := list[filepath.Join(hooks, "unlisted")]
+		assert.NotEmpty(t, m.Refused)
+		assert.Empty(t, m.Tracers)
+	}
+	if assert.Contains(t, list, allowed) {
+		m := list[allowed]
+		assert.Empty(t, m.Refused)
+		assert.True(t, m.Tracers["trace_good"].Available)
+		assert.Contains(t, m.Tracers["trace_bad"].Refused, "does not match")
+		assert.False(t, m.Tracers["trace_bad"].Available)
+		assert.Contains(t, m.Tracers["trace_unlisted"].Refused, "not in the hook policy")
+	}
+	/* The refused hooks are not described, as the manager runs them for the description */
+	assert.Equal(t, 1, strings.Count(readFile(t, filepath.Join(runs, "allowed")), "--describe"))
+
+	for _, n := range []string{"allowed/trace_bad", "unlisted/trace_good"} {
+		_, err = db.GetHook(&n)
+		assert.NotNil(t, err)
+	}
+
+	/* The files are verified again before each run */
+	name := "allowed/trace_good"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	pids := []int{os.Getpid()}
+	s, err := db.Run(th, &pids, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.WaitStart(s))
+	db.Stop(s, true)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(allowed, "trace_good.sh"), []byte(policyHook+"echo modified\n"), 0750))
+	_, err = db.Run(th, &pids, nil, nil, nil)
+	assert.NotNil(t, err)
+	assert.Eventually(t, func() bool {
+		th := (*db.List(false))[allowed].Tracers["trace_good"]
+		return th != nil && th.Refused != ""
+	}, watchDebounce, watchDebounce/10)
+	assert.Nil(t, os.WriteFile(filepath.Join(allowed, "trace_good.sh"), []byte(policyHook), 0750))
+
+	/* A modified module refuses the whole manager */
+	_, err = db.Rescan()
+	assert.Nil(t, err)
+	th, err = db.GetHook(&name)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(allowed, "lib.sh"), []byte(policyLib+"HOOK_LIB=2\n"), 0640))
+	_, err = db.Run(th, &pids, nil, nil, nil)
+	assert.NotNil(t, err)
+	assert.Eventually(t, func() bool {
+		return (*db.List(false))[allowed].Refused != ""
+	}, watchDebounce, watchDebounce/10)
+	assert.Nil(t, os.WriteFile(filepath.Join(allowed, "lib.sh"), []byte(policyLib), 0640))
+
+	/* A file, that is not in the policy, may shadow a module and refuses the manager */
+	_, err = db.Rescan()
+	assert.Nil(t, err)
+	assert.Empty(t, (*db.List(false))[allowed].Refused)
+	assert.Nil(t, os.WriteFile(filepath.Join(allowed, "protocol.sh"), []byte(policyLib), 0640))
+	_, err = db.Rescan()
+	assert.Nil(t, err)
+	assert.Contains(t, (*db.List(false))[allowed].Refused, "is not in the hook policy")
+}
+
+func TestResetPolicy(t *testing.T) {
+	hooks := t.TempDir()
+	runs := t.TempDir()
+	t.Setenv("TEST_RUNS", runs)
+	dir := filepath.Join(hooks, "allowed")
+	assert.Nil(t, os.Mkdir(dir, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(policyManager), 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "lib.sh"), []byte(policyLib), 0640))
+	policy := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.Nil(t, os.WriteFile(policy, []byte(fmt.Sprintf("managers:\n  allowed:\n    sha256: \"%s\"\n    files:\n      lib.sh: \"%s\"\n",
+		digest(t, filepath.Join(dir, "manager.sh")), digest(t, filepath.Join(dir, "lib.sh")))), 0640))
+	orphans := OrphanRemoveAll
+
+	db, err := NewTraceHooksDb(&HookConfig{HooksPath: &hooks, PolicyFile: &policy, OrphanPolicy: &orphans})
+	assert.Nil(t, err)
+	clears := func() int {
+		return strings.Count(readFile(t, filepath.Join(runs, "allowed")), "--clear")
+	}
+	assert.Equal(t, 1, clears())
+
+	/* The manager is verified again before the reset, a modified one is not run */
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "lib.sh"), []byte(policyLib+"HOOK_LIB=2\n"), 0640))
+	db.ResetAll()
+	assert.Equal(t, 1, clears())
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "lib.sh"), []byte(policyLib), 0640))
+	db.ResetAll()
+	assert.Equal(t, 2, clears())
+}
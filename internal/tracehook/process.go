@@ -0,0 +1,226 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Control of the trace hook processes - start and stop timeouts, resource limits and cleanup.
+ */
+package tracehook
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	DefaultStartTimeout = 5 * time.Second
+	DefaultStopTimeout  = 5 * time.Second
+	startPollDelay      = 100 * time.Millisecond
+
+	/* Set when the tracer runs itself to apply the limits, as "<cpu>:<memory>:<path of the hook>" */
+	envLimitsExec = "TRACER_HOOK_RLIMITS"
+	selfExe       = "/proc/self/exe"
+
+	/* Signals, sent to the process group of a hook until it stops */
+	stopSignals = []syscall.Signal{
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGKILL,
+	}
+)
+
+/*
+ * The resource limits of a process cannot be set from another thread of the tracer, as they are shared
+ * by all of its threads. The hook is started through a copy of the tracer, which sets the limits on
+ * itself and executes the hook. The limits are applied before the hook runs and its children inherit them.
+ */
+func init() {
+	if l, ok := os.LookupEnv(envLimitsExec); ok {
+		os.Exit(limitsExec(l))
+	}
+}
+
+/* Run the command through a copy of the tracer, which applies the configured resource limits */
+func (h *TraceHooks) setLimits(cmd *exec.Cmd) {
+	if h.cpuLimit == 0 && h.memLimit == 0 {
+		return
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d:%d:%s", envLimitsExec, h.cpuLimit, h.memLimit, cmd.Path))
+	cmd.Path = selfExe
+}
+
+func setLimit(resource int, limit uint64) error {
+	if limit == 0 {
+		return nil
+	}
+	return unix.Setrlimit(resource, &unix.Rlimit{Cur: limit, Max: limit})
+}
+
+/* Apply the limits to the current process and execute the hook. Returns only on error */
+func limitsExec(limits string) int {
+	l := strings.SplitN(limits, ":", 3)
+	if len(l) != 3 {
+		fmt.Fprintf(os.Stderr, "Invalid limits of the trace hook: %s\n", limits)
+		return 126
+	}
+	cpu, err1 := strconv.ParseUint(l[0], 10, 64)
+	mem, err2 := strconv.ParseUint(l[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		fmt.Fprintf(os.Stderr, "Invalid limits of the trace hook: %s\n", limits)
+		return 126
+	}
+	if err := setLimit(unix.RLIMIT_CPU, cpu); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set CPU limit of the trace hook: %v\n", err)
+		return 126
+	}
+	if err := setLimit(unix.RLIMIT_AS, mem); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set memory limit of the trace hook: %v\n", err)
+		return 126
+	}
+
+	env := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, envLimitsExec+"=") {
+			env = append(env, e)
+		}
+	}
+	err := syscall.Exec(l[2], os.Args, env)
+	fmt.Fprintf(os.Stderr, "Failed to run the trace hook %s: %v\n", l[2], err)
+	return 127
+}
+
+/*
+ * Wait for the hook to exit and for all of its output. The hook is not reaped until its leftovers are
+ * killed, the id of its process group cannot be reused while it is a zombie.
+ */
+func (h *TraceHooks) waitProcess(s *Session) {
+	var info unix.Siginfo
+
+	for {
+		err := unix.Waitid(unix.P_PID, s.cmd.Process.Pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	/* Kill all leftovers in the process group of the hook */
+	unix.Kill(-s.cmd.Process.Pid, unix.SIGKILL)
+	s.cmdWg.Wait()
+
+	s.reapLock.Lock()
+	s.waitErr = s.cmd.Wait()
+	s.reaped = true
+	s.reapLock.Unlock()
+
+	/* Remove the resources, left by the hook */
+	s.releaseResources()
+
+	h.runLock.Lock()
+	delete(h.running, s)
+	h.runLock.Unlock()
+	close(s.exited)
+}
+
+/* Signal the process group of the hook, unless the hook is reaped */
+func (s *Session) signalGroup(sig syscall.Signal) error {
+	s.reapLock.Lock()
+	defer s.reapLock.Unlock()
+
+	if s.reaped {
+		return nil
+	}
+	return unix.Kill(-s.cmd.Process.Pid, sig)
+}
+
+func (s *Session) hasExited(timeout time.Duration) bool {
+	select {
+	case <-s.exited:
+		return true
+	default:
+	}
+	select {
+	case <-s.exited:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+/* Signal the process group of the hook, escalating until it stops */
+func (h *TraceHooks) stopProcess(s *Session) error {
+	for _, sig := range stopSignals {
+		if err := s.signalGroup(sig); err != nil && err != unix.ESRCH {
+			return err
+		}
+		if s.hasExited(h.stopTimeout) {
+			return s.waitErr
+		}
+	}
+
+	return fmt.Errorf("Trace hook %d did not stop", s.cmd.Process.Pid)
+}
+
+/*
+ * Wait for the hook to start and to report the file with the collected traces. If the hook does not
+ * start in time, or fails, it is stopped.
+ */
+func (h *TraceHooks) WaitStart(s *Session) error {
+	if s.proto != nil {
+		select {
+		case <-s.proto.ready:
+		case <-time.After(h.startTimeout):
+			h.Stop(s, false)
+			return fmt.Errorf("Trace hook did not start in %v", h.startTimeout)
+		}
+		if err := s.proto.waitReady(); err != nil {
+			h.Stop(s, false)
+			return err
+		}
+		return nil
+	}
+
+	/* Legacy protocol, the first line on the standard output is the trace file */
+	for start := time.Now(); time.Since(start) < h.startTimeout; {
+		stdout, stderr := s.GetOutput()
+		if len(*stderr) > 0 {
+			h.Stop(s, false)
+			return fmt.Errorf("Trace hook failed to start: %s", strings.Join(*stderr, "\n"))
+		}
+		if len(*stdout) > 0 {
+			return nil
+		}
+		if s.hasExited(startPollDelay) {
+			return fmt.Errorf("Trace hook exited before starting: %v", s.waitErr)
+		}
+	}
+
+	h.Stop(s, false)
+	return fmt.Errorf("Trace hook did not start in %v", h.startTimeout)
+}
+
+/* Stop all running hooks, used on shutdown to not leave orphaned hook processes */
+func (h *TraceHooks) Destroy() {
+	var wg sync.WaitGroup
+
+	h.runLock.Lock()
+	all := []*Session{}
+	for s := range h.running {
+		all = append(all, s)
+	}
+	h.runLock.Unlock()
+
+	for _, s := range all {
+		wg.Add(1)
+		go func(s *Session) {
+			h.Stop(s, true)
+			wg.Done()
+		}(s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracehook
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* A manager, which ignores SIGINT and SIGTERM and runs a child in its process group */
+var stubbornManager = `#!/bin/sh
+case "$1" in
+	--get-all) echo trace_stubborn trace_silent trace_limits ;;
+	--describe) echo "Stubborn trace hook" ;;
+	--run)
+		trap '' INT TERM
+		if [ "$2" = "trace_limits" ]; then
+			echo "$(ulimit -t) $(ulimit -v)"
+		fi
+		if [ "$2" = "trace_silent" ]; then
+			sleep 60
+		fi
+		sleep 60 &
+		echo $!
+		wait
+		;;
+esac
+`
+
+/* Check if the process is running, zombies are not */
+func alive(pid int) bool {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	f := strings.Fields(string(data[strings.LastIndex(string(data), ")")+1:]))
+	return len(f) > 0 && f[0] != "Z"
+}
+
+func stubbornHooksDb(t *testing.T) *TraceHooks {
+	hooks := t.TempDir()
+	start := 500 * time.Millisecond
+	stop := 200 * time.Millisecond
+
+	dir := filepath.Join(hooks, "stubborn")
+	assert.Nil(t, os.Mkdir(dir, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(stubbornManager), 0750))
+	db, err := NewTraceHooksDb(&HookConfig{
+		HooksPath:    &hooks,
+		StartTimeout: &start,
+		StopTimeout:  &stop,
+	})
+	assert.Nil(t, err)
+	return db
+}
+
+func TestStopEscalation(t *testing.T) {
+	db := stubbornHooksDb(t)
+
+	name := "trace_stubborn"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	pids := []int{os.Getpid()}
+	s, err := db.Run(th, &pids, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.WaitStart(s))
+	out, _ := s.GetOutput()
+	child, err := strconv.Atoi(strings.TrimSpace((*out)[0]))
+	assert.Nil(t, err)
+
+	start := time.Now()
+	assert.NotNil(t, db.Stop(s, true))
+	assert.True(t, time.Since(start) >= 2*db.stopTimeout)
+	assert.Eventually(t, func() bool {
+		return !alive(child)
+	}, time.Second, 50*time.Millisecond)
+
+	/* Stopping an already stopped hook does not block */
+	db.Stop(s, true)
+	db.runLock.Lock()
+	assert.Equal(t, 0, len(db.running))
+	db.runLock.Unlock()
+}
+
+func TestStartTimeout(t *testing.T) {
+	db := stubbornHooksDb(t)
+
+	name := "trace_silent"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	pids := []int{os.Getpid()}
+	s, err := db.Run(th, &pids, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, db.WaitStart(s))
+
+	db.Destroy()
+	assert.True(t, s.hasExited(0))
+}
+
+func TestLimits(t *testing.T) {
+	db := stubbornHooksDb(t)
+	db.cpuLimit = 100
+	db.memLimit = 2048 * 1024 * 1024
+
+	name := "trace_limits"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	pids := []int{os.Getpid()}
+	s, err := db.Run(th, &pids, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.WaitStart(s))
+	out, _ := s.GetOutput()
+	assert.Equal(t, "100 2097152", (*out)[0])
+
+	/* The limits are applied to the hook only */
+	var l syscall.Rlimit
+	assert.Nil(t, syscall.Getrlimit(syscall.RLIMIT_CPU, &l))
+	assert.NotEqual(t, uint64(100), l.Cur)
+	assert.NotNil(t, db.Stop(s, true))
+}
@@ -0,0 +1,211 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Versioned JSON lines protocol between the tracer and the hook managers. The manager writes one
+ * JSON message per line to a dedicated pipe, passed to it as a file descriptor. Managers, that do
+ * not support the protocol, use the legacy one - path to the trace file on the standard output and
+ * errors on the standard error output.
+ */
+package tracehook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ProtocolVersion = 2 /* The latest protocol version, supported by the tracer */
+	protocolLegacy  = 0
+	protocolPipe    = 2 /* The first version, in which the traces are written to a pipe of the tracer */
+	protocolFd      = 3 /* The first of the extra files, passed to the manager */
+	outputFd        = 4
+
+	EnvProtocolFd      = "TRACER_HOOK_PROTOCOL_FD"
+	EnvProtocolVersion = "TRACER_HOOK_PROTOCOL_VERSION"
+	EnvOutputFd        = "TRACER_OUTPUT_FD"
+
+	MsgReady   = "ready"   /* The trace is running */
+	MsgOutput  = "output"  /* Location and format of the collected traces */
+	MsgPids    = "pids"    /* PIDs, actually filtered by the hook */
+	MsgWarning = "warning" /* Non fatal problem */
+	MsgStats   = "stats"   /* Statistics of the trace, i.e. lost events */
+	MsgError   = "error"   /* Fatal problem, the hook stops */
+
+	MsgResource = "resource" /* Kernel trace resource, created by the hook */
+
+	FormatFtrace    = "ftrace"         /* ftrace text format, as in trace_pipe */
+	FormatFuncgraph = "function_graph" /* Output of the function_graph tracer */
+	FormatSched     = "sched"          /* ftrace text format with scheduler events */
+	FormatIo        = "io"             /* ftrace text format with block and file system events */
+)
+
+/* A message from the manager */
+type hookMessage struct {
+	Version int               `json:"version"`
+	Type    string            `json:"type"`
+	Path    string            `json:"path,omitempty"`
+	Format  string            `json:"format,omitempty"`
+	Pipe    bool              `json:"pipe,omitempty"` /* The traces are written to the output pipe */
+	Pids    []int             `json:"pids,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Stats   map[string]uint64 `json:"stats,omitempty"`
+	Kind    string            `json:"kind,omitempty"` /* Kind of the resource, i.e. instance */
+	Name    string            `json:"name,omitempty"` /* Name of the resource */
+}
+
+type HookOutput struct {
+	Path   string
+	Format string
+	Pipe   bool `json:",omitempty"` /* The traces are written to the output pipe of the tracer */
+}
+
+/* State of a running hook, as reported through the protocol */
+type HookStatus struct {
+	Protocol int
+	Ready    bool
+	Outputs  []HookOutput      `json:",omitempty"`
+	Pids     []int             `json:",omitempty"`
+	Warnings []string          `json:",omitempty"`
+	Stats    map[string]uint64 `json:",omitempty"`
+	Error    string            `json:",omitempty"`
+}
+
+type hookProtocol struct {
+	lock      sync.RWMutex
+	status    HookStatus
+	ready     chan struct{} /* Closed when the hook is ready, or failed to start */
+	readyOnce sync.Once
+	owner     func(kind, name string) /* Records the resources, created by the hook */
+}
+
+func newProtocol(version int) *hookProtocol {
+	return &hookProtocol{
+		status: HookStatus{
+			Protocol: version,
+			Stats:    make(map[string]uint64),
+		},
+		ready: make(chan struct{}),
+	}
+}
+
+/* Ask the manager for the latest protocol version it supports */
+func (b *execBackend) getProtocolVersion() int {
+	cmd := b.command(context.Background(), "--protocol-version")
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return protocolLegacy
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(out.String()))
+	if err != nil || v < protocolLegacy {
+		return protocolLegacy
+	}
+	if v > ProtocolVersion {
+		v = ProtocolVersion
+	}
+
+	return v
+}
+
+func (p *hookProtocol) setReady() {
+	p.readyOnce.Do(func() {
+		close(p.ready)
+	})
+}
+
+func (p *hookProtocol) handle(m *hookMessage) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch m.Type {
+	case MsgReady:
+		if len(p.status.Outputs) == 0 {
+			p.status.Error = "Trace hook is ready, but reported no output"
+		} else {
+			p.status.Ready = true
+		}
+		p.setReady()
+	case MsgOutput:
+		if m.Format == "" {
+			m.Format = FormatFtrace
+		}
+		p.status.Outputs = append(p.status.Outputs, HookOutput{Path: m.Path, Format: m.Format, Pipe: m.Pipe})
+	case MsgPids:
+		p.status.Pids = m.Pids
+	case MsgWarning:
+		p.status.Warnings = append(p.status.Warnings, m.Message)
+	case MsgStats:
+		for k, v := range m.Stats {
+			p.status.Stats[k] = v
+		}
+	case MsgError:
+		p.status.Error = m.Message
+		p.setReady()
+	case MsgResource:
+		if err := checkResource(m.Kind, m.Name); err != nil {
+			p.status.Warnings = append(p.status.Warnings, err.Error())
+		} else if p.owner != nil {
+			p.owner(m.Kind, m.Name)
+		}
+	}
+}
+
+/* Read messages from the manager, until it closes the pipe */
+func (p *hookProtocol) read(r io.ReadCloser) {
+	defer r.Close()
+
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		var m hookMessage
+		if err := json.Unmarshal(scan.Bytes(), &m); err != nil {
+			p.handle(&hookMessage{Type: MsgWarning, Message: fmt.Sprintf("Invalid protocol message: %s", scan.Text())})
+			continue
+		}
+		p.handle(&m)
+	}
+	/* The manager exited or closed the pipe before being ready */
+	p.lock.Lock()
+	if !p.status.Ready && p.status.Error == "" {
+		p.status.Error = "Trace hook exited before being ready"
+	}
+	p.lock.Unlock()
+	p.setReady()
+}
+
+/* Wait for the hook to report its start result */
+func (p *hookProtocol) waitReady() error {
+	<-p.ready
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.status.Error != "" {
+		return fmt.Errorf("Trace hook failed to start: %s", p.status.Error)
+	}
+
+	return nil
+}
+
+func (p *hookProtocol) getStatus() *HookStatus {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	res := p.status
+	res.Outputs = append([]HookOutput{}, p.status.Outputs...)
+	res.Pids = append([]int{}, p.status.Pids...)
+	res.Warnings = append([]string{}, p.status.Warnings...)
+	res.Stats = make(map[string]uint64)
+	for k, v := range p.status.Stats {
+		res.Stats[k] = v
+	}
+
+	return &res
+}
@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracehook
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/* A manager, speaking the protocol on the file descriptor, passed by the tracer */
+var protocolManager = `#!/bin/sh
+case "$1" in
+	--protocol-version) echo 1 ;;
+	--get-all) echo trace_ok trace_fail ;;
+	--describe) echo "Protocol trace hook" ;;
+	--run)
+		fd=$TRACER_HOOK_PROTOCOL_FD
+		echo "some logs" >&2
+		if [ "$2" = "trace_fail" ]; then
+			echo '{"version": 1, "type": "error", "message": "no such event"}' >&$fd
+			exit 1
+		fi
+		echo '{"version": 1, "type": "output", "path": "/trace/pipe"}' >&$fd
+		echo '{"version": 1, "type": "pids", "pids": [1, 2]}' >&$fd
+		echo 'garbage' >&$fd
+		echo '{"version": 1, "type": "stats", "stats": {"lost": 3}}' >&$fd
+		echo '{"version": 1, "type": "ready"}' >&$fd
+		sleep 60
+		;;
+esac
+`
+
+func TestProtocol(t *testing.T) {
+	hooks := t.TempDir()
+	dir := filepath.Join(hooks, "proto")
+	assert.Nil(t, os.Mkdir(dir, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(protocolManager), 0750))
+	db, err := NewTraceHooksDb(&HookConfig{HooksPath: &hooks})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, (*db.Get())[dir].Protocol)
+
+	pids := []int{os.Getpid()}
+	name := "trace_ok"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	s, err := db.Run(th, &pids, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.WaitStart(s))
+	path, format := s.TraceFile()
+	assert.Equal(t, "/trace/pipe", path)
+	assert.Equal(t, FormatFtrace, format)
+	assert.Nil(t, s.Output())
+	st := s.Status()
+	assert.True(t, st.Ready)
+	assert.Equal(t, []int{1, 2}, st.Pids)
+	assert.Equal(t, uint64(3), st.Stats["lost"])
+	assert.Equal(t, 1, len(st.Warnings))
+	db.Stop(s, true)
+
+	name = "trace_fail"
+	th, err = db.GetHook(&name)
+	assert.Nil(t, err)
+	s, err = db.Run(th, &pids, nil, nil, nil)
+	assert.Nil(t, err)
+	err = db.WaitStart(s)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no such event")
+}
+
+/* A manager, writing the traces to the output pipe of the tracer */
+var pipeManager = `#!/bin/sh
+case "$1" in
+	--protocol-version) echo 2 ;;
+	--get-all) echo trace_pipe ;;
+	--describe) echo "Pipe trace hook" ;;
+	--run)
+		fd=$TRACER_HOOK_PROTOCOL_FD
+		echo '{"version": 2, "type": "output", "path": "/trace/pipe", "format": "sched", "pipe": true}' >&$fd
+		echo '{"version": 2, "type": "ready"}' >&$fd
+		echo "event 1" >&$TRACER_OUTPUT_FD
+		echo "event 2" >&$TRACER_OUTPUT_FD
+		;;
+esac
+`
+
+func TestOutputPipe(t *testing.T) {
+	hooks := t.TempDir()
+	dir := filepath.Join(hooks, "pipe")
+	assert.Nil(t, os.Mkdir(dir, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(pipeManager), 0750))
+	db, err := NewTraceHooksDb(&HookConfig{HooksPath: &hooks})
+	assert.Nil(t, err)
+	assert.Equal(t, ProtocolVersion, (*db.Get())[dir].Protocol)
+
+	pids := []int{os.Getpid()}
+	name := "trace_pipe"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	s, err := db.Run(th, &pids, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.WaitStart(s))
+	path, format := s.TraceFile()
+	assert.True(t, strings.HasPrefix(path, "pipe:"))
+	assert.Equal(t, FormatSched, format)
+
+	/* The traces are read until the hook exits and closes the pipe */
+	out := s.Output()
+	assert.NotNil(t, out)
+	data, err := io.ReadAll(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "event 1\nevent 2\n", string(data))
+	out.Close()
+	db.Stop(s, true)
+}
@@ -0,0 +1,385 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Ownership of the kernel trace resources - trace instances and dynamic events, created for the trace
+ * sessions. The tracer records the resources of each session in a state file and removes only its own
+ * resources. Resources, that are not used by any running session, are orphans. They are left by a crash
+ * of the tracer, or are created by someone else, and are cleaned up according to the orphan policy.
+ */
+package tracehook
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware-labs/container-tracer/internal/ftrace"
+)
+
+var (
+	EnvStateFile    = "TRACER_STATE_FILE"
+	EnvOrphanPolicy = "TRACER_ORPHAN_POLICY"
+
+	DefaultStateFile = "/var/run/container-tracer/resources.json"
+
+	ResourceInstance     = "instance"
+	ResourceDynamicEvent = "dynamic_event"
+
+	OrphanKeep      = "keep"       /* Orphans are only reported */
+	OrphanRemove    = "remove"     /* Orphans, created by the tracer, are removed */
+	OrphanRemoveAll = "remove-all" /* All orphans are removed, including the ones created by someone else */
+
+	DefaultOrphanPolicy = OrphanKeep
+	orphanPolicies      = []string{OrphanKeep, OrphanRemove, OrphanRemoveAll}
+)
+
+/* Kernel trace resource, created for a trace session */
+type TraceResource struct {
+	Kind    string /* instance or dynamic_event */
+	Name    string /* Name of the instance, or "<group>/<event>" of the dynamic event */
+	Session string `json:",omitempty"` /* Trace session, that created the resource */
+	Hook    string `json:",omitempty"` /* Qualified name of the hook, that created the resource */
+	Created time.Time
+	Owned   bool /* Created by this tracer, or by its previous run, according to the state file */
+	Orphan  bool /* Not used by a running trace session */
+}
+
+/* All resources, known by the tracer */
+type resourceDb struct {
+	lock      sync.Mutex
+	tracefs   *ftrace.Tracefs
+	stateFile string /* Empty if the owned resources are not persisted */
+	policy    string
+	all       map[string]*TraceResource /* By "<kind>:<name>" */
+}
+
+func (r *TraceResource) key() string {
+	return r.Kind + ":" + r.Name
+}
+
+func newResourceDb(tfs *ftrace.Tracefs, stateFile, policy string) (*resourceDb, error) {
+	if policy == "" {
+		policy = DefaultOrphanPolicy
+	}
+	if !containsString(orphanPolicies, policy) {
+		return nil, fmt.Errorf("Unknown orphan policy %s, must be one of %s", policy, strings.Join(orphanPolicies, ", "))
+	}
+
+	return &resourceDb{
+		tracefs:   tfs,
+		stateFile: stateFile,
+		policy:    policy,
+		all:       make(map[string]*TraceResource),
+	}, nil
+}
+
+/* Validate a resource, reported by a hook. Instances are "<name>", dynamic events are "<group>/<event>" */
+func checkResource(kind, name string) error {
+	parts := []string{name}
+	switch kind {
+	case ResourceInstance:
+	case ResourceDynamicEvent:
+		if parts = strings.Split(name, "/"); len(parts) != 2 {
+			return fmt.Errorf("Invalid dynamic event %s", name)
+		}
+	default:
+		return fmt.Errorf("Unknown trace resource %s", kind)
+	}
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." || strings.ContainsAny(p, "/ \t\n") {
+			return fmt.Errorf("Invalid trace %s %s", kind, name)
+		}
+	}
+	return nil
+}
+
+/* Check if the resource still exists in the kernel */
+func (d *resourceDb) exists(r *TraceResource) bool {
+	if d.tracefs == nil {
+		return false
+	}
+	switch r.Kind {
+	case ResourceInstance:
+		_, err := d.tracefs.GetInstance(r.Name)
+		return err == nil
+	case ResourceDynamicEvent:
+		group := strings.SplitN(r.Name, "/", 2)[0]
+		if all, err := d.tracefs.DynamicEvents(group); err == nil {
+			return containsString(all, r.Name)
+		}
+	}
+	return false
+}
+
+/* Remove the resource from the kernel. Removing a resource, that does not exist, is not an error */
+func (d *resourceDb) remove(r *TraceResource) error {
+	if !d.exists(r) {
+		return nil
+	}
+	switch r.Kind {
+	case ResourceInstance:
+		inst, err := d.tracefs.GetInstance(r.Name)
+		if err != nil {
+			return nil
+		}
+		stopTrace(inst)
+		return removeInstance(inst)
+	case ResourceDynamicEvent:
+		return d.tracefs.RemoveDynamicEvent(r.Name)
+	}
+	return fmt.Errorf("Unknown trace resource %s", r.Kind)
+}
+
+/* The dynamic events cannot be removed while they are used by an instance, remove the instances first */
+func sortResources(all []*TraceResource) {
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Kind == ResourceInstance && all[j].Kind != ResourceInstance
+	})
+}
+
+/* Write the owned resources to the state file, to find them after a crash of the tracer */
+func (d *resourceDb) save() {
+	if d.stateFile == "" {
+		return
+	}
+	owned := []*TraceResource{}
+	for _, r := range d.all {
+		if r.Owned {
+			owned = append(owned, r)
+		}
+	}
+	data, err := json.MarshalIndent(owned, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(d.stateFile), 0750)
+	}
+	if err == nil {
+		/* Replace the file at once, a crash while writing must not lose the previous state */
+		tmp := d.stateFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0640); err == nil {
+			err = os.Rename(tmp, d.stateFile)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save the trace resources in %s: %v\n", d.stateFile, err)
+	}
+}
+
+/* Record a resource, created for a running session */
+func (d *resourceDb) add(r *TraceResource) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	r.Owned = true
+	d.all[r.key()] = r
+	d.save()
+}
+
+/*
+ * Remove the resources of a stopped session. The resources, that cannot be removed, i.e. an instance
+ * with open trace pipe, are kept as orphans.
+ */
+func (d *resourceDb) release(all []*TraceResource) {
+	sortResources(all)
+
+	for _, r := range all {
+		err := d.remove(r)
+		d.lock.Lock()
+		if err == nil {
+			delete(d.all, r.key())
+		} else {
+			fmt.Fprintf(os.Stderr, "Failed to remove trace %s %s: %v\n", r.Kind, r.Name, err)
+			r.Orphan = true
+		}
+		d.lock.Unlock()
+	}
+
+	d.lock.Lock()
+	d.save()
+	d.lock.Unlock()
+}
+
+/* Find resources with the prefix of the tracer, that are not recorded. They are created by someone else */
+func (d *resourceDb) scanUnknown() {
+	if d.tracefs == nil {
+		return
+	}
+	found := []*TraceResource{}
+	if all, err := d.tracefs.Instances(instancePrefix); err == nil {
+		for _, i := range all {
+			found = append(found, &TraceResource{Kind: ResourceInstance, Name: i.Name})
+		}
+	}
+	if all, err := d.tracefs.DynamicEvents(""); err == nil {
+		for _, e := range all {
+			if strings.HasPrefix(e, instancePrefix) {
+				found = append(found, &TraceResource{Kind: ResourceDynamicEvent, Name: e})
+			}
+		}
+	}
+	for _, r := range found {
+		if _, ok := d.all[r.key()]; !ok {
+			r.Orphan = true
+			d.all[r.key()] = r
+		}
+	}
+}
+
+/* Drop the orphans, that do not exist anymore, and find the new unknown ones */
+func (d *resourceDb) refresh() {
+	for k, r := range d.all {
+		if r.Orphan && !d.exists(r) {
+			delete(d.all, k)
+		}
+	}
+	d.scanUnknown()
+}
+
+/* Load the resources, left by the previous run of the tracer. All of them are orphans */
+func (d *resourceDb) load() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.stateFile != "" {
+		data, err := os.ReadFile(d.stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			var all []*TraceResource
+			if err := json.Unmarshal(data, &all); err != nil {
+				return fmt.Errorf("Invalid state file %s: %v", d.stateFile, err)
+			}
+			for _, r := range all {
+				r.Owned = true
+				r.Orphan = true
+				d.all[r.key()] = r
+			}
+		}
+	}
+	d.refresh()
+	d.save()
+
+	return nil
+}
+
+/*
+ * Remove the orphans, according to the orphan policy. Returns true if all orphans are removed,
+ * including the ones created by someone else.
+ */
+func (d *resourceDb) cleanup() bool {
+	if d.policy == OrphanKeep {
+		return false
+	}
+
+	d.lock.Lock()
+	d.refresh()
+	orphans := []*TraceResource{}
+	for _, r := range d.all {
+		if r.Orphan && (r.Owned || d.policy == OrphanRemoveAll) {
+			orphans = append(orphans, r)
+		}
+	}
+	d.lock.Unlock()
+
+	sortResources(orphans)
+	for _, r := range orphans {
+		if err := d.remove(r); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove orphaned trace %s %s: %v\n", r.Kind, r.Name, err)
+			continue
+		}
+		d.lock.Lock()
+		delete(d.all, r.key())
+		d.lock.Unlock()
+	}
+
+	d.lock.Lock()
+	d.save()
+	d.lock.Unlock()
+
+	return d.policy == OrphanRemoveAll
+}
+
+/* Get all resources, used by the running sessions and the orphaned ones */
+func (d *resourceDb) list() []TraceResource {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.refresh()
+	res := []TraceResource{}
+	for _, r := range d.all {
+		res = append(res, *r)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].key() < res[j].key()
+	})
+
+	return res
+}
+
+/*
+ * Report a kernel trace resource, created for the session. When the session stops, the tracer removes
+ * the resource, if the hook has not removed it already.
+ */
+func (s *Session) Own(kind, name string) {
+	r := &TraceResource{
+		Kind:    kind,
+		Name:    name,
+		Created: time.Now(),
+	}
+
+	s.resLock.Lock()
+	s.resources = append(s.resources, r)
+	db := s.resDb
+	if db != nil {
+		r.Session, r.Hook = s.resSession, s.resHook
+	}
+	released := s.resReleased
+	s.resLock.Unlock()
+
+	if db == nil {
+		return
+	}
+	db.add(r)
+	if released {
+		s.releaseResources()
+	}
+}
+
+/* Attach the session to the resources database. The resources, reported before that, are recorded now */
+func (s *Session) setOwner(db *resourceDb, session, hook string) {
+	s.resLock.Lock()
+	s.resDb, s.resSession, s.resHook = db, session, hook
+	all := append([]*TraceResource{}, s.resources...)
+	released := s.resReleased
+	s.resLock.Unlock()
+
+	for _, r := range all {
+		r.Session, r.Hook = session, hook
+		db.add(r)
+	}
+	if released {
+		s.releaseResources()
+	}
+}
+
+/* Remove the resources of a stopped session */
+func (s *Session) releaseResources() {
+	s.resLock.Lock()
+	s.resReleased = true
+	db := s.resDb
+	if db == nil {
+		s.resLock.Unlock()
+		return
+	}
+	all := s.resources
+	s.resources = nil
+	s.resLock.Unlock()
+
+	db.release(all)
+}
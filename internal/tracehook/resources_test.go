@@ -0,0 +1,170 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracehook
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func resourcesDb(t *testing.T, tracefs, state, policy string) *TraceHooks {
+	hooks := t.TempDir()
+	db, err := NewTraceHooksDb(&HookConfig{
+		HooksPath:    &hooks,
+		Tracefs:      &tracefs,
+		StateFile:    &state,
+		OrphanPolicy: &policy,
+	})
+	assert.Nil(t, err)
+	return db
+}
+
+func resourceNames(all []TraceResource) []string {
+	res := []string{}
+	for _, r := range all {
+		res = append(res, r.Name)
+	}
+	return res
+}
+
+func stateNames(t *testing.T, state string) []string {
+	var all []TraceResource
+	assert.Nil(t, json.Unmarshal([]byte(readFile(t, state)), &all))
+	return resourceNames(all)
+}
+
+func TestOrphans(t *testing.T) {
+	tracefs := t.TempDir()
+	state := filepath.Join(t.TempDir(), "state", "resources.json")
+	instance := func(name string) string {
+		return filepath.Join(tracefs, "instances", name)
+	}
+
+	/* Resources, left by a crash of the tracer, and the ones created by someone else */
+	for _, i := range []string{instancePrefix + "old", instancePrefix + "other", "other"} {
+		assert.Nil(t, os.MkdirAll(instance(i), 0750))
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(tracefs, "dynamic_events"),
+		[]byte("p:"+instancePrefix+"old/p_open do_sys_open\n"), 0640))
+	assert.Nil(t, os.MkdirAll(filepath.Dir(state), 0750))
+	owned, err := json.Marshal([]TraceResource{
+		{Kind: ResourceInstance, Name: instancePrefix + "old", Session: "1"},
+		{Kind: ResourceInstance, Name: instancePrefix + "gone", Session: "1"},
+		{Kind: ResourceDynamicEvent, Name: instancePrefix + "old/p_open", Session: "1"},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(state, owned, 0640))
+
+	_, err = NewTraceHooksDb(&HookConfig{Tracefs: &tracefs, OrphanPolicy: &NativeManager})
+	assert.NotNil(t, err)
+
+	/* The orphans are only reported by default */
+	db := resourcesDb(t, tracefs, state, "")
+	all := db.Resources()
+	assert.Equal(t, []TraceResource{
+		{Kind: ResourceDynamicEvent, Name: instancePrefix + "old/p_open", Session: "1", Owned: true, Orphan: true},
+		{Kind: ResourceInstance, Name: instancePrefix + "old", Session: "1", Owned: true, Orphan: true},
+		{Kind: ResourceInstance, Name: instancePrefix + "other", Orphan: true},
+	}, all)
+	db.ResetAll()
+	assert.DirExists(t, instance(instancePrefix+"old"))
+	assert.ElementsMatch(t, []string{instancePrefix + "old", instancePrefix + "old/p_open"}, stateNames(t, state))
+
+	/* Only the orphans, created by the tracer, are removed */
+	db = resourcesDb(t, tracefs, state, OrphanRemove)
+	assert.Equal(t, []string{instancePrefix + "other"}, resourceNames(db.Resources()))
+	assert.NoDirExists(t, instance(instancePrefix+"old"))
+	assert.Equal(t, "", readFile(t, filepath.Join(tracefs, "dynamic_events")))
+	assert.Equal(t, []string{}, stateNames(t, state))
+
+	db = resourcesDb(t, tracefs, state, OrphanRemoveAll)
+	assert.Equal(t, []string{}, resourceNames(db.Resources()))
+	assert.NoDirExists(t, instance(instancePrefix+"other"))
+	assert.DirExists(t, instance("other"))
+}
+
+func TestNativeResources(t *testing.T) {
+	db, tracefs := fakeHooksDb(t)
+	state := filepath.Join(t.TempDir(), "resources.json")
+	db.resources.stateFile = state
+
+	name := "syscalls"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	pids := []int{os.Getpid()}
+	params := []string{"-s", "openat"}
+	s, err := db.Run(th, &pids, nil, &params, &HookContext{Session: "7"})
+	assert.Nil(t, err)
+
+	all := db.Resources()
+	if assert.Equal(t, 1, len(all)) {
+		assert.Equal(t, ResourceInstance, all[0].Kind)
+		assert.Equal(t, "7", all[0].Session)
+		assert.Equal(t, "native/syscalls", all[0].Hook)
+		assert.True(t, all[0].Owned)
+		assert.False(t, all[0].Orphan)
+		assert.DirExists(t, filepath.Join(tracefs, "instances", all[0].Name))
+	}
+	assert.Equal(t, resourceNames(all), stateNames(t, state))
+
+	assert.Nil(t, db.Stop(s, true))
+	assert.Equal(t, 0, len(db.Resources()))
+	assert.Equal(t, []string{}, stateNames(t, state))
+}
+
+/* A manager, that creates a trace instance and does not remove it */
+var resourceManager = `#!/bin/sh
+case "$1" in
+	--protocol-version) echo 2 ;;
+	--get-all) echo trace_leak ;;
+	--describe) echo "Leak a trace instance" ;;
+	--run)
+		fd=$TRACER_HOOK_PROTOCOL_FD
+		mkdir "$TEST_TRACEFS/instances/kube_leak"
+		echo '{"version": 2, "type": "resource", "kind": "instance", "name": "../leak"}' >&$fd
+		echo '{"version": 2, "type": "resource", "kind": "instance", "name": "kube_leak"}' >&$fd
+		echo '{"version": 2, "type": "output", "path": "/trace/pipe"}' >&$fd
+		echo '{"version": 2, "type": "ready"}' >&$fd
+		exec sleep 10
+		;;
+esac
+`
+
+func TestHookResources(t *testing.T) {
+	hooks := t.TempDir()
+	tracefs := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(tracefs, "instances"), 0750))
+	t.Setenv("TEST_TRACEFS", tracefs)
+	dir := filepath.Join(hooks, "leak")
+	assert.Nil(t, os.Mkdir(dir, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(resourceManager), 0750))
+	db, err := NewTraceHooksDb(&HookConfig{HooksPath: &hooks, Tracefs: &tracefs})
+	assert.Nil(t, err)
+
+	name := "leak/trace_leak"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	pids := []int{os.Getpid()}
+	s, err := db.Run(th, &pids, nil, nil, &HookContext{Session: "3"})
+	assert.Nil(t, err)
+	assert.Nil(t, db.WaitStart(s))
+	assert.Equal(t, 1, len(s.Status().Warnings))
+	all := db.Resources()
+	if assert.Equal(t, 1, len(all)) {
+		assert.Equal(t, "kube_leak", all[0].Name)
+		assert.Equal(t, "3", all[0].Session)
+		assert.False(t, all[0].Orphan)
+	}
+
+	/* The hook is killed and cannot clean up, the tracer removes its instance */
+	db.Stop(s, true)
+	assert.NoDirExists(t, filepath.Join(tracefs, "instances", "kube_leak"))
+	assert.Equal(t, 0, len(db.Resources()))
+}
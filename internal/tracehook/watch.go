@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Rescan of the trace hooks at runtime, on request or on changes in the hooks directory.
+ */
+package tracehook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	watchPollMs   = 500
+	watchDebounce = time.Second /* Wait for the changes to settle, before rescanning */
+	watchEvents   = uint32(unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+		unix.IN_CLOSE_WRITE | unix.IN_ATTRIB | unix.IN_DELETE_SELF)
+)
+
+type HooksChange struct {
+	Added   []string /* Hooks, found by the rescan */
+	Removed []string /* Hooks, that are not available anymore. Running sessions are not affected */
+}
+
+/* Get the qualified names of all hooks */
+func (h *TraceHooks) hookNames() map[string]bool {
+	res := make(map[string]bool)
+
+	for _, m := range *h.Get() {
+		for _, th := range m.Tracers {
+			res[th.FullName] = true
+		}
+	}
+	return res
+}
+
+/* Discover the hooks again and return the changes */
+func (h *TraceHooks) Rescan() (*HooksChange, error) {
+	res := HooksChange{
+		Added:   []string{},
+		Removed: []string{},
+	}
+
+	old := h.hookNames()
+	if err := h.discoverHooks(); err != nil {
+		return nil, err
+	}
+	now := h.hookNames()
+
+	for n := range now {
+		if !old[n] {
+			res.Added = append(res.Added, n)
+		}
+	}
+	for n := range old {
+		if !now[n] {
+			res.Removed = append(res.Removed, n)
+		}
+	}
+	sort.Strings(res.Added)
+	sort.Strings(res.Removed)
+	if len(res.Added) > 0 || len(res.Removed) > 0 {
+		log.Printf("Trace hooks rescanned, added %v, removed %v", res.Added, res.Removed)
+	}
+
+	return &res, nil
+}
+
+/* Watch the hooks directory and all its sub-directories. Old watches are removed */
+func (h *TraceHooks) addWatches(fd int, watches map[int]string) {
+	for w := range watches {
+		unix.InotifyRmWatch(fd, uint32(w))
+		delete(watches, w)
+	}
+
+	filepath.WalkDir(*h.topDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if path != *h.topDir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if w, err := unix.InotifyAddWatch(fd, path, watchEvents); err == nil {
+			watches[w] = path
+		}
+		return nil
+	})
+}
+
+/* Read all pending inotify events, returns true if there was at least one */
+func readEvents(fd int) bool {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	found := false
+
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil || n <= 0 {
+			return found
+		}
+		found = true
+	}
+}
+
+/*
+ * Watch the hooks directory for changes and rescan the hooks when something changes.
+ * Blocks until the context is done.
+ */
+func (h *TraceHooks) Watch(ctx context.Context) error {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("Failed to watch trace hooks directory %s: %v", *h.topDir, err)
+	}
+	defer unix.Close(fd)
+
+	watches := make(map[int]string)
+	h.addWatches(fd, watches)
+	if len(watches) == 0 {
+		return fmt.Errorf("Failed to watch trace hooks directory %s", *h.topDir)
+	}
+
+	var changed time.Time
+	pfd := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		if n, err := unix.Poll(pfd, watchPollMs); err == nil && n > 0 && readEvents(fd) {
+			changed = time.Now()
+			continue
+		}
+		if !changed.IsZero() && time.Since(changed) >= watchDebounce {
+			changed = time.Time{}
+			if _, err := h.Rescan(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			/* New sub-directories may be added */
+			h.addWatches(fd, watches)
+		}
+	}
+}
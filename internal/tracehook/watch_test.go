@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracehook
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var fakeManager = `#!/bin/sh
+case "$1" in
+	--get-all) echo trace_fake ;;
+	--describe) echo "Fake trace hook" ;;
+esac
+`
+
+func TestRescan(t *testing.T) {
+	db, _ := fakeHooksDb(t)
+	dir := filepath.Join(*db.topDir, "fake")
+
+	assert.Nil(t, os.Mkdir(dir, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(fakeManager), 0750))
+	ch, err := db.Rescan()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fake/trace_fake"}, ch.Added)
+	assert.Equal(t, 0, len(ch.Removed))
+
+	name := "trace_fake"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+
+	/* Removed hooks are not available anymore, but the old references stay valid */
+	assert.Nil(t, os.RemoveAll(dir))
+	ch, err = db.Rescan()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fake/trace_fake"}, ch.Removed)
+	_, err = db.GetHook(&name)
+	assert.NotNil(t, err)
+	assert.Equal(t, "trace_fake", th.Name)
+	assert.Equal(t, []string{"Fake trace hook"}, th.Description)
+}
+
+func TestQualifiedNames(t *testing.T) {
+	db, _ := fakeHooksDb(t)
+
+	for _, d := range []string{"fake", "other/fake"} {
+		dir := filepath.Join(*db.topDir, d)
+		assert.Nil(t, os.MkdirAll(dir, 0750))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(fakeManager), 0750))
+	}
+	ch, err := db.Rescan()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fake/trace_fake", "other/fake/trace_fake"}, ch.Added)
+
+	/* Names, provided by more than one manager, must be qualified */
+	name := "trace_fake"
+	_, err = db.GetHook(&name)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "fake/trace_fake, other/fake/trace_fake")
+	assert.Equal(t, map[string][]string{"trace_fake": {"fake/trace_fake", "other/fake/trace_fake"}},
+		duplicateHooks(*db.Get()))
+
+	name = "other/fake/trace_fake"
+	th, err := db.GetHook(&name)
+	assert.Nil(t, err)
+	assert.Equal(t, "trace_fake", th.Name)
+	assert.Equal(t, name, th.FullName)
+	assert.Equal(t, "other/fake", th.manager.Name)
+
+	/* Unique names are resolved without the manager */
+	name = "syscalls"
+	th, err = db.GetHook(&name)
+	assert.Nil(t, err)
+	assert.Equal(t, NativeManager+"/syscalls", th.FullName)
+	name = "fake/syscalls"
+	_, err = db.GetHook(&name)
+	assert.NotNil(t, err)
+}
+
+func TestWatch(t *testing.T) {
+	db, _ := fakeHooksDb(t)
+	dir := filepath.Join(*db.topDir, "fake")
+	name := "trace_fake"
+
+	watchDebounce = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- db.Watch(ctx)
+	}()
+	/* Give the watcher time to set up the watches */
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Nil(t, os.Mkdir(dir, 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "manager.sh"), []byte(fakeManager), 0750))
+	assert.Eventually(t, func() bool {
+		_, err := db.GetHook(&name)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	assert.Nil(t, os.Remove(filepath.Join(dir, "manager.sh")))
+	assert.Eventually(t, func() bool {
+		_, err := db.GetHook(&name)
+		return err != nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
@@ -8,18 +8,91 @@
 package tracerctx
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/vmware-labs/container-tracer/internal/pods"
+	"github.com/vmware-labs/container-tracer/internal/tracehook"
 )
 
+var (
+	podsRevisionHeader = "X-Pods-Revision"
+	podsWatchInterval  = 2 * time.Second
+)
+
+/*
+ * Parse the revision of the pods database, passed by the user. It can be either a number or a comma
+ * separated list of <node>=<revision> pairs, when the request is sent to all nodes in the cluster.
+ * Nodes, that are not in the list, return all of their containers.
+ */
+func (t *Tracer) parseRevision(str string) (uint64, error) {
+	if !strings.Contains(str, "=") {
+		return strconv.ParseUint(str, 10, 64)
+	}
+	for _, r := range strings.Split(str, ",") {
+		nr := strings.SplitN(r, "=", 2)
+		if len(nr) != 2 {
+			return 0, fmt.Errorf("Invalid revision %s", r)
+		}
+		if strings.TrimSpace(nr[0]) == *t.node {
+			return strconv.ParseUint(strings.TrimSpace(nr[1]), 10, 64)
+		}
+	}
+
+	return 0, nil
+}
+
 // get all pods, running on the local node
+// if since is passed, get only the changes after the given revision of the pods database
+// if stats is passed, include the resource usage of each container
+// if sort is passed, get a list of the top containers, sorted by their resource usage
 func (t *Tracer) LocalPodsGet(c *gin.Context) {
 	if e := t.pods.Scan(); e != nil {
 		c.JSON(http.StatusInternalServerError, e.Error())
 	}
+	c.Header(podsRevisionHeader, strconv.FormatUint(t.pods.Revision(), 10))
+	if since, ok := c.GetQuery("since"); ok {
+		rev, err := t.parseRevision(since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		if ch, err := t.pods.Changes(rev); err == nil {
+			c.JSON(http.StatusOK, map[string]*pods.PodChanges{*t.node: ch})
+		} else {
+			/* The changes are not known, the client must get all containers again */
+			c.JSON(http.StatusGone, err.Error())
+		}
+		return
+	}
+	if by, ok := c.GetQuery("sort"); ok {
+		top := 0
+		if n, ok := c.GetQuery("top"); ok {
+			var err error
+			if top, err = strconv.Atoi(n); err != nil {
+				c.JSON(http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		t.pods.ScanStats()
+		if res, err := t.pods.TopContainers(by, top); err == nil {
+			c.JSON(http.StatusOK, map[string][]*pods.Container{*t.node: res})
+		} else {
+			c.JSON(http.StatusBadRequest, err.Error())
+		}
+		return
+	}
 	cdb := t.pods.Get()
+	if st, ok := c.GetQuery("stats"); ok && st != "false" {
+		t.pods.ScanStats()
+		cdb = t.pods.GetStats()
+	}
 	if cdb != nil && len(*cdb) > 0 {
 		c.JSON(http.StatusOK, cdb)
 	} else {
@@ -27,9 +100,71 @@ func (t *Tracer) LocalPodsGet(c *gin.Context) {
 	}
 }
 
-// get all trace hooks
+// stream the changes in the pods database, running on the local node
+// the database is scanned periodically while there are watchers, shared by all of them
+func (t *Tracer) LocalPodsWatch(c *gin.Context) {
+	var rev uint64
+	var err error
+
+	if since, ok := c.GetQuery("since"); ok {
+		if rev, err = t.parseRevision(since); err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	t.watch.add()
+	defer t.watch.remove()
+
+	next := t.watch.next()
+	ch, err := t.pods.Changes(rev)
+	if err != nil {
+		c.JSON(http.StatusGone, err.Error())
+		return
+	}
+
+	/* Send the headers now, the proxies wait for them before streaming */
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		if len(ch.Changes) > 0 {
+			if data, err := json.Marshal(map[string]*pods.PodChanges{*t.node: ch}); err == nil {
+				w.Write(append(data, '\n'))
+			}
+			rev = ch.Revision
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-next:
+		}
+		next = t.watch.next()
+		/* The client is too slow, the changes it has not seen are no longer in the change log */
+		if ch, err = t.pods.Changes(rev); err != nil {
+			return false
+		}
+		return true
+	})
+}
+
+// get the health state of the tracer on the local node
+func (t *Tracer) HealthGet(c *gin.Context) {
+	t.pods.Scan()
+	h := t.getHealth()
+	res := map[string]*tracerHealth{
+		h.Node: h,
+	}
+	if h.Status == healthFailed {
+		c.JSON(http.StatusServiceUnavailable, res)
+	} else {
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// get all trace hooks, available on this node
+// if all=true, the hooks that cannot be used on this node are listed as well
 func (t *Tracer) TraceHooksGet(c *gin.Context) {
-	h := t.hooks.Get()
+	h := t.hooks.List(c.Query("all") == "true")
 	if h != nil && len(*h) > 0 {
 		c.JSON(http.StatusOK, h)
 	} else {
@@ -37,6 +172,20 @@ func (t *Tracer) TraceHooksGet(c *gin.Context) {
 	}
 }
 
+// rescan the trace hooks and get the added and removed hooks
+func (t *Tracer) TraceHooksRescan(c *gin.Context) {
+	if resp, err := t.hooks.Rescan(); err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+	} else {
+		c.JSON(http.StatusOK, map[string]*tracehook.HooksChange{*t.node: resp})
+	}
+}
+
+// get the kernel trace resources of the running trace sessions and the orphaned ones
+func (t *Tracer) TraceResourcesGet(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string][]tracehook.TraceResource{*t.node: t.hooks.Resources()})
+}
+
 // get all trace sessions
 func (t *Tracer) TraceSessionGet(c *gin.Context) {
 	id := c.Param("id")
@@ -52,6 +201,44 @@ func (t *Tracer) TraceSessionGet(c *gin.Context) {
 	}
 }
 
+// get all processes of the containers in a trace session
+func (t *Tracer) TraceSessionProcessesGet(c *gin.Context) {
+	id := c.Param("id")
+
+	if resp, err := t.getSessionProcesses(&id); err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+	} else {
+		c.JSON(http.StatusOK, *resp)
+	}
+}
+
+// stream the trace events of a running trace session
+func (t *Tracer) TraceSessionEventsGet(c *gin.Context) {
+	id := c.Param("id")
+
+	ch, unsubscribe, err := t.subscribeSession(&id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	defer unsubscribe()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case ev, ok := <-ch:
+			if !ok {
+				return false
+			}
+			if data, err := json.Marshal(ev); err == nil {
+				w.Write(append(data, '\n'))
+			}
+			return true
+		}
+	})
+}
+
 // modify a trace session
 func (t *Tracer) TraceSessionPut(c *gin.Context) {
 	var s sessionChange
@@ -91,7 +278,8 @@ func (t *Tracer) TraceSessionPost(c *gin.Context) {
 }
 
 // delete a trace session
-// if id == "all", all trace sessions are deleted and trace subsystems are reseted
+// if id == "all", all trace sessions are deleted and the orphaned trace resources are cleaned up
+// according to the orphan policy
 func (t *Tracer) TraceSessionDel(c *gin.Context) {
 	id := c.Param("id")
 	if id == "all" {
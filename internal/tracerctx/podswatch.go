@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ * Periodic scan of the pods database, shared by all clients watching for its changes.
+ */
+package tracerctx
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vmware-labs/container-tracer/internal/pods"
+)
+
+type podsWatch struct {
+	lock     sync.Mutex
+	pods     *pods.PodDb
+	interval time.Duration
+	watchers int
+	stop     chan struct{}
+	scanned  chan struct{} /* Closed after the next scan */
+}
+
+func newPodsWatch(db *pods.PodDb, interval time.Duration) *podsWatch {
+	return &podsWatch{
+		pods:     db,
+		interval: interval,
+		scanned:  make(chan struct{}),
+	}
+}
+
+/* Register a new watcher. The database is scanned only while there are watchers */
+func (w *podsWatch) add() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.watchers++
+	if w.watchers == 1 {
+		w.stop = make(chan struct{})
+		go w.run(w.stop)
+	}
+}
+
+func (w *podsWatch) remove() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.watchers--
+	if w.watchers == 0 {
+		close(w.stop)
+	}
+}
+
+/* Get a channel, which is closed after the next scan of the database */
+func (w *podsWatch) next() <-chan struct{} {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.scanned
+}
+
+func (w *podsWatch) run(stop chan struct{}) {
+	tick := time.NewTicker(w.interval)
+	defer tick.Stop()
+
+	for {
+		w.pods.Scan()
+		w.lock.Lock()
+		close(w.scanned)
+		w.scanned = make(chan struct{})
+		w.lock.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracerctx
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware-labs/container-tracer/internal/pods"
+	"github.com/vmware-labs/container-tracer/internal/pods/fakecri"
+)
+
+/* A tracer with a fake container runtime, serving the pods API */
+func podsTracer(t *testing.T) (*Tracer, *fakecri.Runtime, *httptest.Server) {
+	r, err := fakecri.NewRuntime("containerd")
+	if err != nil {
+		t.Fatal("Failed to start fake runtime: ", err)
+	}
+	t.Cleanup(r.Destroy)
+	r.Add(&fakecri.Container{Id: "c1", Name: "app", Pod: "web", Namespace: "default", Pid: 101})
+
+	db, err := pods.NewPodDb(context.Background(), &pods.PodConfig{
+		Cri: pods.CriConfig{Endpoints: []string{r.Endpoint}},
+	}, nil, nil)
+	assert.Nil(t, err)
+	node := "node1"
+	tr := &Tracer{pods: db, node: &node, watch: newPodsWatch(db, 50*time.Millisecond)}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/v1/pods", tr.LocalPodsGet)
+	router.GET("/v1/pods/watch", tr.LocalPodsWatch)
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+
+	return tr, r, srv
+}
+
+func readChanges(t *testing.T, scan *bufio.Scanner) *pods.PodChanges {
+	if !scan.Scan() {
+		t.Fatal("Watch stream ended: ", scan.Err())
+	}
+	var res map[string]*pods.PodChanges
+	assert.Nil(t, json.Unmarshal(scan.Bytes(), &res))
+	return res["node1"]
+}
+
+func TestPodsSince(t *testing.T) {
+	tr, _, srv := podsTracer(t)
+	rev := tr.pods.Revision()
+
+	for since, code := range map[string]int{
+		"0":                                    http.StatusOK,
+		"1":                                    http.StatusOK,
+		"99":                                   http.StatusGone,
+		"node2=99":                             http.StatusOK,
+		"node1=99,node2=1":                     http.StatusGone,
+		"ten":                                  http.StatusBadRequest,
+		"node1":                                http.StatusBadRequest,
+		"node1=" + strconv.FormatUint(rev, 10): http.StatusOK,
+	} {
+		resp, err := http.Get(srv.URL + "/v1/pods?since=" + since)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, code, resp.StatusCode, since)
+	}
+
+	resp, err := http.Get(srv.URL + "/v1/pods/watch?since=99")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestPodsWatch(t *testing.T) {
+	tr, r, srv := podsTracer(t)
+
+	/* All watchers share the same scans */
+	ctx, cancel := context.WithCancel(context.Background())
+	streams := []*bufio.Scanner{}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/v1/pods/watch", nil)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		defer resp.Body.Close()
+		streams = append(streams, bufio.NewScanner(resp.Body))
+	}
+	tr.watch.lock.Lock()
+	assert.Equal(t, 2, tr.watch.watchers)
+	tr.watch.lock.Unlock()
+
+	for _, s := range streams {
+		ch := readChanges(t, s)
+		assert.True(t, ch.Full)
+		assert.Len(t, ch.Changes, 1)
+	}
+
+	r.Add(&fakecri.Container{Id: "c2", Name: "db", Pod: "store", Namespace: "default", Pid: 201})
+	for _, s := range streams {
+		ch := readChanges(t, s)
+		assert.False(t, ch.Full)
+		if assert.Len(t, ch.Changes, 1) {
+			assert.Equal(t, pods.ChangeAdded, ch.Changes[0].Type)
+			assert.Equal(t, "store", ch.Changes[0].Pod)
+		}
+	}
+
+	/* The scans stop with the last watcher */
+	cancel()
+	assert.Eventually(t, func() bool {
+		tr.watch.lock.Lock()
+		defer tr.watch.lock.Unlock()
+		return tr.watch.watchers == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -8,11 +8,12 @@
 package tracerctx
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/vmware-labs/container-tracer/internal/logger"
 	"github.com/vmware-labs/container-tracer/internal/pods"
@@ -20,16 +21,15 @@ import (
 )
 
 var (
-	idGenRetries        = 100
-	sessionStartTimeout = 50
+	idGenRetries = 100
 )
 
 type sessionNew struct {
-	Pod              string `json:"pod"`
-	Container        string `json:"container"`
-	TraceHook        string `json:"trace-hook"`
-	TraceArguments   string `json:"trace-arguments"`
-	TraceUserContext string `json:"trace-user-context"`
+	Pod              string          `json:"pod"`
+	Container        string          `json:"container"`
+	TraceHook        string          `json:"trace-hook"`
+	TraceArguments   json.RawMessage `json:"trace-arguments"` /* A string, an array or an object */
+	TraceUserContext string          `json:"trace-user-context"`
 }
 
 type sessionChange struct {
@@ -46,11 +46,14 @@ type traceSessionInfo struct {
 	Running     bool
 	Output      *[]string
 	Error       *[]string
+	Hook        *tracehook.HookStatus `json:",omitempty"` /* State of the hook, if it supports the protocol */
+	Sched       []*logger.SchedStats  `json:",omitempty"` /* Scheduling statistics, if the hook traces the scheduler */
 }
 
 type traceSession struct {
 	pod          *string
 	containers   []*pods.Container
+	pids         *pods.PidMap
 	tHook        *tracehook.TraceHook
 	tHookParam   []string
 	userContext  *string
@@ -89,7 +92,7 @@ func (t *Tracer) getSessionInfo(id uint64) (*traceSessionInfo, error) {
 	}
 	res := traceSessionInfo{
 		Running:     false,
-		TraceHook:   &s.tHook.Name,
+		TraceHook:   &s.tHook.FullName,
 		TraceParams: &s.tHookParam,
 		Context:     s.userContext,
 		Containers:  make(map[string][]*string),
@@ -100,7 +103,9 @@ func (t *Tracer) getSessionInfo(id uint64) (*traceSessionInfo, error) {
 	if s.tHookSession != nil {
 		res.Running = true
 		res.Output, res.Error = s.tHookSession.GetOutput()
+		res.Hook = s.tHookSession.Status()
 	}
+	res.Sched = s.log.SchedStats()
 	for _, c := range s.containers {
 		if _, ok := res.Containers[*c.Pod]; !ok {
 			res.Containers[*c.Pod] = []*string{}
@@ -111,6 +116,85 @@ func (t *Tracer) getSessionInfo(id uint64) (*traceSessionInfo, error) {
 	return &res, nil
 }
 
+func argumentValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	}
+	return "", fmt.Errorf("Unsupported trace argument %v", v)
+}
+
+/*
+ * Convert the trace arguments to a list of hook arguments. The arguments can be passed as:
+ *  - a string, split on white spaces. Kept for backward compatibility.
+ *  - an array, each item is passed to the hook as a single argument.
+ *  - an object, each property is passed to the hook as "--<name> <values>". Arrays are passed as
+ *    multiple values, boolean properties are passed as "--<name>" if true and skipped if false.
+ */
+func parseArguments(raw json.RawMessage) ([]string, error) {
+	var str string
+	var arr []interface{}
+	var obj map[string]interface{}
+	res := []string{}
+
+	if len(raw) == 0 || string(raw) == "null" {
+		return res, nil
+	}
+
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return append(res, strings.Fields(str)...), nil
+	}
+
+	if err := json.Unmarshal(raw, &arr); err == nil {
+		for _, a := range arr {
+			if v, err := argumentValue(a); err == nil {
+				res = append(res, v)
+			} else {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, fmt.Errorf("Trace arguments must be a string, an array or an object")
+	}
+	names := []string{}
+	for n := range obj {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		switch val := obj[n].(type) {
+		case bool:
+			if val {
+				res = append(res, "--"+n)
+			}
+		case []interface{}:
+			res = append(res, "--"+n)
+			for _, a := range val {
+				if v, err := argumentValue(a); err == nil {
+					res = append(res, v)
+				} else {
+					return nil, err
+				}
+			}
+		default:
+			if v, err := argumentValue(val); err == nil {
+				res = append(res, "--"+n, v)
+			} else {
+				return nil, err
+			}
+		}
+	}
+
+	return res, nil
+}
+
 func (t *Tracer) newSession(s *sessionNew) (uint64, error) {
 	var e error
 	var id uint64
@@ -120,8 +204,8 @@ func (t *Tracer) newSession(s *sessionNew) (uint64, error) {
 		pod:         &s.Pod,
 	}
 
-	for _, w := range strings.Fields(s.TraceArguments) {
-		ts.tHookParam = append(ts.tHookParam, w)
+	if ts.tHookParam, e = parseArguments(s.TraceArguments); e != nil {
+		return 0, e
 	}
 
 	if id, e = t.sessions.newId(); e != nil {
@@ -135,14 +219,54 @@ func (t *Tracer) newSession(s *sessionNew) (uint64, error) {
 	if ts.tHook, e = t.hooks.GetHook(&s.TraceHook); e != nil {
 		return 0, e
 	}
+	if e = ts.tHook.Validate(ts.tHookParam); e != nil {
+		return 0, e
+	}
 
 	t.sessions.all[id] = &ts
 	return id, nil
 }
 
+/* Describe the session and its containers to the hook, so it does not have to look them up again */
+func (t *Tracer) hookContext(s *traceSession, sid string) *tracehook.HookContext {
+	res := tracehook.HookContext{
+		Node:       *t.node,
+		Session:    sid,
+		Containers: []tracehook.HookContainer{},
+	}
+	if s.userContext != nil {
+		res.User = *s.userContext
+	}
+
+	for _, c := range s.containers {
+		hc := tracehook.HookContainer{
+			Pod:       *c.Pod,
+			Namespace: c.Namespace,
+			Name:      *c.Id,
+			Id:        c.RuntimeId(),
+		}
+		if c.Runtime != nil {
+			hc.Runtime = *c.Runtime
+		}
+		if len(c.Tasks) > 0 {
+			hc.Cgroups, _ = t.pods.Cgroups(c.Tasks[0])
+			hc.Namespaces = t.pods.Namespaces(c.Tasks[0])
+		}
+		/* Found by the pods scan from any of the tasks, the network hooks filter the events by it */
+		if c.NetNs != 0 {
+			if hc.Namespaces == nil {
+				hc.Namespaces = make(map[string]int)
+			}
+			hc.Namespaces["net"] = c.NetNs
+		}
+		res.Containers = append(res.Containers, hc)
+	}
+
+	return &res
+}
+
 func (t *Tracer) startSession(id uint64) error {
 	var s *traceSession
-	var stdout, stderr *[]string
 	var ok bool
 	var err error
 
@@ -160,32 +284,33 @@ func (t *Tracer) startSession(id uint64) error {
 		parent = append(parent, p.Parent...)
 	}
 
+	sid := strconv.FormatUint(id, 10)
+	hctx := t.hookContext(s, sid)
 	if len(parent) > 0 {
-		s.tHookSession, err = t.hooks.Run(s.tHook, &pids, &parent, &s.tHookParam, s.userContext)
+		s.tHookSession, err = t.hooks.Run(s.tHook, &pids, &parent, &s.tHookParam, hctx)
 	} else {
-		s.tHookSession, err = t.hooks.Run(s.tHook, &pids, nil, &s.tHookParam, s.userContext)
+		s.tHookSession, err = t.hooks.Run(s.tHook, &pids, nil, &s.tHookParam, hctx)
 	}
 	if err == nil {
-		sid := strconv.FormatUint(id, 10)
+		s.pids = t.pods.NewPidMap(s.containers)
 		s.log = logger.LogJob{
 			Name:    *s.userContext,
 			Node:    *t.node,
 			Pod:     *s.pod,
-			Job:     s.tHook.Name,
+			Job:     s.tHook.FullName,
 			Session: sid,
+			Pids:    s.pids,
+			Files:   s.pids,
 		}
 
-		for i := 0; i < sessionStartTimeout; i++ {
-			stdout, stderr = s.tHookSession.GetOutput()
-			if len(*stderr) > 0 || len(*stdout) > 0 {
-				break
-			}
-			time.Sleep(100 * time.Millisecond)
-		}
-		if len(*stderr) < 1 && len(*stdout) > 0 {
-			s.log.File = (*stdout)[0]
-			t.logger.RunLogJob(&s.log)
+		if err = t.hooks.WaitStart(s.tHookSession); err != nil {
+			s.tHookSession = nil
+			return err
 		}
+		s.log.File, s.log.Format = s.tHookSession.TraceFile()
+		s.log.Input = s.tHookSession.Output()
+		s.log.Filter = s.tHookSession.Filter()
+		t.logger.RunLogJob(&s.log)
 	}
 
 	return err
@@ -201,9 +326,10 @@ func (t *Tracer) stopSession(id uint64) error {
 	}
 
 	if s.tHookSession != nil {
+		/* The trace instance cannot be removed by the hook while its trace pipe is open */
+		t.logger.StopLogJob(&s.log)
 		err = t.hooks.Stop(s.tHookSession, true)
 		s.tHookSession = nil
-		t.logger.StopLogJob(&s.log)
 	}
 
 	return err
@@ -264,6 +390,49 @@ func (t *Tracer) getSession(id *string, running bool) (*map[string]*traceSession
 	return &res, nil
 }
 
+/* Get all processes of the containers in a session, with their host and container PIDs */
+func (t *Tracer) getSessionProcesses(id *string) (*map[string][]pods.PidInfo, error) {
+	var s *traceSession
+	var ok bool
+
+	n, err := strconv.ParseUint(*id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok = t.sessions.all[n]; !ok {
+		return nil, fmt.Errorf("No session with ID %d", n)
+	}
+
+	pm := s.pids
+	if pm == nil {
+		pm = t.pods.NewPidMap(s.containers)
+	}
+
+	return &map[string][]pods.PidInfo{*id: pm.Get()}, nil
+}
+
+/* Subscribe for the trace events of a running session */
+func (t *Tracer) subscribeSession(id *string) (<-chan *logger.TraceEvent, func(), error) {
+	var s *traceSession
+	var ok bool
+
+	n, err := strconv.ParseUint(*id, 10, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s, ok = t.sessions.all[n]; !ok {
+		return nil, nil, fmt.Errorf("No session with ID %d", n)
+	}
+	if s.tHookSession == nil {
+		return nil, nil, fmt.Errorf("Session %d is not running", n)
+	}
+	if ch, unsubscribe, ok := t.logger.Subscribe(&s.log); ok {
+		return ch, unsubscribe, nil
+	}
+
+	return nil, nil, fmt.Errorf("Session %d does not collect any traces", n)
+}
+
 func (t *Tracer) destroyAllSessions() {
 	for i := range t.sessions.all {
 		t.stopSession(i)
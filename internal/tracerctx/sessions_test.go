@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: GPL-2.0-or-later
+/*
+ * Copyright (C) 2022 VMware, Inc. Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+ *
+ */
+package tracerctx
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArguments(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		res  []string /* nil if the arguments are invalid */
+	}{
+		{"empty", ``, []string{}},
+		{"null", `null`, []string{}},
+		{"string", `"-e  sys_enter_openat --time 100"`, []string{"-e", "sys_enter_openat", "--time", "100"}},
+		{"empty string", `""`, []string{}},
+		{"array", `["--kprobe", "do_sys_openat2 dfd=%di", 100, true]`,
+			[]string{"--kprobe", "do_sys_openat2 dfd=%di", "100", "true"}},
+		{"object", `{"time": 100, "event": "sys_enter_read", "ratio": 0.5}`,
+			[]string{"--event", "sys_enter_read", "--ratio", "0.5", "--time", "100"}},
+		{"object bool", `{"block-only": true, "verbose": false}`, []string{"--block-only"}},
+		{"object array", `{"kprobe": ["do_sys_openat2 dfd=%di", "vfs_read"], "time": 10}`,
+			[]string{"--kprobe", "do_sys_openat2 dfd=%di", "vfs_read", "--time", "10"}},
+		{"object empty array", `{"event": []}`, []string{"--event"}},
+		{"nested array", `[["--time", "100"]]`, nil},
+		{"nested object", `{"event": {"name": "sys_enter_read"}}`, nil},
+		{"nested object in array", `{"event": [{"name": "sys_enter_read"}]}`, nil},
+		{"null in array", `[null]`, nil},
+		{"null in object", `{"event": null}`, nil},
+		{"number", `100`, nil},
+		{"bool", `true`, nil},
+		{"invalid json", `{"event": `, nil},
+	}
+
+	for _, tt := range tests {
+		res, err := parseArguments(json.RawMessage(tt.raw))
+		if tt.res == nil {
+			assert.NotNil(t, err, tt.name)
+			continue
+		}
+		if assert.Nil(t, err, tt.name) {
+			assert.Equal(t, tt.res, res, tt.name)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"hash/fnv"
 	"math/rand"
+	"os"
 	"strconv"
 	"time"
 
@@ -21,12 +22,25 @@ import (
 
 type Tracer struct {
 	pods     *pods.PodDb
+	watch    *podsWatch
 	hooks    *tracehook.TraceHooks
 	sessions *sessionDb
 	logger   *logger.Logger
 	node     *string
 }
 
+type tracerHealth struct {
+	Node      string
+	Status    string
+	Discovery []pods.DiscoverHealth
+}
+
+var (
+	healthOk       = "ok"
+	healthDegraded = "degraded"
+	healthFailed   = "failed"
+)
+
 type TracerConfig struct {
 	NodeName *string              /* Name of the cluster node */
 	Verbose  *bool                /* Print informational logs on the standard output. */
@@ -50,13 +64,21 @@ func NewTracer(ctx context.Context, cfg *TracerConfig) (*Tracer, error) {
 
 	setRandomSeed(cfg.NodeName)
 
-	if tr.pods, err = pods.NewPodDb(ctx, &cfg.Pod, cfg.Hook.Procfs); err != nil {
+	if tr.pods, err = pods.NewPodDb(ctx, &cfg.Pod, cfg.Hook.Procfs, cfg.Hook.Sysfs); err != nil {
 		return nil, err
 	}
+	tr.watch = newPodsWatch(tr.pods, podsWatchInterval)
 	if tr.hooks, err = tracehook.NewTraceHooksDb(&cfg.Hook); err != nil {
 		return nil, err
 	}
 
+	/* Pick up the trace hooks, added or removed at runtime */
+	go func() {
+		if err := tr.hooks.Watch(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+
 	if tr.sessions = newSessionDb(); tr.sessions == nil {
 		return nil, fmt.Errorf("Failed to create new session database")
 	}
@@ -68,6 +90,31 @@ func NewTracer(ctx context.Context, cfg *TracerConfig) (*Tracer, error) {
 	return &tr, nil
 }
 
+/* The tracer is degraded, if only a fallback backend is used for pods discovery */
+func (t *Tracer) getHealth() *tracerHealth {
+	res := tracerHealth{
+		Node:      *t.node,
+		Status:    healthFailed,
+		Discovery: t.pods.Health(),
+	}
+
+	for _, d := range res.Discovery {
+		if !d.Active {
+			continue
+		}
+		if !d.Fallback {
+			res.Status = healthOk
+			break
+		}
+		res.Status = healthDegraded
+	}
+
+	return &res
+}
+
+/* Stop all trace sessions and hooks, so no orphaned hook processes are left */
 func (t *Tracer) Destroy() {
+	t.destroyAllSessions()
+	t.hooks.Destroy()
 	t.logger.Destroy()
 }
@@ -7,23 +7,30 @@
 package tracekubectx
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	kapi "k8s.io/api/core/v1"
 )
 
+var (
+	streamLineMax = 64 * 1024 * 1024 /* Max size of one line of a streamed response */
+)
+
 func (t *TraceKube) sendRequest(pod string, req *http.Request, body io.ReadCloser) (*http.Response, error) {
 	var err error
 	var pReq *http.Request
 
 	url := fmt.Sprintf("%s%s", t.tracers[pod].target.String(), req.RequestURI)
-	if pReq, err = http.NewRequest(req.Method, url, body); err != nil {
+	/* Cancelled together with the request of the client, i.e. when it stops a stream */
+	if pReq, err = http.NewRequestWithContext(req.Context(), req.Method, url, body); err != nil {
 		return nil, err
 	}
 	pReq.Header = req.Header
@@ -56,6 +63,7 @@ func (t *TraceKube) proxySend(c *gin.Context, any bool) error {
 	var reqData []byte
 	var err error
 	errMsg := "Connection to tracers failed"
+	goneMsg := ""
 	status := http.StatusInternalServerError
 
 	if reqData, err = ioutil.ReadAll(c.Request.Body); err != nil {
@@ -78,6 +86,11 @@ func (t *TraceKube) proxySend(c *gin.Context, any bool) error {
 					resp.Body.Close()
 					break
 				}
+			} else if resp.StatusCode == http.StatusGone {
+				/* The requested revision of the pods is gone on a tracer, the client must get all pods again */
+				r, _ := io.ReadAll(resp.Body)
+				goneMsg = string(r)
+				fmt.Print("\t\t", goneMsg, "\n")
 			} else if status != http.StatusOK {
 				/* Save last received error, if there is still no StatusOK */
 				status = resp.StatusCode
@@ -92,7 +105,9 @@ func (t *TraceKube) proxySend(c *gin.Context, any bool) error {
 	}
 	t.trSync.RUnlock()
 
-	if status == http.StatusOK {
+	if goneMsg != "" {
+		c.JSON(http.StatusGone, goneMsg)
+	} else if status == http.StatusOK {
 		if aggregatedData != nil {
 			if d, e := json.Marshal(aggregatedData); e == nil {
 				c.Writer.Write(d)
@@ -114,3 +129,91 @@ func (t *TraceKube) ProxyAnyMap(c *gin.Context) {
 func (t *TraceKube) ProxyAllMap(c *gin.Context) {
 	t.proxySend(c, false)
 }
+
+/* Forward a streaming request to all tracers and merge their responses, line by line */
+func (t *TraceKube) ProxyAllStream(c *gin.Context) {
+	resps := []*http.Response{}
+	errMsg := "Connection to tracers failed"
+	goneMsg := ""
+	status := http.StatusInternalServerError
+
+	t.trSync.RLock()
+	for n, p := range t.tracers {
+		if p.state != kapi.PodRunning || p.client == nil {
+			continue
+		}
+		fmt.Print("\tForward a stream request to ", p.target, " ... ")
+		resp, err := t.sendRequest(n, c.Request, nil)
+		if err != nil {
+			fmt.Print(err, "\n")
+			continue
+		}
+		fmt.Print(resp.StatusCode, "\n")
+		if resp.StatusCode == http.StatusOK {
+			resps = append(resps, resp)
+			continue
+		}
+		r, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			goneMsg = string(r)
+		} else {
+			status = resp.StatusCode
+			errMsg = string(r)
+		}
+		fmt.Print("\t\t", string(r), "\n")
+	}
+	t.trSync.RUnlock()
+
+	if goneMsg != "" || len(resps) == 0 {
+		for _, r := range resps {
+			r.Body.Close()
+		}
+		if goneMsg != "" {
+			c.JSON(http.StatusGone, goneMsg)
+		} else {
+			c.JSON(status, errMsg)
+		}
+		return
+	}
+
+	/* The streams end when the client goes away, as the forwarded requests are cancelled */
+	done := c.Request.Context().Done()
+	lines := make(chan []byte)
+	var wg sync.WaitGroup
+	for _, r := range resps {
+		wg.Add(1)
+		go func(r *http.Response) {
+			defer wg.Done()
+			defer r.Body.Close()
+			scan := bufio.NewScanner(r.Body)
+			scan.Buffer(nil, streamLineMax)
+			for scan.Scan() {
+				select {
+				case lines <- append(append([]byte{}, scan.Bytes()...), '\n'):
+				case <-done:
+					return
+				}
+			}
+		}(r)
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				return false
+			}
+			w.Write(l)
+			return true
+		case <-done:
+			return false
+		}
+	})
+}
@@ -9,10 +9,11 @@ Manager of trace helper programs located in the same directory:
  - run a trace program
 """
 
-import os, subprocess, signal, sys
+import os, subprocess, signal, sys, json, glob, threading, time
 import argparse, string, random
 from pathlib import Path
 import tracecruncher.ftracepy as ft
+import protocol
 
 scripts_dir="./"
 scripts_prefix = "trace_"
@@ -20,10 +21,13 @@ instance_prefix = "kube_"
 instance_name_len = 16 - len(instance_prefix)
 instance_name_chars = string.ascii_letters + string.digits
 max_ftrace_retries = 10
+instance_remove_tries = 20
+instance_remove_delay = 0.5
 envProc = "TRACER_PROCFS_PATH"
 envSys = "TRACER_SYSFS_PATH"
 procDefPath = "/proc"
 sysDefPath = "/sys"
+stats_period = 5
 
 description="Manager of trace scripts in the current directory"
 
@@ -35,15 +39,81 @@ def get_scripts():
 
 def run_script(name, arguments):
     signal.signal(signal.SIGUSR1, signal.SIG_IGN)
+    # The script runs in the process group of the manager and receives the same signals.
+    # Do not interrupt it on SIGINT, wait for it to stop the trace and to clean up.
+    signal.signal(signal.SIGINT, lambda signum, frame: None)
+    # Pass the protocol pipe to the script, it reports when the trace is ready
+    fds = ()
+    if protocol.enabled():
+        fds = (protocol.fd(),)
+    if protocol.output_fd() is not None:
+        fds += (protocol.output_fd(),)
     for file in os.listdir(scripts_dir):
       if file.startswith(name + "."):
         try:
-            output = subprocess.run(["./" + file] + arguments, capture_output=True, universal_newlines = True, start_new_session=True)
+            output = subprocess.run(["./" + file] + arguments, capture_output=True, universal_newlines = True, pass_fds=fds)
             print(output.stdout, flush=True)
             print(output.stderr, file=sys.stderr, flush=True)
+            if output.returncode != 0:
+                protocol.error(output.stderr.strip() or "Trace script failed with code {0}".format(output.returncode))
         except KeyboardInterrupt:
             pass
-    exit(0)
+
+def check_script(name):
+    # Print the reasons, why the script cannot be used on this node, and exit with non zero code
+    if not os.path.isdir(ft.dir()+"/instances"):
+        print("ftrace instances are not available in " + ft.dir())
+        exit(1)
+    for file in os.listdir(scripts_dir):
+      if file.startswith(name + "."):
+        output = subprocess.run(["./" + file, "--check"], capture_output=True, universal_newlines = True)
+        print(output.stdout, flush=True)
+        exit(output.returncode)
+    print("Cannot find trace script " + name)
+    exit(1)
+
+def send_stats(idir):
+    # Periodically report the number of recorded and lost events of the instance
+    while True:
+        entries = 0
+        overrun = 0
+        for f in glob.glob(idir + "/per_cpu/cpu*/stats"):
+            try:
+                with open(f) as s:
+                    for l in s:
+                        w = l.split(":")
+                        if len(w) != 2:
+                            continue
+                        if w[0].strip() == "entries":
+                            entries += int(w[1])
+                        elif w[0].strip() == "overrun":
+                            overrun += int(w[1])
+            except (OSError, ValueError):
+                pass
+        protocol.stats(events=entries, lost=overrun)
+        threading.Event().wait(stats_period)
+
+def remove_instance(idir):
+    # Stop following the forked tasks before clearing the PID filters, the kernel keeps adding the
+    # children of the traced tasks to the filters while the fork options are set.
+    for f, v in [("tracing_on", "0"), ("options/event-fork", "0"), ("options/function-fork", "0"),
+                 ("set_event_pid", ""), ("set_ftrace_pid", "")]:
+        try:
+            with open(idir + "/" + f, "w") as fd:
+                fd.write(v)
+        except OSError:
+            pass
+    # The instance is busy while its trace pipe is open, wait for the reader to close it
+    for _ in range(instance_remove_tries):
+        try:
+            os.rmdir(idir)
+            return True
+        except FileNotFoundError:
+            return True
+        except OSError:
+            time.sleep(instance_remove_delay)
+    print("Failed to remove trace instance " + idir, file=sys.stderr, flush=True)
+    return False
 
 def run_trace(name, arguments):
     instance = None
@@ -57,15 +127,24 @@ def run_trace(name, arguments):
         retries-=1
         pass
     if not instance:
+      protocol.error("Failed to create a trace instance")
       raise RuntimeError("Failed to create a trace instance")
-    print(ft.dir()+"/instances/"+iname+"/trace_pipe", flush=True)
+    idir = ft.dir()+"/instances/"+iname
+    if protocol.enabled():
+        # The instance is owned by the tracer, it is removed even if the manager is killed
+        protocol.resource("instance", iname)
+        # The script reports the output and the traced PIDs, when the trace is running
+        threading.Thread(target=send_stats, args=(idir,), daemon=True).start()
+    else:
+        print(idir+"/trace_pipe", flush=True)
     run_script(name, arguments + ["--instance", iname])
+    remove_instance(idir)
 
 def reset_ftrace():
     instances = [f.path for f in os.scandir(ft.dir()+"/instances") if f.is_dir()]
     for i in list(instances):
       if (Path(i).stem.startswith(instance_prefix)):
-        os.rmdir(i)
+        remove_instance(i)
     exit(0)
 
 def set_ftrace_dir():
@@ -109,21 +188,40 @@ if __name__ == "__main__":
                         help="Get available scripts")
     parser.add_argument('-d', '--describe', nargs=1, dest='get_desc',
                         help="Get description of a script")
+    parser.add_argument('--check', nargs=1, dest='check',
+                        help="Check if a script can be used on this node")
     parser.add_argument('-c', '--clear', action='store_true', dest='reset',
-                        help="Reset ftrace subsystem to default")
+                        help="Remove all trace instances, created by any tracer")
+    parser.add_argument('--protocol-version', action='store_true', dest='protocol_version',
+                        help="Get the latest version of the tracer protocol, supported by the manager")
     parser.add_argument('-r', '--run', dest='script', nargs=1, help="Name of a trace script to run")
     parser.add_argument('-a', '--args', dest='arguments',  nargs=1,
-                        help="Arguments of a trace script")
+                        help="Arguments of a trace script, separated by white spaces")
+    parser.add_argument('-j', '--args-json', dest='arguments_json',  nargs=1,
+                        help="Arguments of a trace script, as a JSON array of strings")
 
     set_ftrace_dir()
 
     args = parser.parse_args()
 
+    if args.protocol_version:
+      print(protocol.version)
+      exit(0)
     if args.get_all:
       get_scripts()
+    if args.check:
+      check_script(args.check[0])
     if args.get_desc:
       run_script(args.get_desc[0], ["--describe"])
+      exit(0)
     if args.reset:
         reset_ftrace()
     if args.script:
-        run_trace(args.script[0], list(args.arguments[0].split(" ")))
+        if args.arguments_json:
+            arguments = [str(a) for a in json.loads(args.arguments_json[0])]
+        elif args.arguments:
+            arguments = list(args.arguments[0].split())
+        else:
+            arguments = []
+        run_trace(args.script[0], arguments)
+        exit(0)
@@ -0,0 +1,94 @@
+"""
+SPDX-License-Identifier: GPL-2.0-or-later
+Copyright 2022 VMware Inc, Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+
+Versioned JSON lines protocol, used to report the state of a trace hook to the tracer.
+The tracer passes a pipe to the manager, as a file descriptor in TRACER_HOOK_PROTOCOL_FD.
+Since version 2, the traces are written to another pipe, passed in TRACER_OUTPUT_FD.
+"""
+
+import os, json
+
+version = 2
+envFd = "TRACER_HOOK_PROTOCOL_FD"
+envVersion = "TRACER_HOOK_PROTOCOL_VERSION"
+envOutputFd = "TRACER_OUTPUT_FD"
+envContext = "TRACER_CONTEXT"
+
+_pipe = None
+
+def _env_fd(name):
+    f = os.environ.get(name)
+    if not f:
+        return None
+    try:
+        return int(f)
+    except ValueError:
+        return None
+
+def fd():
+    """ File descriptor of the protocol pipe, or None if the tracer uses the legacy protocol """
+    return _env_fd(envFd)
+
+def output_fd():
+    """ File descriptor of the pipe for the traces, or None if the traces must be read from a file """
+    return _env_fd(envOutputFd)
+
+def copy_output(path, fd):
+    """ Copy the traces from the file to the output pipe. Blocks while the tracer is busy """
+    with open(path, "rb", buffering=0) as src, os.fdopen(fd, "wb", buffering=0) as dst:
+        while True:
+            data = src.read(65536)
+            if not data:
+                break
+            dst.write(data)
+
+def enabled():
+    return fd() is not None
+
+def context():
+    """ Context of the trace session - node, session, user context and the traced containers """
+    try:
+        return json.loads(os.environ.get(envContext, "{}"))
+    except ValueError:
+        return {}
+
+def send(type, **fields):
+    global _pipe
+    f = fd()
+    if f is None:
+        return
+    if _pipe is None:
+        _pipe = os.fdopen(f, 'w', buffering=1, closefd=False)
+    msg = {"version": version, "type": type}
+    msg.update(fields)
+    try:
+        _pipe.write(json.dumps(msg) + "\n")
+        _pipe.flush()
+    except OSError:
+        pass
+
+def ready():
+    send("ready")
+
+def output(path, format="ftrace", pipe=False):
+    if pipe:
+        send("output", path=path, format=format, pipe=True)
+    else:
+        send("output", path=path, format=format)
+
+def pids(pids):
+    send("pids", pids=pids)
+
+def warning(message):
+    send("warning", message=message)
+
+def error(message):
+    send("error", message=message)
+
+def stats(**values):
+    send("stats", stats=values)
+
+def resource(kind, name):
+    """ Report a trace instance or a dynamic event, created by the hook. The tracer removes it, if the hook does not """
+    send("resource", kind=kind, name=name)
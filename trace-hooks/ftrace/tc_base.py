@@ -8,8 +8,9 @@ A helper base class, implementing common functionality for all trace-cruncher ba
 """
 
 
-import argparse
+import argparse, threading
 import tracecruncher.ftracepy as ft
+import protocol
 
 class tracer:
     def __init__(self, prog_desc, args_desc):
@@ -17,6 +18,8 @@ class tracer:
         self.args_description = args_desc
         self.duration = 0
         self.instance = None
+        self.instance_dir = None
+        self.format = "ftrace"
         self.parser = argparse.ArgumentParser(description=prog_desc)
         self.parser.add_argument('-p', '--pid', nargs='+', dest='pids', type=int,
                                  help="list of Process IDs to be traced, optional argument")
@@ -28,6 +31,12 @@ class tracer:
                                  help="Duration of the trace in milliseconds, optional argument")
         self.parser.add_argument('--describe', action='store_true', dest='describe',
                                  help="Description of the script, displayed to the user")
+        self.parser.add_argument('--check', action='store_true', dest='check',
+                                 help="Check if the script can be used on this node")
+
+    def check(self):
+        """ Return a list of reasons, why the script cannot be used on this node """
+        return []
 
     def parse_arguments(self):
         self.args = self.parser.parse_args()
@@ -36,6 +45,11 @@ class tracer:
             print(self.args_description)
             print("-t, --time TIME : Duration of the trace in milliseconds, optional argument")
             exit(0)
+        if self.args.check:
+            reasons = self.check()
+            for r in reasons:
+                print(r)
+            exit(1 if reasons else 0)
         if self.args.time:
             self.duration = self.args.time[0]
         if self.args.instance:
@@ -43,6 +57,7 @@ class tracer:
             self.instance = ft.find_instance(self.args.instance[0])
           except:
             self.instance = ft.create_instance(tracing_on=False, name=self.args.instance[0])
+          self.instance_dir = ft.dir() + "/instances/" + self.args.instance[0]
         else:
           self.instance = ft.create_instance(tracing_on=False)
         if not self.args.pids and not self.args.parent:
@@ -50,19 +65,24 @@ class tracer:
     def run_trace(self):
         ft.enable_option(option="event-fork", instance=self.instance)
         ft.enable_option(option="function-fork", instance=self.instance)
-        if self.args.pids:
-            ft.set_event_pid(pid=self.args.pids, instance=self.instance)
-            ft.set_ftrace_pid(pid=self.args.pids, instance=self.instance)
-        if self.args.parent:
-            ft.set_event_pid(pid=self.args.parent, instance=self.instance)
-            ft.set_ftrace_pid(pid=self.args.parent, instance=self.instance)
+        # The filters are overwritten on each call, set the tasks and their parents at once.
+        # The children, started later by the parents, are added by the kernel.
+        traced = (self.args.pids or []) + (self.args.parent or [])
+        ft.set_event_pid(pid=traced, instance=self.instance)
+        ft.set_ftrace_pid(pid=traced, instance=self.instance)
         ft.tracing_ON(instance=self.instance)
+        if self.instance_dir:
+            ofd = protocol.output_fd()
+            if ofd is not None:
+                # The tracer may run in another mount name space, pass the traces through its pipe
+                threading.Thread(target=protocol.copy_output, daemon=True,
+                                 args=(self.instance_dir + "/trace_pipe", ofd)).start()
+            protocol.output(self.instance_dir + "/trace_pipe", self.format, pipe=ofd is not None)
+        protocol.pids(traced)
+        protocol.ready()
 
-        wait_pids = []
-        if self.args.pids:
-            wait_pids.extend(self.args.pids)
-        if self.args.parent:
-            wait_pids.extend(self.args.parent)
+        # The parents usually outlive the tasks, wait for them only if no tasks are given
+        wait_pids = self.args.pids or self.args.parent
         ft.wait(signals=['SIGUSR1', 'SIGINT'], pids=wait_pids, time=self.duration)
 
         ft.tracing_OFF(instance=self.instance)
@@ -0,0 +1,105 @@
+#!/usr/bin/env python3
+
+"""
+SPDX-License-Identifier: GPL-2.0-or-later
+
+Copyright 2022 VMware Inc, Tzvetomir Stoyanov (VMware) <tz.stoyanov@gmail.com>
+"""
+
+import os
+import tracecruncher.ftracepy as ft
+import tc_base as tc
+import protocol
+
+script_description = "Trace kernel function call graphs of given container"
+args_description = """
+-f, --function [FUNCTION ...] : list of kernel functions to be graphed, optional argument.
+                                Wildcards are supported. If not specified, all functions are graphed.
+-e, --exclude [FUNCTION ...]  : list of kernel functions to be excluded from the graph, optional argument.
+                                Wildcards are supported.
+-d, --depth DEPTH             : maximum depth of the graph, optional argument."""
+
+tracer_name = "function_graph"
+graph_options = {
+    "funcgraph-abstime": "1",
+    "funcgraph-proc": "1",
+    "funcgraph-tail": "1",
+}
+
+class funcgraph_tracer(tc.tracer):
+    def __init__(self, description):
+        super().__init__(prog_desc=script_description, args_desc=args_description)
+        self.format = "function_graph"
+        self.options = {}
+        self.parser.add_argument('-f', '--function', nargs='+', dest='function',
+                                 help="list of kernel functions to be graphed, optional")
+        self.parser.add_argument('-e', '--exclude', nargs='+', dest='exclude',
+                                 help="list of kernel functions to be excluded from the graph, optional")
+        self.parser.add_argument('-d', '--depth', dest='depth', type=int,
+                                 help="maximum depth of the graph, optional")
+
+    def check(self):
+        try:
+            with open(ft.dir() + "/available_tracers") as f:
+                if tracer_name not in f.read().split():
+                    return ["The " + tracer_name + " tracer is not available in the kernel"]
+        except OSError as e:
+            return ["Cannot read available tracers: {0}".format(e)]
+        return []
+
+    def write(self, file, value, append=False):
+        with open(self.instance_dir + "/" + file, "a" if append else "w") as f:
+            f.write(value)
+
+    def read(self, file):
+        with open(self.instance_dir + "/" + file) as f:
+            return f.read().strip()
+
+    def set_functions(self, file, functions):
+        self.write(file, "")
+        for func in functions or []:
+            try:
+                self.write(file, func, append=True)
+            except OSError:
+                raise ValueError("Function", func, "is not available in the system")
+
+    def parse(self):
+        self.parse_arguments()
+        if not self.instance_dir:
+            raise ValueError("No trace instance is provided.")
+
+    def setup(self):
+        self.set_functions("set_graph_function", self.args.function)
+        self.set_functions("set_graph_notrace", self.args.exclude)
+        if self.args.depth:
+            if os.path.exists(self.instance_dir + "/max_graph_depth"):
+                self.write("max_graph_depth", str(self.args.depth))
+            else:
+                protocol.warning("The maximum graph depth cannot be set per trace instance, it is ignored")
+        # The options of the tracer are available, when it is the current one
+        self.write("current_tracer", tracer_name)
+        for o, v in graph_options.items():
+            try:
+                self.options[o] = self.read("options/" + o)
+                self.write("options/" + o, v)
+            except OSError:
+                protocol.warning("Option " + o + " is not supported")
+
+    def cleanup(self):
+        for o, v in self.options.items():
+            self.write("options/" + o, v)
+        self.write("current_tracer", "nop")
+        self.set_functions("set_graph_function", [])
+        self.set_functions("set_graph_notrace", [])
+
+    def trace(self):
+        self.setup()
+        try:
+            self.run_trace()
+        finally:
+            self.cleanup()
+
+if __name__ == "__main__":
+    fg_tracer = funcgraph_tracer(description=script_description)
+    fg_tracer.parse()
+    fg_tracer.trace()
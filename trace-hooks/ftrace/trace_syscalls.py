@@ -13,7 +13,10 @@ import tc_base as tc
 script_description = "Trace system calls, used by given container"
 args_description = """
 -s, --syscall [SYSCALL ...] : list of System call names to be traced, optional argument.
-                              If no system calls are specified, all available are traced."""
+                              If no system calls are specified, all available are traced.
+-f, --filter FILTER         : ftrace filter expression, applied to the traced system calls,
+                              optional argument. For example "ret < 0" or "fd == 3".
+"""
 
 class syscall_tracer(tc.tracer):
     def __init__(self, description):
@@ -21,7 +24,16 @@ class syscall_tracer(tc.tracer):
         super().__init__(prog_desc=script_description, args_desc=args_description)
         self.parser.add_argument('-s', '--syscall', nargs='+', dest='syscall',
                                  help="list of System call names to be traced, optional")
+        self.parser.add_argument('-f', '--filter', dest='filter',
+                                 help="ftrace filter expression, optional")
 
+    def check(self):
+        try:
+            if not ft.available_system_events(system='syscalls', sort=False):
+                return ["No system call events are available"]
+        except Exception as e:
+            return ["System call events are not available: {0}".format(e)]
+        return []
     def parse(self):
         self.parse_arguments()
         events = ft.available_system_events(system='syscalls', sort=False)
@@ -37,13 +49,19 @@ class syscall_tracer(tc.tracer):
           for s in events:
             if "sys_enter_" in s:
               self.syscalls.append(s)
-    def filterParents(self):
+    def setFilter(self):
         filter=""
-        for p in self.args.parent:
+        if self.args.parent:
+            for p in self.args.parent:
+                if filter == "":
+                    filter = 'common_pid != {0}'.format(p)
+                else:
+                    filter += '&& common_pid != {0}'.format(p)
+        if self.args.filter:
             if filter == "":
-                filter = 'common_pid != {0}'.format(p)
+                filter = self.args.filter
             else:
-                filter += '&& common_pid != {0}'.format(p)
+                filter = '({0}) && {1}'.format(self.args.filter, filter)
         if filter != "":
            ft.set_event_filter(instance=self.instance, system='syscalls', filter=filter)
     def trace(self):
@@ -52,8 +70,7 @@ class syscall_tracer(tc.tracer):
         else:
           events = ['all']
         ft.enable_events(instance=self.instance, events={'syscalls': events})
-        if self.args.parent:
-            self.filterParents()
+        self.setFilter()
         self.run_trace()
         ft.disable_events(instance=self.instance, events={'syscalls': events})
         ft.clear_event_filter(instance=self.instance, system='syscalls')